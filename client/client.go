@@ -34,6 +34,7 @@ type ProgramOutput struct {
 //OutputPack Represents the output package
 type OutputPack struct {
 	Error       bool          `json:"error"`
+	ErrorCode   string        `json:"errorCode"`
 	ErrorString string        `json:"errorString"`
 	Output      ProgramOutput `json:"execution"`
 }
@@ -116,6 +117,7 @@ func pprint(response *OutputPack) {
 	fmt.Println("-------------------")
 	if response.Error {
 		fmt.Println(string(colorRed), "Server encountered an error processing the file")
+		fmt.Println(string(colorRed), "Error code: ", response.ErrorCode)
 		fmt.Println(string(colorRed), "Error message: ", response.ErrorString)
 		return
 	}
@@ -3,6 +3,8 @@
 #include <stdio.h>
 #include <fcntl.h>
 #include <stdbool.h>
+#include <string.h>
+#include <sys/wait.h>
 
 
 #define BUFFER_SIZE 4096
@@ -10,7 +12,12 @@
 
 typedef unsigned char uchar;
 
-void write_stdin_to_file(int * size) {
+/*
+ * Reads the binary from stdin. When expected is not negative, exactly expected
+ * bytes are read and the rest of stdin is left to the program as its input.
+ * Otherwise the binary is read until EOF.
+ */
+void write_stdin_to_file(int * size, long expected) {
 
     uchar buffer[BUFFER_SIZE];
     int read_bytes = 0, itrs = 0;
@@ -25,7 +32,16 @@ void write_stdin_to_file(int * size) {
     }
     
     while (true) {
-        read_bytes = read(0, buffer, BUFFER_SIZE);
+        long wanted = BUFFER_SIZE;
+        if (expected >= 0 && expected - *size < wanted) {
+            wanted = expected - *size;
+        }
+
+        if (wanted == 0) {
+            break;
+        }
+
+        read_bytes = read(0, buffer, wanted);
         if (read_bytes < 0) {
             fprintf(stdout, "Failed to read binary data, exiting");
             fclose(fp);
@@ -46,44 +62,109 @@ void write_stdin_to_file(int * size) {
     fclose(fp);
 }
 
+/*
+ * Builds the command running the binary with the arguments of the program,
+ * every argument is single-quoted for the shell run by popen.
+ */
+char * binary_command(int argc, char **argv) {
+    size_t length = strlen("./binary") + 1;
+    for (int i = 0; i < argc; i++) {
+        //a quote becomes '\'' and every argument is surrounded by quotes
+        length += strlen(argv[i]) * 4 + 3;
+    }
+
+    char * command = malloc(length);
+    if (command == NULL) {
+        fprintf(stdout, "Failed to allocate the command\n");
+        exit(-1);
+    }
+
+    char * end = command;
+    end += sprintf(end, "./binary");
+    for (int i = 0; i < argc; i++) {
+        *end++ = ' ';
+        *end++ = '\'';
+        for (char * c = argv[i]; *c != '\0'; c++) {
+            if (*c == '\'') {
+                end += sprintf(end, "'\\''");
+            } else {
+                *end++ = *c;
+            }
+        }
+        *end++ = '\'';
+    }
+    *end = '\0';
+
+    return command;
+}
+
+/*
+ * Maps the status of the program to an exit code, a program killed by a
+ * signal exits with 128 plus the signal like in a shell, 137 for SIGKILL.
+ */
+int exit_status(int status) {
+    if (status == -1) {
+        fprintf(stdout, "Failed to wait for the binary\n");
+        return 1;
+    }
+
+    if (WIFEXITED(status)) {
+        return WEXITSTATUS(status);
+    }
+
+    if (WIFSIGNALED(status)) {
+        return 128 + WTERMSIG(status);
+    }
+
+    return 1;
+}
+
 int main(int argc, char **argv) {
-    int size = 0, fread_bytes = 0;
+    int size = 0, read_bytes = 0;
 
     char output_buffer[OUTPUT_BUFFER];
-    write_stdin_to_file(&size);
+
+    //gopg passes the size of the binary, stdin then continues with the input of the program.
+    //The arguments of the program follow the size
+    long expected = -1;
+    if (argc > 1) {
+        expected = strtol(argv[1], NULL, 10);
+    }
+    char * command = binary_command(argc > 2 ? argc - 2 : 0, argv + 2);
+
+    write_stdin_to_file(&size, expected);
 
     if (size == 0) {
         fprintf(stdout, "Empty binary file, discarding\n");
         exit(0);
     }
 
-    FILE * process_fd = popen("./binary", "r");
+    FILE * process_fd = popen(command, "r");
     if (process_fd == NULL) {
         fprintf(stdout, "Failed to execute the binary\n");
         exit(-1);
     }
 
     fprintf(stdout, "Executing binary inside the sandbox\n");
+    fflush(stdout);
 
-    //read the data as buffers and stream it to stdout
+    //stream the output as it comes, gopg forwards it to the clients of /executeStream
     while (true) {
-        fread_bytes = fread(output_buffer, sizeof(uchar), sizeof(uchar) * OUTPUT_BUFFER, process_fd);
+        read_bytes = read(fileno(process_fd), output_buffer, OUTPUT_BUFFER);
 
-        if (fread_bytes == 0) {
-            //EOF
-            fclose(process_fd);
-            exit(0);
+        if (read_bytes == 0) {
+            //EOF, exit like the program so that gopg can tell how it ended
+            exit(exit_status(pclose(process_fd)));
         }
 
-        if (fread_bytes < 0) {
+        if (read_bytes < 0) {
             //Error 
             fprintf(stdout, "Failed to read the output");
             exit(-1);
         }
 
-        output_buffer[fread_bytes] = '\0';
-
-        fprintf(stdout, "%s", output_buffer);
+        fwrite(output_buffer, sizeof(uchar), read_bytes, stdout);
+        fflush(stdout);
     }
 
     return 0;
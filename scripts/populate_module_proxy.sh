@@ -0,0 +1,38 @@
+#!/bin/bash
+
+#Populates a local GOPROXY directory with the given modules and their dependencies
+#usage: ./populate_module_proxy.sh <proxy-dir> <module@version>...
+
+PROXY_DIR=$1
+shift
+
+if [[ -z "$PROXY_DIR" || $# -eq 0 ]]; then
+    echo "usage: $0 <proxy-dir> <module@version>..."
+    exit 1
+fi
+
+DOWNLOAD_CACHE=$(mktemp -d)
+WORK_DIR=$(mktemp -d)
+
+pushd $WORK_DIR
+    export GOMODCACHE=$DOWNLOAD_CACHE
+    go mod init gopg/proxy
+
+    for module in "$@"; do
+        go get $module || exit 1
+    done
+
+    go mod download all
+
+    echo "Modules available in the proxy, add the ones programs may require to the module configuration:"
+    go list -m all | tail -n +2
+popd
+
+mkdir -p $PROXY_DIR
+cp -r $DOWNLOAD_CACHE/cache/download/. $PROXY_DIR/
+
+#the module cache is read-only
+chmod -R u+w $DOWNLOAD_CACHE
+rm -rf $DOWNLOAD_CACHE $WORK_DIR
+
+echo "Populated module proxy at $PROXY_DIR"
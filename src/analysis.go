@@ -0,0 +1,578 @@
+package main
+
+import (
+	"go/ast"
+	"go/build"
+	"go/doc"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//AnalysisFileName name given to the single-file program while analysing
+const AnalysisFileName string = "main.go"
+
+//AnalysisInput Represents the input of the analysis endpoints
+type AnalysisInput struct {
+	Program string `json:"program"`
+	Offset  int    `json:"offset"`
+}
+
+//Diagnostic Represents a syntax or type-check error
+type Diagnostic struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	Offset  int    `json:"offset"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+}
+
+//HoverInfo Represents the information of the identifier under the cursor
+type HoverInfo struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Type   string `json:"type"`
+	Doc    string `json:"doc"`
+	Offset int    `json:"offset"`
+	End    int    `json:"end"`
+}
+
+//Completion Represents a single completion candidate
+type Completion struct {
+	Label string `json:"label"`
+	Kind  string `json:"kind"`
+	Type  string `json:"type"`
+}
+
+//AnalysisOutput Represents the output of the analysis endpoints
+type AnalysisOutput struct {
+	Error       bool         `json:"error"`
+	ErrorString string       `json:"errorString"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+	Hover       *HoverInfo   `json:"hover,omitempty"`
+	Completions []Completion `json:"completions,omitempty"`
+	Formatted   string       `json:"formatted,omitempty"`
+}
+
+//lockedImporter serializes access to the source importer, which keeps
+//an unsynchronized package cache
+type lockedImporter struct {
+	lock     *sync.Mutex
+	importer types.ImporterFrom
+}
+
+func (l *lockedImporter) Import(path string) (*types.Package, error) {
+	return l.ImportFrom(path, "", 0)
+}
+
+func (l *lockedImporter) ImportFrom(path, dir string, mode types.ImportMode) (*types.Package, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.importer.ImportFrom(path, dir, mode)
+}
+
+//packageImporter is shared across requests so that the standard library
+//is type-checked only once
+var packageImporter = &lockedImporter{
+	lock:     &sync.Mutex{},
+	importer: importer.ForCompiler(token.NewFileSet(), "source", nil).(types.ImporterFrom),
+}
+
+//packageDocs caches the doc comments of imported packages, keyed by import path
+var packageDocs = struct {
+	lock *sync.Mutex
+	docs map[string]map[string]string
+}{
+	lock: &sync.Mutex{},
+	docs: make(map[string]map[string]string),
+}
+
+//Analysis holds the parsed and type-checked state of a single-file program
+type Analysis struct {
+	fset        *token.FileSet
+	file        *ast.File
+	source      string
+	pkg         *types.Package
+	info        *types.Info
+	diagnostics []Diagnostic
+}
+
+//NewAnalysis parses and type-checks the program, collecting every error as a diagnostic
+func NewAnalysis(program string) *Analysis {
+	analysis := Analysis{}
+	analysis.fset = token.NewFileSet()
+	analysis.source = program
+	analysis.diagnostics = make([]Diagnostic, 0)
+
+	file, err := parser.ParseFile(analysis.fset, AnalysisFileName, program, parser.AllErrors|parser.ParseComments)
+	if err != nil {
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				analysis.addDiagnostic("syntax", e.Msg, e.Pos)
+			}
+		} else {
+			analysis.diagnostics = append(analysis.diagnostics, Diagnostic{Kind: "syntax", Message: err.Error()})
+		}
+	}
+
+	if file == nil {
+		return &analysis
+	}
+
+	analysis.file = file
+	analysis.info = &types.Info{
+		Types:  make(map[ast.Expr]types.TypeAndValue),
+		Defs:   make(map[*ast.Ident]types.Object),
+		Uses:   make(map[*ast.Ident]types.Object),
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+
+	config := types.Config{
+		Importer: packageImporter,
+		Error: func(err error) {
+			if typeErr, ok := err.(types.Error); ok {
+				analysis.addDiagnostic("type", typeErr.Msg, typeErr.Fset.Position(typeErr.Pos))
+			}
+		},
+	}
+
+	//errors are reported through config.Error, the partial result is still usable
+	analysis.pkg, _ = config.Check(file.Name.Name, analysis.fset, []*ast.File{file}, analysis.info)
+
+	return &analysis
+}
+
+func (a *Analysis) addDiagnostic(kind string, message string, pos token.Position) {
+	a.diagnostics = append(a.diagnostics, Diagnostic{
+		Kind:    kind,
+		Message: message,
+		Offset:  pos.Offset,
+		Line:    pos.Line,
+		Column:  pos.Column,
+	})
+}
+
+//Diagnostics returns the syntax and type errors of the program
+func (a *Analysis) Diagnostics() []Diagnostic {
+	return a.diagnostics
+}
+
+func (a *Analysis) position(offset int) (token.Pos, bool) {
+	if a.file == nil || offset < 0 || offset > len(a.source) {
+		return token.NoPos, false
+	}
+
+	return a.fset.File(a.file.Pos()).Pos(offset), true
+}
+
+func (a *Analysis) offset(pos token.Pos) int {
+	return a.fset.Position(pos).Offset
+}
+
+func (a *Analysis) qualifier(pkg *types.Package) string {
+	if pkg == a.pkg {
+		return ""
+	}
+
+	return pkg.Name()
+}
+
+//Hover returns the type and doc of the identifier at offset, nil if there is none
+func (a *Analysis) Hover(offset int) *HoverInfo {
+	pos, ok := a.position(offset)
+	if !ok || a.info == nil {
+		return nil
+	}
+
+	var ident *ast.Ident
+	ast.Inspect(a.file, func(node ast.Node) bool {
+		if node == nil || ident != nil {
+			return false
+		}
+		if pos < node.Pos() || pos > node.End() {
+			return false
+		}
+		if id, ok := node.(*ast.Ident); ok {
+			ident = id
+			return false
+		}
+		return true
+	})
+
+	if ident == nil {
+		return nil
+	}
+
+	obj := a.info.Uses[ident]
+	if obj == nil {
+		obj = a.info.Defs[ident]
+	}
+	if obj == nil {
+		return nil
+	}
+
+	hover := HoverInfo{}
+	hover.Name = ident.Name
+	hover.Kind = objectKind(obj)
+	hover.Offset = a.offset(ident.Pos())
+	hover.End = a.offset(ident.End())
+	hover.Doc = a.objectDoc(obj)
+
+	if pkgName, ok := obj.(*types.PkgName); ok {
+		hover.Type = "package " + pkgName.Imported().Path()
+	} else if obj.Type() != nil {
+		hover.Type = types.TypeString(obj.Type(), a.qualifier)
+	}
+
+	return &hover
+}
+
+//Complete returns the completion candidates at offset
+func (a *Analysis) Complete(offset int) []Completion {
+	completions := make([]Completion, 0)
+
+	pos, ok := a.position(offset)
+	if !ok || a.info == nil || a.pkg == nil {
+		return completions
+	}
+
+	//walk back over the partially typed identifier
+	start := offset
+	for start > 0 && isIdentByte(a.source[start-1]) {
+		start--
+	}
+	prefix := a.source[start:offset]
+
+	if start > 0 && a.source[start-1] == '.' {
+		for _, candidate := range a.selectorCandidates(start - 1) {
+			if strings.HasPrefix(candidate.Label, prefix) {
+				completions = append(completions, candidate)
+			}
+		}
+		return completions
+	}
+
+	seen := make(map[string]bool)
+	for scope := a.innermostScope(pos); scope != nil; scope = scope.Parent() {
+		for _, name := range scope.Names() {
+			if seen[name] || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+
+			obj := scope.Lookup(name)
+			//objects declared further down a function body are not yet visible
+			if scope != a.pkg.Scope() && scope != types.Universe && obj.Pos() > pos {
+				continue
+			}
+
+			seen[name] = true
+			completions = append(completions, a.makeCompletion(obj))
+		}
+	}
+
+	sortCompletions(completions)
+	return completions
+}
+
+//selectorCandidates lists the members of the expression ending right before dot
+func (a *Analysis) selectorCandidates(dot int) []Completion {
+	candidates := make([]Completion, 0)
+
+	end := dot
+	for end > 0 && a.source[end-1] == ' ' {
+		end--
+	}
+	start := end
+	for start > 0 && isIdentByte(a.source[start-1]) {
+		start--
+	}
+	if start == end {
+		return candidates
+	}
+
+	name := a.source[start:end]
+	pos, _ := a.position(start)
+
+	_, obj := a.innermostScope(pos).LookupParent(name, pos)
+	if obj == nil {
+		return candidates
+	}
+
+	if pkgName, ok := obj.(*types.PkgName); ok {
+		scope := pkgName.Imported().Scope()
+		for _, member := range scope.Names() {
+			if memberObj := scope.Lookup(member); memberObj.Exported() {
+				candidates = append(candidates, a.makeCompletion(memberObj))
+			}
+		}
+		sortCompletions(candidates)
+		return candidates
+	}
+
+	typ := obj.Type()
+	if typ == nil {
+		return candidates
+	}
+	if _, isPointer := typ.Underlying().(*types.Pointer); !isPointer && !types.IsInterface(typ) {
+		typ = types.NewPointer(typ)
+	}
+
+	//methods, including promoted ones
+	methods := types.NewMethodSet(typ)
+	for idx := 0; idx < methods.Len(); idx++ {
+		candidates = append(candidates, a.makeCompletion(methods.At(idx).Obj()))
+	}
+
+	//fields, including promoted ones
+	for _, field := range structFields(typ) {
+		candidates = append(candidates, a.makeCompletion(field))
+	}
+
+	sortCompletions(candidates)
+	return candidates
+}
+
+func (a *Analysis) innermostScope(pos token.Pos) *types.Scope {
+	fileScope := a.info.Scopes[a.file]
+	if fileScope == nil {
+		return a.pkg.Scope()
+	}
+
+	if scope := fileScope.Innermost(pos); scope != nil {
+		return scope
+	}
+
+	return fileScope
+}
+
+func (a *Analysis) makeCompletion(obj types.Object) Completion {
+	completion := Completion{}
+	completion.Label = obj.Name()
+	completion.Kind = objectKind(obj)
+
+	if pkgName, ok := obj.(*types.PkgName); ok {
+		completion.Type = "package " + pkgName.Imported().Path()
+	} else if obj.Type() != nil {
+		completion.Type = types.TypeString(obj.Type(), a.qualifier)
+	}
+
+	return completion
+}
+
+//objectDoc looks up the doc comment of obj, either in the program or in the imported package
+func (a *Analysis) objectDoc(obj types.Object) string {
+	if pkgName, ok := obj.(*types.PkgName); ok {
+		return lookupPackageDocs(pkgName.Imported().Path())[""]
+	}
+
+	if obj.Pkg() == nil {
+		return ""
+	}
+
+	if obj.Pkg() == a.pkg {
+		return a.localDoc(obj.Pos())
+	}
+
+	return lookupPackageDocs(obj.Pkg().Path())[docKey(obj)]
+}
+
+//localDoc returns the doc comment of the declaration whose name is at pos
+func (a *Analysis) localDoc(pos token.Pos) string {
+	for _, decl := range a.file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Name.Pos() == pos {
+				return d.Doc.Text()
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				var names []*ast.Ident
+				var specDoc *ast.CommentGroup
+
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					names = []*ast.Ident{s.Name}
+					specDoc = s.Doc
+				case *ast.ValueSpec:
+					names = s.Names
+					specDoc = s.Doc
+				}
+
+				for _, name := range names {
+					if name.Pos() != pos {
+						continue
+					}
+					if specDoc != nil {
+						return specDoc.Text()
+					}
+					return d.Doc.Text()
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+//docKey names obj the same way lookupPackageDocs does, methods are keyed as Type.Method
+func docKey(obj types.Object) string {
+	fn, ok := obj.(*types.Func)
+	if !ok {
+		return obj.Name()
+	}
+
+	sig, ok := fn.Type().(*types.Signature)
+	if !ok || sig.Recv() == nil {
+		return obj.Name()
+	}
+
+	recv := sig.Recv().Type()
+	if pointer, ok := recv.(*types.Pointer); ok {
+		recv = pointer.Elem()
+	}
+	if named, ok := recv.(*types.Named); ok {
+		return named.Obj().Name() + "." + obj.Name()
+	}
+
+	return obj.Name()
+}
+
+//lookupPackageDocs parses the sources of an imported package and extracts its doc comments
+func lookupPackageDocs(path string) map[string]string {
+	packageDocs.lock.Lock()
+	defer packageDocs.lock.Unlock()
+
+	if docs, ok := packageDocs.docs[path]; ok {
+		return docs
+	}
+
+	docs := make(map[string]string)
+	packageDocs.docs[path] = docs
+
+	buildPkg, err := build.Import(path, "", 0)
+	if err != nil {
+		return docs
+	}
+
+	fset := token.NewFileSet()
+	files := make([]*ast.File, 0)
+
+	for _, name := range buildPkg.GoFiles {
+		file, err := parser.ParseFile(fset, buildPkg.Dir+"/"+name, nil, parser.ParseComments)
+		if err == nil {
+			files = append(files, file)
+		}
+	}
+
+	pkgDoc, err := doc.NewFromFiles(fset, files, path)
+	if err != nil {
+		return docs
+	}
+
+	docs[""] = pkgDoc.Doc
+
+	addValues := func(values []*doc.Value) {
+		for _, value := range values {
+			for _, name := range value.Names {
+				docs[name] = value.Doc
+			}
+		}
+	}
+
+	addValues(pkgDoc.Consts)
+	addValues(pkgDoc.Vars)
+	for _, fn := range pkgDoc.Funcs {
+		docs[fn.Name] = fn.Doc
+	}
+
+	for _, typ := range pkgDoc.Types {
+		docs[typ.Name] = typ.Doc
+		addValues(typ.Consts)
+		addValues(typ.Vars)
+		for _, fn := range typ.Funcs {
+			docs[fn.Name] = fn.Doc
+		}
+		for _, method := range typ.Methods {
+			docs[typ.Name+"."+method.Name] = method.Doc
+		}
+	}
+
+	return docs
+}
+
+//structFields collects the fields of the struct behind typ, including promoted fields
+func structFields(typ types.Type) []*types.Var {
+	fields := make([]*types.Var, 0)
+	seen := make(map[string]bool)
+
+	var collect func(t types.Type, depth int)
+	collect = func(t types.Type, depth int) {
+		if pointer, ok := t.Underlying().(*types.Pointer); ok {
+			t = pointer.Elem()
+		}
+
+		st, ok := t.Underlying().(*types.Struct)
+		if !ok || depth > 8 {
+			return
+		}
+
+		for idx := 0; idx < st.NumFields(); idx++ {
+			field := st.Field(idx)
+			if !seen[field.Name()] {
+				seen[field.Name()] = true
+				fields = append(fields, field)
+			}
+			if field.Embedded() {
+				collect(field.Type(), depth+1)
+			}
+		}
+	}
+
+	collect(typ, 0)
+	return fields
+}
+
+func objectKind(obj types.Object) string {
+	switch o := obj.(type) {
+	case *types.PkgName:
+		return "package"
+	case *types.Const:
+		return "const"
+	case *types.TypeName:
+		return "type"
+	case *types.Builtin:
+		return "builtin"
+	case *types.Nil:
+		return "nil"
+	case *types.Label:
+		return "label"
+	case *types.Func:
+		if sig, ok := o.Type().(*types.Signature); ok && sig.Recv() != nil {
+			return "method"
+		}
+		return "func"
+	case *types.Var:
+		if o.IsField() {
+			return "field"
+		}
+		return "var"
+	}
+
+	return "unknown"
+}
+
+func sortCompletions(completions []Completion) {
+	sort.Slice(completions, func(i, j int) bool {
+		return completions[i].Label < completions[j].Label
+	})
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+
+	//AuditQueryLimit default number of records answered by an audit query
+	AuditQueryLimit int = 100
+
+	//AuditQueryMaxLimit maximum number of records answered by an audit query
+	AuditQueryMaxLimit int = 1000
+
+	//auditDateLayout date in the name of the audit files
+	auditDateLayout string = "2006-01-02"
+)
+
+//AuditRecord Represents a program execution in the audit log
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+
+	//Client API key of the client as key:<id>, or its address as ip:<address>
+	Client  string `json:"client"`
+	KeyName string `json:"keyName,omitempty"`
+
+	//SourceHash SHA-256 of the sources and the go.mod, identical programs have the same hash
+	SourceHash string       `json:"sourceHash"`
+	Sources    []SourceFile `json:"sources,omitempty"`
+	GoMod      string       `json:"goMod,omitempty"`
+	StdinSize  int          `json:"stdinSize"`
+
+	//ErrorCode set when the program was not run
+	ErrorCode      ErrorCode `json:"errorCode,omitempty"`
+	Outcome        string    `json:"outcome,omitempty"`
+	Executor       string    `json:"executor,omitempty"`
+	Cached         bool      `json:"cached"`
+	CompileSeconds float64   `json:"compileSeconds"`
+	RunSeconds     float64   `json:"runSeconds"`
+	CPUSeconds     float64   `json:"cpuSeconds"`
+}
+
+//AuditQuery Represents the filters of an audit query, zero values match every record
+type AuditQuery struct {
+	//User matches the client, the key ID or the key name
+	User    string
+	Since   time.Time
+	Until   time.Time
+	Outcome string
+	Limit   int
+}
+
+//matches reports whether the record passes the filters of the query
+func (query *AuditQuery) matches(record *AuditRecord) bool {
+	if query.User != "" && query.User != record.Client && "key:"+query.User != record.Client && query.User != record.KeyName {
+		return false
+	}
+	if !query.Since.IsZero() && record.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !record.Time.Before(query.Until) {
+		return false
+	}
+	if query.Outcome != "" && query.Outcome != record.Outcome && query.Outcome != string(record.ErrorCode) {
+		return false
+	}
+
+	return true
+}
+
+//AuditLog append-only log of the executions, kept in one file per day.
+//A file larger than maxSize is continued in a new file of the same day
+type AuditLog struct {
+	dir     string
+	maxSize int64
+
+	lock *sync.Mutex
+
+	//file open file of the day, day and index name it
+	file  *os.File
+	size  int64
+	day   string
+	index int
+}
+
+//auditFileName name of the index-th file of the day
+func auditFileName(day string, index int) string {
+	if index == 0 {
+		return fmt.Sprintf("audit-%s.jsonl", day)
+	}
+
+	return fmt.Sprintf("audit-%s.%d.jsonl", day, index)
+}
+
+//parseAuditFileName returns the day and the index of an audit file
+func parseAuditFileName(name string) (string, int, bool) {
+	if !strings.HasPrefix(name, "audit-") || !strings.HasSuffix(name, ".jsonl") {
+		return "", 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(name, "audit-"), ".jsonl"), ".", 2)
+	if _, err := time.Parse(auditDateLayout, parts[0]); err != nil {
+		return "", 0, false
+	}
+	if len(parts) == 1 {
+		return parts[0], 0, true
+	}
+
+	index, err := strconv.Atoi(parts[1])
+	if err != nil || index < 1 {
+		return "", 0, false
+	}
+
+	return parts[0], index, true
+}
+
+//files lists the audit files, oldest first
+func (auditLog *AuditLog) files() ([]string, error) {
+	entries, err := ioutil.ReadDir(auditLog.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type auditFile struct {
+		name  string
+		day   string
+		index int
+	}
+
+	files := make([]auditFile, 0)
+	for _, entry := range entries {
+		day, index, ok := parseAuditFileName(entry.Name())
+		if ok && !entry.IsDir() {
+			files = append(files, auditFile{name: entry.Name(), day: day, index: index})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].day != files[j].day {
+			return files[i].day < files[j].day
+		}
+		return files[i].index < files[j].index
+	})
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.name)
+	}
+
+	return names, nil
+}
+
+//open makes the latest file of the day the current file, the caller holds the lock
+func (auditLog *AuditLog) open(day string) error {
+	if auditLog.file != nil {
+		auditLog.file.Close()
+		auditLog.file = nil
+	}
+
+	//continue the latest file of the day, after a restart
+	if auditLog.day != day {
+		auditLog.day = day
+		auditLog.index = 0
+		for {
+			_, err := os.Stat(filepath.Join(auditLog.dir, auditFileName(day, auditLog.index+1)))
+			if err != nil {
+				break
+			}
+			auditLog.index++
+		}
+	}
+
+	for {
+		path := filepath.Join(auditLog.dir, auditFileName(day, auditLog.index))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		if info.Size() < auditLog.maxSize {
+			auditLog.file = file
+			auditLog.size = info.Size()
+			return nil
+		}
+
+		file.Close()
+		auditLog.index++
+	}
+}
+
+//Append writes the record to the log and syncs it to disk
+func (auditLog *AuditLog) Append(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	auditLog.lock.Lock()
+	defer auditLog.lock.Unlock()
+
+	day := record.Time.UTC().Format(auditDateLayout)
+	if auditLog.file == nil || day != auditLog.day || auditLog.size+int64(len(data)) > auditLog.maxSize {
+		if day == auditLog.day && auditLog.file != nil {
+			auditLog.index++
+		}
+
+		err = auditLog.open(day)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = auditLog.file.Write(data)
+	if err != nil {
+		return err
+	}
+	auditLog.size += int64(len(data))
+
+	return auditLog.file.Sync()
+}
+
+//Query returns the records matching the query, newest first
+func (auditLog *AuditLog) Query(query AuditQuery) ([]*AuditRecord, error) {
+	names, err := auditLog.files()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*AuditRecord, 0)
+
+	//newest files first, a file holds the records of its day only
+	for i := len(names) - 1; i >= 0 && len(records) < query.Limit; i-- {
+		day, _, _ := parseAuditFileName(names[i])
+		start, _ := time.Parse(auditDateLayout, day)
+		if !query.Until.IsZero() && !start.Before(query.Until) {
+			continue
+		}
+		if !query.Since.IsZero() && !start.Add(24*time.Hour).After(query.Since) {
+			break
+		}
+
+		fileRecords, err := auditLog.readFile(names[i], &query)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := len(fileRecords) - 1; j >= 0 && len(records) < query.Limit; j-- {
+			records = append(records, fileRecords[j])
+		}
+	}
+
+	return records, nil
+}
+
+//readFile returns the records of an audit file matching the query, in the order they were written
+func (auditLog *AuditLog) readFile(name string, query *AuditQuery) ([]*AuditRecord, error) {
+	file, err := os.Open(filepath.Join(auditLog.dir, name))
+	if os.IsNotExist(err) {
+		//removed by the retention
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*AuditRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			//a record cut short by a crash
+			continue
+		}
+
+		if query.matches(&record) {
+			records = append(records, &record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+//Purge removes the files of the days older than retention
+func (auditLog *AuditLog) Purge(retention time.Duration, now time.Time) error {
+	names, err := auditLog.files()
+	if err != nil {
+		return err
+	}
+
+	oldest := now.UTC().Add(-retention).Format(auditDateLayout)
+	for _, name := range names {
+		day, _, _ := parseAuditFileName(name)
+		if day >= oldest {
+			break
+		}
+
+		auditLog.lock.Lock()
+		if day == auditLog.day && auditLog.file != nil {
+			auditLog.file.Close()
+			auditLog.file = nil
+		}
+		err = os.Remove(filepath.Join(auditLog.dir, name))
+		auditLog.lock.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Close closes the current file
+func (auditLog *AuditLog) Close() error {
+	auditLog.lock.Lock()
+	defer auditLog.lock.Unlock()
+
+	if auditLog.file == nil {
+		return nil
+	}
+
+	err := auditLog.file.Close()
+	auditLog.file = nil
+	return err
+}
+
+//NewAuditLog creates an audit log writing to dir, files are continued up to maxSize bytes
+func NewAuditLog(dir string, maxSize int64) (*AuditLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog := AuditLog{}
+	auditLog.dir = dir
+	auditLog.maxSize = maxSize
+	auditLog.lock = &sync.Mutex{}
+
+	return &auditLog, nil
+}
+
+//purgeAudit periodically removes the audit files older than audit-retention-days
+func purgeAudit(auditLog *AuditLog, interval time.Duration) {
+	for range time.Tick(interval) {
+		retention := time.Duration(currentConfig().AuditRetentionDays) * 24 * time.Hour
+		err := auditLog.Purge(retention, time.Now())
+		if err != nil {
+			slog.Error("Failed to purge the audit log", "error", err)
+		}
+	}
+}
+
+//hashSources returns the hex encoded SHA-256 of the sources and the go.mod of a program
+func hashSources(input *InputPack) string {
+	digest := sha256.New()
+	for _, source := range input.sources() {
+		fmt.Fprintf(digest, "%s\x00%d\x00%s", source.Name, len(source.Content), source.Content)
+	}
+	fmt.Fprintf(digest, "go.mod\x00%d\x00%s", len(input.GoMod), input.GoMod)
+
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+//redactAddress replaces the address of an ip:<address> client by its network,
+//a /24 for IPv4 and a /48 for IPv6. A hash would not redact anything, the
+//whole IPv4 space is hashed in minutes
+func redactAddress(client string) string {
+	if !strings.HasPrefix(client, "ip:") {
+		return client
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(client, "ip:"))
+	if ip == nil {
+		return "ip:redacted"
+	}
+
+	bits := 48
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 24
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, len(ip)*8)), Mask: net.CIDRMask(bits, len(ip)*8)}
+
+	return "ip:" + network.String()
+}
+
+//auditExecution records the execution of input in the audit log, applying
+//the audit-source and audit-redact-addresses policies
+func auditExecution(ctx context.Context, input *InputPack, output *OutputPack, summary *JobSummary) {
+	if auditLog == nil {
+		return
+	}
+
+	config := currentConfig()
+
+	record := AuditRecord{}
+	record.Time = time.Now().UTC()
+	record.RequestID = requestID(ctx)
+	record.Client = requestClient(ctx)
+	if key := requestAPIKey(ctx); key != nil {
+		record.Client = "key:" + key.ID
+		record.KeyName = key.Name
+	}
+	if config.AuditRedactAddresses {
+		record.Client = redactAddress(record.Client)
+	}
+
+	record.SourceHash = hashSources(input)
+	if config.AuditSource == "full" {
+		record.Sources = input.sources()
+		record.GoMod = input.GoMod
+	}
+	record.StdinSize = len(input.Stdin)
+
+	record.ErrorCode = output.ErrorCode
+	record.Outcome = summary.Outcome
+	record.Executor = summary.Executor
+	record.Cached = summary.Cached
+	record.CompileSeconds = summary.CompileSeconds
+	record.RunSeconds = summary.RunSeconds
+	record.CPUSeconds = summary.CPUSeconds
+
+	err := auditLog.Append(&record)
+	if err != nil {
+		requestLogger(ctx).Error("Failed to write the audit log", "error", err)
+	}
+}
+
+//auditLog executions audit log, nil when audit-dir is not set
+var auditLog *AuditLog
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestRedactAddress(t *testing.T) {
+	cases := map[string]string{
+		"ip:203.0.113.57":         "ip:203.0.113.0/24",
+		"ip:::ffff:203.0.113.57":  "ip:203.0.113.0/24",
+		"ip:2001:db8:1234:5678::": "ip:2001:db8:1234::/48",
+		"ip:not-an-address":       "ip:redacted",
+		"key:0123456789abcdef":    "key:0123456789abcdef",
+		"cert:ci.example.edu":     "cert:ci.example.edu",
+	}
+
+	for client, want := range cases {
+		if got := redactAddress(client); got != want {
+			t.Errorf("redactAddress(%q) = %q, want %q", client, got, want)
+		}
+	}
+}
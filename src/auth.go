@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//APIKeyPrefix prefix of every API key, makes leaked keys easy to search for
+const APIKeyPrefix string = "gopg_"
+
+//ErrKeyNotFound returned when revoking an unknown key
+var ErrKeyNotFound = errors.New("API key not found")
+
+//KeyPolicy Represents what a key is allowed to do, zero values mean no restriction
+type KeyPolicy struct {
+	//Endpoints routes the key may call, routes ending with "/" allow every path under them
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	//MaxTimeout caps the run time of the programs, as a Go duration
+	MaxTimeout string `json:"maxTimeout,omitempty"`
+
+	//MaxMemoryMB caps the memory limit of the programs
+	MaxMemoryMB int `json:"maxMemoryMB,omitempty"`
+
+	//GoVersions toolchain versions the key may run programs with, like go1.22.1
+	GoVersions []string `json:"goVersions,omitempty"`
+
+	//AllowUnsandboxed lets the key run programs while the sandbox is disabled
+	AllowUnsandboxed bool `json:"allowUnsandboxed"`
+
+	//Admin grants the /admin/ endpoints
+	Admin bool `json:"admin"`
+
+	//MaxPriority highest priority the key may ask for with X-Priority, like
+	//interactive, the requests of the key may only lower their priority when empty
+	MaxPriority string `json:"maxPriority,omitempty"`
+
+	maxTimeout time.Duration
+}
+
+//validate parses the policy, it must be called before the policy is used
+func (policy *KeyPolicy) validate() error {
+	for _, endpoint := range policy.Endpoints {
+		if !strings.HasPrefix(endpoint, "/") {
+			return fmt.Errorf("Endpoint %q must start with /", endpoint)
+		}
+	}
+
+	//docker refuses containers with less than 6MB of memory
+	if policy.MaxMemoryMB != 0 && policy.MaxMemoryMB < 6 {
+		return fmt.Errorf("maxMemoryMB must be at least 6, found %d", policy.MaxMemoryMB)
+	}
+
+	if policy.MaxPriority != "" && ParsePriority(policy.MaxPriority, -1) < 0 {
+		return fmt.Errorf("maxPriority must be interactive, grading or batch, found %q", policy.MaxPriority)
+	}
+
+	policy.maxTimeout = 0
+	if policy.MaxTimeout != "" {
+		timeout, err := time.ParseDuration(policy.MaxTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("maxTimeout must be a positive duration, found %q", policy.MaxTimeout)
+		}
+		policy.maxTimeout = timeout
+	}
+
+	return nil
+}
+
+//AllowsEndpoint reports whether the key may call path
+func (policy *KeyPolicy) AllowsEndpoint(path string) bool {
+	if strings.HasPrefix(path, "/admin/") || path == "/admin" {
+		return policy.Admin
+	}
+
+	if len(policy.Endpoints) == 0 {
+		return true
+	}
+
+	for _, endpoint := range policy.Endpoints {
+		if endpoint == path || (strings.HasSuffix(endpoint, "/") && strings.HasPrefix(path, endpoint)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//Apply returns the configuration of a program run with the key, limits are
+//capped by the policy. Fails when the key may not run programs on this server
+func (policy *KeyPolicy) Apply(config *Config, goVersion string) (*Config, error) {
+	if !config.Sandbox && !policy.AllowUnsandboxed {
+		return nil, errors.New("This API key may only run programs in the sandbox, which is disabled")
+	}
+
+	if len(policy.GoVersions) > 0 {
+		allowed := false
+		for _, version := range policy.GoVersions {
+			allowed = allowed || version == goVersion
+		}
+		if !allowed {
+			return nil, fmt.Errorf("This API key may not run programs with %s, allowed versions: %s",
+				goVersion, strings.Join(policy.GoVersions, ", "))
+		}
+	}
+
+	limited := *config
+	if policy.maxTimeout > 0 && policy.maxTimeout < limited.Timeout {
+		limited.Timeout = policy.maxTimeout
+	}
+	if policy.MaxMemoryMB > 0 && policy.MaxMemoryMB < limited.MemoryLimitMB {
+		limited.MemoryLimitMB = policy.MaxMemoryMB
+	}
+
+	return &limited, nil
+}
+
+//APIKey Represents a key as stored in the key file, only the hash of the secret is kept
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Policy  KeyPolicy `json:"policy"`
+
+	//Certificate common name of the client certificates authenticated as this key
+	Certificate string `json:"certificate,omitempty"`
+}
+
+//APIKeyInfo Represents a key as listed by the admin endpoints
+type APIKeyInfo struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Policy  KeyPolicy `json:"policy"`
+
+	Certificate string `json:"certificate,omitempty"`
+}
+
+//NewAPIKey Represents a created key, the secret is shown only once
+type NewAPIKey struct {
+	APIKeyInfo
+	Key string `json:"key"`
+}
+
+func (key *APIKey) info() APIKeyInfo {
+	return APIKeyInfo{ID: key.ID, Name: key.Name, Created: key.Created, Policy: key.Policy, Certificate: key.Certificate}
+}
+
+//keyFile Represents the key file
+type keyFile struct {
+	Keys []*APIKey `json:"keys"`
+}
+
+//hashKey returns the hex encoded SHA-256 of a secret, secrets are random so no salt is needed
+func hashKey(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+//KeyStore API keys backed by a key file, safe for concurrent use
+type KeyStore struct {
+	path string
+
+	lock *sync.RWMutex
+
+	//keys maps the hash of every secret to its key
+	keys map[string]*APIKey
+}
+
+//Reload reads the key file again, the keys are left untouched when it is invalid
+func (store *KeyStore) Reload() error {
+	keys := make(map[string]*APIKey)
+
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		//an empty store, the first key creates the file
+		data, err = []byte(`{"keys":[]}`), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	file := keyFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return fmt.Errorf("Invalid key file %s: %v", store.path, err)
+	}
+
+	certificates := make(map[string]bool)
+	for _, key := range file.Keys {
+		if key.ID == "" || len(key.Hash) != sha256.Size*2 {
+			return fmt.Errorf("Invalid key file %s: key %q needs an id and a SHA-256 hash", store.path, key.ID)
+		}
+
+		if key.Certificate != "" {
+			if certificates[key.Certificate] {
+				return fmt.Errorf("Invalid key file %s: certificate %q is given to more than one key", store.path, key.Certificate)
+			}
+			certificates[key.Certificate] = true
+		}
+
+		err = key.Policy.validate()
+		if err != nil {
+			return fmt.Errorf("Invalid key file %s: key %s: %v", store.path, key.ID, err)
+		}
+
+		keys[key.Hash] = key
+	}
+
+	store.lock.Lock()
+	store.keys = keys
+	store.lock.Unlock()
+
+	return nil
+}
+
+//save writes the key file, the caller holds the write lock
+func (store *KeyStore) save() error {
+	file := keyFile{Keys: make([]*APIKey, 0, len(store.keys))}
+	for _, key := range store.keys {
+		file.Keys = append(file.Keys, key)
+	}
+	sort.Slice(file.Keys, func(i, j int) bool {
+		return file.Keys[i].Created.Before(file.Keys[j].Created)
+	})
+
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	//write then rename, a reader never sees a partial file
+	temp, err := ioutil.TempFile(filepath.Dir(store.path), ".keys-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Chmod(0600)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), store.path)
+}
+
+//Authenticate returns the key of the secret
+func (store *KeyStore) Authenticate(secret string) (*APIKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	key, ok := store.keys[hashKey(secret)]
+	return key, ok
+}
+
+//AuthenticateCertificate returns the key of the client certificate common name
+func (store *KeyStore) AuthenticateCertificate(name string) (*APIKey, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, key := range store.keys {
+		if key.Certificate == name {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+//List returns the keys, oldest first
+func (store *KeyStore) List() []APIKeyInfo {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	keys := make([]APIKeyInfo, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key.info())
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys
+}
+
+//Create generates a key with the given policy and saves it to the key file,
+//clients presenting a certificate with the common name certificate are
+//authenticated as the key when it is not empty
+func (store *KeyStore) Create(name string, policy KeyPolicy, certificate string) (*NewAPIKey, error) {
+	err := policy.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	random, err := randomHex(24)
+	if err != nil {
+		return nil, err
+	}
+	secret := APIKeyPrefix + random
+
+	key := APIKey{}
+	key.ID = id
+	key.Name = name
+	key.Hash = hashKey(secret)
+	key.Created = time.Now().UTC()
+	key.Policy = policy
+	key.Certificate = certificate
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, other := range store.keys {
+		if certificate != "" && other.Certificate == certificate {
+			return nil, fmt.Errorf("Certificate %q already authenticates key %s", certificate, other.ID)
+		}
+	}
+
+	store.keys[key.Hash] = &key
+	err = store.save()
+	if err != nil {
+		delete(store.keys, key.Hash)
+		return nil, err
+	}
+
+	return &NewAPIKey{APIKeyInfo: key.info(), Key: secret}, nil
+}
+
+//Revoke removes the key with the given id from the key file
+func (store *KeyStore) Revoke(id string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for hash, key := range store.keys {
+		if key.ID != id {
+			continue
+		}
+
+		delete(store.keys, hash)
+		err := store.save()
+		if err != nil {
+			store.keys[hash] = key
+		}
+		return err
+	}
+
+	return ErrKeyNotFound
+}
+
+//NewKeyStore loads the keys of the key file, a missing file is created by the first key
+func NewKeyStore(path string) (*KeyStore, error) {
+	store := KeyStore{}
+	store.path = path
+	store.lock = &sync.RWMutex{}
+	store.keys = make(map[string]*APIKey)
+
+	err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+type contextKey string
+
+//apiKeyContext request context value holding the authenticated *APIKey
+const apiKeyContext contextKey = "apiKey"
+
+//requestAPIKey returns the key the request was authenticated with, nil when authentication is disabled
+func requestAPIKey(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContext).(*APIKey)
+	return key
+}
+
+//authenticate requires a valid "Authorization: Bearer" key allowed to call the
+//requested path, or a client certificate given to such a key when no key is
+//sent. The key is stored in the request context
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if keyStore == nil {
+			next(w, r)
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+		secret := strings.TrimPrefix(authorization, "Bearer ")
+
+		var key *APIKey
+		var ok bool
+		if name := clientCertificate(r); authorization == "" && name != "" {
+			key, ok = keyStore.AuthenticateCertificate(name)
+			if !ok {
+				sendError(&w, CodeUnauthorized, fmt.Sprintf("Client certificate %q is not given to an API key", name))
+				return
+			}
+		} else if secret == authorization || secret == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gopg"`)
+			sendError(&w, CodeUnauthorized, "Missing API key, send it as Authorization: Bearer <key>")
+			return
+		} else {
+			key, ok = keyStore.Authenticate(secret)
+		}
+
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gopg", error="invalid_token"`)
+			sendError(&w, CodeUnauthorized, "Invalid API key")
+			return
+		}
+
+		if !key.Policy.AllowsEndpoint(r.URL.Path) {
+			sendError(&w, CodeForbidden, fmt.Sprintf("This API key may not call %s", r.URL.Path))
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext, key)))
+	}
+}
+
+//requireAdmin answers 403 unless the request was authenticated with an admin
+//key, the admin routes stay closed while authentication is disabled: the audit
+//log and the pool state are not for anyone reaching the server
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r.Context())
+		if key == nil || !key.Policy.Admin {
+			sendError(&w, CodeForbidden, "The /admin/ routes need an admin API key, set api-keys and create one with -create-admin-key")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+//keyStore API keys, nil disables authentication
+var keyStore *KeyStore
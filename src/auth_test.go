@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//useKeyStore enables authentication with an empty key store for the test
+func useKeyStore(t *testing.T) *KeyStore {
+	t.Helper()
+
+	store, err := NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("NewKeyStore() = %v", err)
+	}
+
+	previous := keyStore
+	keyStore = store
+	t.Cleanup(func() {
+		keyStore = previous
+	})
+
+	return store
+}
+
+//newTestKey creates a key with policy and returns its secret
+func newTestKey(t *testing.T, store *KeyStore, policy KeyPolicy) string {
+	t.Helper()
+
+	key, err := store.Create("test", policy, "")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+
+	return key.Key
+}
+
+func TestKeyPolicyDeniesUnsandboxedRuns(t *testing.T) {
+	config := DefaultConfig()
+	config.Sandbox = false
+
+	policy := KeyPolicy{}
+	if _, err := policy.Apply(config, "go1.22.1"); err == nil {
+		t.Error("Apply() allowed an unsandboxed run")
+	}
+
+	policy.AllowUnsandboxed = true
+	if _, err := policy.Apply(config, "go1.22.1"); err != nil {
+		t.Errorf("Apply() with allowUnsandboxed = %v", err)
+	}
+
+	config.Sandbox = true
+	if _, err := (&KeyPolicy{}).Apply(config, "go1.22.1"); err != nil {
+		t.Errorf("Apply() of a sandboxed run = %v", err)
+	}
+}
+
+func TestKeyPolicyCapsLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.Sandbox = true
+	config.Timeout = 10 * time.Second
+	config.MemoryLimitMB = 100
+
+	policy := KeyPolicy{MaxTimeout: "2s", MaxMemoryMB: 64}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+
+	limited, err := policy.Apply(config, "go1.22.1")
+	if err != nil {
+		t.Fatalf("Apply() = %v", err)
+	}
+	if limited.Timeout != 2*time.Second || limited.MemoryLimitMB != 64 {
+		t.Errorf("Apply() = %s and %dMB, want 2s and 64MB", limited.Timeout, limited.MemoryLimitMB)
+	}
+	if config.Timeout != 10*time.Second || config.MemoryLimitMB != 100 {
+		t.Error("Apply() changed the server configuration")
+	}
+
+	//the policy never raises the limits of the server
+	policy = KeyPolicy{MaxTimeout: "1m", MaxMemoryMB: 512}
+	policy.validate()
+	limited, _ = policy.Apply(config, "go1.22.1")
+	if limited.Timeout != 10*time.Second || limited.MemoryLimitMB != 100 {
+		t.Errorf("Apply() = %s and %dMB, want the server limits", limited.Timeout, limited.MemoryLimitMB)
+	}
+}
+
+func TestKeyPolicyGoVersions(t *testing.T) {
+	config := DefaultConfig()
+	config.Sandbox = true
+
+	policy := KeyPolicy{GoVersions: []string{"go1.21.0", "go1.22.1"}}
+	if _, err := policy.Apply(config, "go1.22.1"); err != nil {
+		t.Errorf("Apply() with an allowed version = %v", err)
+	}
+	if _, err := policy.Apply(config, "go1.23.0"); err == nil {
+		t.Error("Apply() allowed a version missing from the policy")
+	}
+}
+
+func TestKeyPolicyValidate(t *testing.T) {
+	for _, policy := range []KeyPolicy{
+		{Endpoints: []string{"executeJson"}},
+		{MaxMemoryMB: 4},
+		{MaxTimeout: "10"},
+		{MaxTimeout: "-1s"},
+		{MaxPriority: "urgent"},
+	} {
+		if err := policy.validate(); err == nil {
+			t.Errorf("validate() of %+v = nil, want an error", policy)
+		}
+	}
+}
+
+func TestKeyPolicyAllowsEndpoint(t *testing.T) {
+	policy := KeyPolicy{Endpoints: []string{"/executeJson", "/p/"}}
+
+	cases := map[string]bool{
+		"/executeJson":  true,
+		"/executeFile":  false,
+		"/p/abcdefghij": true,
+		"/admin/keys":   false,
+	}
+	for path, want := range cases {
+		if got := policy.AllowsEndpoint(path); got != want {
+			t.Errorf("AllowsEndpoint(%q) = %v, want %v", path, got, want)
+		}
+	}
+
+	admin := KeyPolicy{Admin: true}
+	if !admin.AllowsEndpoint("/admin/keys") || !admin.AllowsEndpoint("/executeJson") {
+		t.Error("An admin key without endpoints may not call every route")
+	}
+}
+
+func TestKeyStoreCreateReload(t *testing.T) {
+	store := useKeyStore(t)
+
+	secret := newTestKey(t, store, KeyPolicy{MaxTimeout: "5s"})
+	if !strings.HasPrefix(secret, APIKeyPrefix) {
+		t.Errorf("Create() = %q, want a key starting with %s", secret, APIKeyPrefix)
+	}
+
+	//the key file only holds the hash of the secret
+	reopened, err := NewKeyStore(store.path)
+	if err != nil {
+		t.Fatalf("NewKeyStore() = %v", err)
+	}
+	key, ok := reopened.Authenticate(secret)
+	if !ok || key.Policy.maxTimeout != 5*time.Second {
+		t.Fatalf("Authenticate() of the created key = %v, %v", key, ok)
+	}
+	if _, ok := reopened.Authenticate(secret + "x"); ok {
+		t.Error("Authenticate() of an unknown key succeeded")
+	}
+
+	err = reopened.Revoke(key.ID)
+	if err != nil {
+		t.Fatalf("Revoke() = %v", err)
+	}
+	if _, ok := reopened.Authenticate(secret); ok {
+		t.Error("Authenticate() of a revoked key succeeded")
+	}
+	if reopened.Revoke(key.ID) != ErrKeyNotFound {
+		t.Error("Revoke() of a revoked key did not return ErrKeyNotFound")
+	}
+}
+
+func TestKeyStoreCertificateOfOneKey(t *testing.T) {
+	store := useKeyStore(t)
+
+	_, err := store.Create("ci", KeyPolicy{}, "ci.example.edu")
+	if err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if _, err := store.Create("other", KeyPolicy{}, "ci.example.edu"); err == nil {
+		t.Error("Create() gave a certificate to a second key")
+	}
+
+	key, ok := store.AuthenticateCertificate("ci.example.edu")
+	if !ok || key.Name != "ci" {
+		t.Errorf("AuthenticateCertificate() = %v, %v, want the ci key", key, ok)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := useKeyStore(t)
+	secret := newTestKey(t, store, KeyPolicy{Endpoints: []string{"/format"}})
+
+	var authenticated *APIKey
+	handler := authenticate(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = requestAPIKey(r.Context())
+	})
+
+	send := func(path string, authorization string) *httptest.ResponseRecorder {
+		authenticated = nil
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", path, nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		handler(recorder, request)
+		return recorder
+	}
+
+	for _, authorization := range []string{"", secret, "Bearer ", "Bearer " + secret + "x"} {
+		recorder := send("/format", authorization)
+		if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q answered %d, want 401 with WWW-Authenticate", authorization, recorder.Code)
+		}
+		if authenticated != nil {
+			t.Errorf("Authorization %q reached the handler", authorization)
+		}
+	}
+
+	if code := send("/executeJson", "Bearer "+secret).Code; code != http.StatusForbidden {
+		t.Errorf("Route missing from the policy answered %d, want 403", code)
+	}
+
+	if code := send("/format", "Bearer "+secret).Code; code != http.StatusOK || authenticated == nil {
+		t.Errorf("Allowed route answered %d, want the handler run with the key", code)
+	}
+}
+
+func TestAdminRoutesNeedAdminKey(t *testing.T) {
+	router, _ := newTestRouter(t)
+
+	send := func(authorization string) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/admin/keys", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	//the admin routes stay closed while authentication is disabled
+	if code := send(""); code != http.StatusForbidden {
+		t.Errorf("Admin route without authentication answered %d, want 403", code)
+	}
+
+	store := useKeyStore(t)
+	user := newTestKey(t, store, KeyPolicy{})
+	admin := newTestKey(t, store, KeyPolicy{Admin: true})
+
+	if code := send(""); code != http.StatusUnauthorized {
+		t.Errorf("Admin route without a key answered %d, want 401", code)
+	}
+	if code := send("Bearer " + user); code != http.StatusForbidden {
+		t.Errorf("Admin route with a user key answered %d, want 403", code)
+	}
+	if code := send("Bearer " + admin); code != http.StatusOK {
+		t.Errorf("Admin route with an admin key answered %d, want 200", code)
+	}
+}
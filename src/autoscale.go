@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ScalingHistory number of scaling decisions kept for the status endpoint
+const ScalingHistory int = 20
+
+//PoolConfig bounds and thresholds of the worker pool autoscaling
+type PoolConfig struct {
+	MinWorkers int
+	MaxWorkers int
+
+	//IdleTimeout time after which an idle worker above MinWorkers retires
+	IdleTimeout time.Duration
+
+	//ScaleInterval time between two scaling decisions
+	ScaleInterval time.Duration
+
+	//MaxLoadPerCPU one-minute load average per CPU above which no worker is added
+	MaxLoadPerCPU float64
+
+	//JobMemory memory needed by a job, workers are added only while it is available
+	JobMemory uint64
+}
+
+//ScalingDecision Represents a change, or a refused change, of the number of workers
+type ScalingDecision struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Workers int       `json:"workers"`
+	Reason  string    `json:"reason"`
+}
+
+//PoolStatus Represents the current state of the worker pool
+type PoolStatus struct {
+	MinWorkers      int               `json:"minWorkers"`
+	MaxWorkers      int               `json:"maxWorkers"`
+	Workers         int               `json:"workers"`
+	BusyWorkers     int               `json:"busyWorkers"`
+	QueueLength     int               `json:"queueLength"`
+	QueueCapacity   int               `json:"queueCapacity"`
+	LoadAverage     float64           `json:"loadAverage"`
+	CPUs            int               `json:"cpus"`
+	AvailableMemory uint64            `json:"availableMemory"`
+	AvgJobDuration  float64           `json:"avgJobDuration"`
+	Decisions       []ScalingDecision `json:"decisions"`
+}
+
+//readLoadAverage returns the one-minute load average of the host
+func readLoadAverage() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("Malformed /proc/loadavg")
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+//readAvailableMemory returns the memory available for new processes, in bytes
+func readAvailableMemory() (uint64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+
+		kiloBytes, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kiloBytes * 1024, nil
+	}
+
+	return 0, errors.New("MemAvailable not found in /proc/meminfo")
+}
+
+//autoscale periodically adds workers until the pool is shut down
+func (wokerPool *WorkerPool) autoscale() {
+	ticker := time.NewTicker(wokerPool.poolConfig().ScaleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if wokerPool.isStopped() {
+			return
+		}
+		wokerPool.scale()
+	}
+}
+
+//scale adds a worker for every queued job without an idle worker, as long as
+//the load and the available memory allow it. Idle workers retire by themselves
+func (wokerPool *WorkerPool) scale() {
+	config := wokerPool.poolConfig()
+	depth := wokerPool.queue.Len()
+
+	wokerPool.statsLock.Lock()
+	workers := wokerPool.nWorkers
+	idle := wokerPool.nWorkers - wokerPool.busyWorkers
+	wokerPool.statsLock.Unlock()
+
+	wanted := depth - idle
+	if wanted <= 0 {
+		return
+	}
+
+	room := config.MaxWorkers - workers
+	if room <= 0 {
+		wokerPool.recordDecision("hold", workers, fmt.Sprintf("%d jobs waiting, at the maximum of %d workers", wanted, workers))
+		return
+	}
+
+	count := wanted
+	if count > room {
+		count = room
+	}
+
+	//readings are skipped where /proc is not available
+	load, err := readLoadAverage()
+	loadPerCPU := load / float64(runtime.NumCPU())
+	if err == nil && loadPerCPU >= config.MaxLoadPerCPU {
+		wokerPool.recordDecision("hold", workers, fmt.Sprintf("%d jobs waiting, load of %.2f per CPU", wanted, loadPerCPU))
+		return
+	}
+
+	memory, err := readAvailableMemory()
+	if err == nil && config.JobMemory > 0 {
+		fits := int(memory / config.JobMemory)
+		if fits == 0 {
+			wokerPool.recordDecision("hold", workers, fmt.Sprintf("%d jobs waiting, %d MB of memory available", wanted, memory>>20))
+			return
+		}
+		if count > fits {
+			count = fits
+		}
+	}
+
+	added := wokerPool.spawnWorkers(count)
+	if added > 0 {
+		wokerPool.recordDecision("scale-up", workers+added, fmt.Sprintf("%d jobs waiting for a worker", wanted))
+	}
+}
+
+//recordDecision keeps the decision for the status endpoint, repeated refusals are recorded once
+func (wokerPool *WorkerPool) recordDecision(action string, workers int, reason string) {
+	wokerPool.statsLock.Lock()
+	defer wokerPool.statsLock.Unlock()
+
+	count := len(wokerPool.decisions)
+	if action == "hold" && count > 0 && wokerPool.decisions[count-1].Reason == reason {
+		return
+	}
+
+	decision := ScalingDecision{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Workers: workers,
+		Reason:  reason,
+	}
+
+	slog.Info("Autoscaling", "action", action, "workers", workers, "reason", reason)
+
+	wokerPool.decisions = append(wokerPool.decisions, decision)
+	if len(wokerPool.decisions) > ScalingHistory {
+		wokerPool.decisions = wokerPool.decisions[1:]
+	}
+}
+
+//poolConfig returns a copy of the pool configuration, it changes on Reconfigure
+func (wokerPool *WorkerPool) poolConfig() PoolConfig {
+	wokerPool.statsLock.Lock()
+	defer wokerPool.statsLock.Unlock()
+
+	return wokerPool.config
+}
+
+//Reconfigure applies new worker bounds, workers above the maximum retire once idle
+func (wokerPool *WorkerPool) Reconfigure(config PoolConfig) {
+	wokerPool.statsLock.Lock()
+	//the scaler ticks at the interval it was started with
+	config.ScaleInterval = wokerPool.config.ScaleInterval
+	wokerPool.config = config
+	workers := wokerPool.nWorkers
+	wokerPool.statsLock.Unlock()
+
+	reason := fmt.Sprintf("reconfigured to %d-%d workers", config.MinWorkers, config.MaxWorkers)
+	if workers < config.MinWorkers {
+		workers += wokerPool.spawnWorkers(config.MinWorkers - workers)
+	}
+	wokerPool.recordDecision("reconfigure", workers, reason)
+}
+
+//Status returns the current state of the pool and its recent scaling decisions
+func (wokerPool *WorkerPool) Status() *PoolStatus {
+	status := PoolStatus{}
+	status.QueueLength = wokerPool.queue.Len()
+	status.QueueCapacity = wokerPool.queue.Cap()
+	status.CPUs = runtime.NumCPU()
+	status.LoadAverage, _ = readLoadAverage()
+	status.AvailableMemory, _ = readAvailableMemory()
+
+	wokerPool.statsLock.Lock()
+	status.MinWorkers = wokerPool.config.MinWorkers
+	status.MaxWorkers = wokerPool.config.MaxWorkers
+	status.Workers = wokerPool.nWorkers
+	status.BusyWorkers = wokerPool.busyWorkers
+	status.AvgJobDuration = wokerPool.avgJobDuration.Seconds()
+	status.Decisions = append([]ScalingDecision{}, wokerPool.decisions...)
+	wokerPool.statsLock.Unlock()
+
+	return &status
+}
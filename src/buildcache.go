@@ -0,0 +1,209 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+
+	//BuildCacheDir default root of the go build and module caches
+	BuildCacheDir string = "/tmp/gopg-cache"
+
+	//BuildCacheMaxSize default size above which the build cache is trimmed - 2GB
+	BuildCacheMaxSize int64 = (1 << 30) * 2
+
+	//BuildCacheTrimRatio fraction of the maximum size left after trimming
+	BuildCacheTrimRatio float64 = 0.8
+)
+
+//BuildCacheStats Represents the statistics of the build cache
+type BuildCacheStats struct {
+	Dir           string    `json:"dir"`
+	Size          int64     `json:"size"`
+	Files         int       `json:"files"`
+	MaxSize       int64     `json:"maxSize"`
+	ModCacheSize  int64     `json:"modCacheSize"`
+	Builds        uint64    `json:"builds"`
+	ActiveBuilds  int       `json:"activeBuilds"`
+	Evictions     uint64    `json:"evictions"`
+	EvictedBytes  int64     `json:"evictedBytes"`
+	LastEviction  time.Time `json:"lastEviction"`
+	ResultEntries int       `json:"resultCacheEntries"`
+}
+
+//BuildCache manages the GOCACHE and GOMODCACHE directories shared by all the jobs
+type BuildCache struct {
+	//builds hold the read lock, eviction holds the write lock while removing files
+	buildLock *sync.RWMutex
+
+	//statsLock guards the counters below
+	statsLock *sync.Mutex
+
+	goCache  string
+	modCache string
+	maxSize  int64
+
+	builds       uint64
+	activeBuilds int
+	evictions    uint64
+	evictedBytes int64
+	lastEviction time.Time
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+//Env returns the environment of a go command using the shared caches
+func (cache *BuildCache) Env() []string {
+	return append(os.Environ(),
+		"GOCACHE="+cache.goCache,
+		"GOMODCACHE="+cache.modCache,
+	)
+}
+
+//BeginBuild marks the start of a go command, eviction waits for it to end
+func (cache *BuildCache) BeginBuild() {
+	cache.buildLock.RLock()
+
+	cache.statsLock.Lock()
+	cache.builds++
+	cache.activeBuilds++
+	cache.statsLock.Unlock()
+}
+
+//EndBuild marks the end of a go command started with BeginBuild
+func (cache *BuildCache) EndBuild() {
+	cache.statsLock.Lock()
+	cache.activeBuilds--
+	cache.statsLock.Unlock()
+
+	cache.buildLock.RUnlock()
+}
+
+func (cache *BuildCache) listFiles(dir string) ([]cacheFile, int64) {
+	files := make([]cacheFile, 0)
+	var total int64
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	return files, total
+}
+
+//Evict removes the least recently used build outputs until the cache is
+//below its maximum size, the module cache is never trimmed. The cache is
+//walked while builds run, the go command tolerates entries missing by then,
+//and builds only wait for the removal
+func (cache *BuildCache) Evict() {
+	files, total := cache.listFiles(cache.goCache)
+	if total <= cache.maxSize {
+		return
+	}
+
+	//go refreshes the modification time of the entries it uses
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	target := int64(float64(cache.maxSize) * BuildCacheTrimRatio)
+	candidates := make([]cacheFile, 0)
+	for _, file := range files {
+		if total <= target {
+			break
+		}
+
+		//keep the files describing the cache layout
+		name := filepath.Base(file.path)
+		if name == "README" || name == "trim.txt" {
+			continue
+		}
+
+		candidates = append(candidates, file)
+		total -= file.size
+	}
+
+	var evicted int64
+	cache.buildLock.Lock()
+	for _, file := range candidates {
+		if os.Remove(file.path) == nil {
+			evicted += file.size
+		}
+	}
+	cache.buildLock.Unlock()
+
+	cache.statsLock.Lock()
+	cache.evictions++
+	cache.evictedBytes += evicted
+	cache.lastEviction = time.Now().UTC()
+	cache.statsLock.Unlock()
+}
+
+//Stats returns the current statistics of the cache
+func (cache *BuildCache) Stats() *BuildCacheStats {
+	stats := BuildCacheStats{}
+	stats.Dir = filepath.Dir(cache.goCache)
+	stats.MaxSize = cache.maxSize
+
+	files, size := cache.listFiles(cache.goCache)
+	stats.Files = len(files)
+	stats.Size = size
+	_, stats.ModCacheSize = cache.listFiles(cache.modCache)
+
+	cache.statsLock.Lock()
+	stats.Builds = cache.builds
+	stats.ActiveBuilds = cache.activeBuilds
+	stats.Evictions = cache.evictions
+	stats.EvictedBytes = cache.evictedBytes
+	stats.LastEviction = cache.lastEviction
+	cache.statsLock.Unlock()
+
+	if resultCache != nil {
+		stats.ResultEntries = resultCache.Len()
+	}
+
+	return &stats
+}
+
+//NewBuildCache creates the go build and module caches under dir
+func NewBuildCache(dir string, maxSize int64) (*BuildCache, error) {
+	cache := BuildCache{}
+	cache.buildLock = &sync.RWMutex{}
+	cache.statsLock = &sync.Mutex{}
+	cache.goCache = filepath.Join(dir, "go-build")
+	cache.modCache = filepath.Join(dir, "mod")
+	cache.maxSize = maxSize
+
+	for _, cacheDir := range []string{cache.goCache, cache.modCache} {
+		err := os.MkdirAll(cacheDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &cache, nil
+}
+
+//evictBuildCache periodically trims the build cache
+func evictBuildCache(cache *BuildCache, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		cache.Evict()
+	}
+}
+
+//buildCache cache shared by the go commands, nil uses the default go caches
+var buildCache *BuildCache
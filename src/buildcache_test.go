@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeCacheFile writes size bytes to name in the build cache, last used age ago
+func writeCacheFile(t *testing.T, cache *BuildCache, name string, size int, age time.Duration) string {
+	t.Helper()
+
+	path := filepath.Join(cache.goCache, name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	err := ioutil.WriteFile(path, make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := time.Now().Add(-age)
+	os.Chtimes(path, used, used)
+
+	return path
+}
+
+func TestBuildCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewBuildCache(t.TempDir(), 10<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, 0)
+	for idx := 0; idx < 6; idx++ {
+		//the first files are the least recently used
+		name := fmt.Sprintf("%02x/entry-%d", idx, idx)
+		paths = append(paths, writeCacheFile(t, cache, name, 2<<10, time.Duration(6-idx)*time.Hour))
+	}
+	readme := writeCacheFile(t, cache, "README", 1<<10, 24*time.Hour)
+
+	cache.Evict()
+
+	//13KB down to 80% of 10KB: the three oldest entries go
+	for idx, path := range paths {
+		_, err := os.Stat(path)
+		if removed := os.IsNotExist(err); removed != (idx < 3) {
+			t.Errorf("entry %d removed = %v, want %v", idx, removed, idx < 3)
+		}
+	}
+	if _, err := os.Stat(readme); err != nil {
+		t.Error("Evict() removed the README of the cache")
+	}
+
+	stats := cache.Stats()
+	if stats.Evictions != 1 || stats.EvictedBytes != 6<<10 {
+		t.Errorf("Stats() = %d evictions of %d bytes, want 1 of %d", stats.Evictions, stats.EvictedBytes, 6<<10)
+	}
+}
+
+func TestBuildCacheBelowMaxSize(t *testing.T) {
+	cache, _ := NewBuildCache(t.TempDir(), 10<<10)
+	path := writeCacheFile(t, cache, "00/entry", 4<<10, time.Hour)
+
+	cache.Evict()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("Evict() trimmed a cache below its maximum size")
+	}
+	if cache.Stats().Evictions != 0 {
+		t.Error("Evict() counted an eviction of a cache below its maximum size")
+	}
+}
+
+func TestBuildCacheEvictionWaitsForBuilds(t *testing.T) {
+	cache, _ := NewBuildCache(t.TempDir(), 1<<10)
+	path := writeCacheFile(t, cache, "00/entry", 4<<10, time.Hour)
+
+	cache.BeginBuild()
+	done := make(chan bool)
+	go func() {
+		cache.Evict()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Evict() removed files while a build was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("Evict() removed a file while a build was running")
+	}
+
+	cache.EndBuild()
+	<-done
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Evict() kept the file once the build ended")
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ResultCacheEntries number of results kept in memory
+const ResultCacheEntries int = 1024
+
+//nonDeterministicImports packages whose use likely makes the output depend on
+//time, randomness or the environment
+var nonDeterministicImports = map[string]bool{
+	"time":            true,
+	"math/rand":       true,
+	"math/rand/v2":    true,
+	"crypto/rand":     true,
+	"os":              true,
+	"net":             true,
+	"net/http":        true,
+	"runtime":         true,
+	"hash/maphash":    true,
+	"syscall":         true,
+	"io/ioutil":       true,
+	"path/filepath":   true,
+	"os/exec":         true,
+	"runtime/metrics": true,
+}
+
+//CacheKey Represents everything the output of a program depends on
+type CacheKey struct {
+	Program      string       `json:"program"`
+	Files        []SourceFile `json:"files,omitempty"`
+	Stdin        string       `json:"stdin,omitempty"`
+	Args         []string     `json:"args,omitempty"`
+	Test         bool         `json:"test,omitempty"`
+	GoMod        string       `json:"goMod"`
+	GoVersion    string       `json:"goVersion"`
+	BuildOptions string       `json:"buildOptions"`
+	Executor     string       `json:"executor"`
+
+	//Limits the run time and memory limits, a program may fail only under tighter limits
+	Limits string `json:"limits"`
+}
+
+//Hash returns the hex encoded SHA-256 of the key
+func (key *CacheKey) Hash() string {
+	data, _ := json.Marshal(key)
+	digest := sha256.Sum256(data)
+
+	return hex.EncodeToString(digest[:])
+}
+
+var goVersion = struct {
+	once    *sync.Once
+	version string
+}{once: &sync.Once{}}
+
+//toolchainVersion returns the version of the go toolchain used to run the programs
+func toolchainVersion() string {
+	goVersion.once.Do(func() {
+		output, err := exec.Command("go", "env", "GOVERSION").Output()
+		if err == nil {
+			goVersion.version = strings.TrimSpace(string(output))
+		}
+	})
+
+	return goVersion.version
+}
+
+//isCacheable reports whether the program output is worth reusing. This is a
+//best-effort guess from the imports: programs reading time, randomness or the
+//environment are not cached, but a program ranging over a map or selecting
+//between ready channels still is, the ttl bounds how long such a result is served
+func isCacheable(program string) bool {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, AnalysisFileName, program, parser.ImportsOnly)
+	if err != nil {
+		//the program does not parse, go build fails the same way
+		return true
+	}
+
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || nonDeterministicImports[path] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//cacheableOutcomes outcomes decided by the program, the other ones depend on
+//the load or the state of the server
+var cacheableOutcomes = map[string]bool{
+	OutcomeSuccess:      true,
+	OutcomeCompileError: true,
+	OutcomeRuntimeError: true,
+}
+
+//environmentErrors compiler output of builds failing because of the server,
+//like an unreachable module proxy or a full disk
+var environmentErrors = []string{
+	"no space left on device",
+	"dial tcp",
+	"proxy.golang.org",
+	"verifying module",
+	"i/o timeout",
+	"too many open files",
+}
+
+//isCacheableResult reports whether the result of a run depends on the program
+//only: it ran to its end without an internal error, and a compile error does
+//not come from the environment
+func isCacheableResult(output *ProgramOutput, err error) bool {
+	if output == nil || output.killed || !cacheableOutcomes[output.outcome] {
+		return false
+	}
+
+	//compile and runtime errors come back with the exit status of the command
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return false
+	}
+
+	if output.outcome == OutcomeCompileError {
+		for _, message := range environmentErrors {
+			if strings.Contains(output.Output, message) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+type cacheEntry struct {
+	key    string
+	output ProgramOutput
+	stored time.Time
+}
+
+//diskEntry Represents a result in the on-disk tier, along with the fields
+//ProgramOutput does not serialize
+type diskEntry struct {
+	ProgramOutput
+	Outcome string    `json:"outcome"`
+	Killed  bool      `json:"killed"`
+	Stored  time.Time `json:"stored"`
+}
+
+//ResultCache LRU cache of program outputs with an optional on-disk tier
+type ResultCache struct {
+	lock     *sync.Mutex
+	capacity int
+	entries  *list.List
+	index    map[string]*list.Element
+
+	//dir directory of the on-disk tier, empty disables it
+	dir string
+
+	//maxSize size above which the least recently used results are removed from dir
+	maxSize int64
+
+	//ttl time a result is served for after its run, and after which an unused
+	//result is removed from dir, zero keeps results until evicted
+	ttl time.Duration
+}
+
+func (cache *ResultCache) path(key string) string {
+	return filepath.Join(cache.dir, key+".json")
+}
+
+//Get returns the cached output of key, looking into the disk tier on a memory miss
+func (cache *ResultCache) Get(key string) (*ProgramOutput, bool) {
+	cache.lock.Lock()
+	element, ok := cache.index[key]
+	if ok {
+		entry := element.Value.(*cacheEntry)
+		if cache.isExpired(entry.stored) || !cacheableOutcomes[entry.output.outcome] {
+			cache.entries.Remove(element)
+			delete(cache.index, key)
+			cache.lock.Unlock()
+			return nil, false
+		}
+
+		cache.entries.MoveToFront(element)
+		output := entry.output
+		cache.lock.Unlock()
+		cache.touch(key)
+		return &output, true
+	}
+	cache.lock.Unlock()
+
+	if cache.dir == "" {
+		return nil, false
+	}
+
+	info, err := os.Stat(cache.path(key))
+	if err != nil || cache.isExpired(info.ModTime()) {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(cache.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	//results stored without their outcome or for too long are run again
+	entry := diskEntry{}
+	err = json.Unmarshal(data, &entry)
+	if err != nil || !cacheableOutcomes[entry.Outcome] || cache.isExpired(entry.Stored) {
+		return nil, false
+	}
+
+	output := entry.ProgramOutput
+	output.outcome = entry.Outcome
+	output.killed = entry.Killed
+
+	//promote to the memory tier
+	cache.putMemory(key, &output, entry.Stored)
+	cache.touch(key)
+	return &output, true
+}
+
+//touch marks the result of key as used, the least recently used results are evicted first
+func (cache *ResultCache) touch(key string) {
+	if cache.dir == "" {
+		return
+	}
+
+	now := time.Now()
+	os.Chtimes(cache.path(key), now, now)
+}
+
+//isExpired reports whether a result stored or last used at then outlived the ttl
+func (cache *ResultCache) isExpired(then time.Time) bool {
+	return cache.ttl > 0 && time.Since(then) > cache.ttl
+}
+
+//Put stores the output of key in memory and on disk
+func (cache *ResultCache) Put(key string, output *ProgramOutput) {
+	stored := time.Now()
+	cache.putMemory(key, output, stored)
+
+	if cache.dir == "" {
+		return
+	}
+
+	entry := diskEntry{}
+	entry.ProgramOutput = *output
+	entry.Outcome = output.outcome
+	entry.Killed = output.killed
+	entry.Stored = stored
+
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return
+	}
+
+	tmpFile, err := ioutil.TempFile(cache.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+
+	_, err = tmpFile.Write(data)
+	tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), cache.path(key))
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+	}
+}
+
+func (cache *ResultCache) putMemory(key string, output *ProgramOutput, stored time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.index[key]; ok {
+		element.Value.(*cacheEntry).output = *output
+		element.Value.(*cacheEntry).stored = stored
+		cache.entries.MoveToFront(element)
+		return
+	}
+
+	cache.index[key] = cache.entries.PushFront(&cacheEntry{key: key, output: *output, stored: stored})
+
+	//evict the least recently used entries
+	for cache.entries.Len() > cache.capacity {
+		oldest := cache.entries.Back()
+		cache.entries.Remove(oldest)
+		delete(cache.index, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+//Evict removes the results unused for longer than the ttl from the disk tier,
+//then the least recently used ones until it is below its maximum size
+func (cache *ResultCache) Evict() {
+	if cache.dir == "" {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(cache.dir)
+	if err != nil {
+		return
+	}
+
+	files := make([]cacheFile, 0, len(entries))
+	var total int64
+	for _, info := range entries {
+		path := filepath.Join(cache.dir, info.Name())
+
+		//temporary files left by an interrupted Put count as results
+		if info.IsDir() || (filepath.Ext(info.Name()) != ".json" && filepath.Ext(info.Name()) != ".tmp") {
+			continue
+		}
+		if cache.isExpired(info.ModTime()) {
+			os.Remove(path)
+			continue
+		}
+
+		files = append(files, cacheFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	if total <= cache.maxSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	target := int64(float64(cache.maxSize) * BuildCacheTrimRatio)
+	for _, file := range files {
+		if total <= target {
+			break
+		}
+
+		if os.Remove(file.path) == nil {
+			total -= file.size
+		}
+	}
+}
+
+//Len returns the number of results kept in memory
+func (cache *ResultCache) Len() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.entries.Len()
+}
+
+//NewResultCache creates a result cache holding capacity entries in memory,
+//dir enables the on-disk tier when not empty, holding about maxSize bytes of
+//results used within ttl
+func NewResultCache(capacity int, dir string, maxSize int64, ttl time.Duration) (*ResultCache, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cache := ResultCache{}
+	cache.lock = &sync.Mutex{}
+	cache.capacity = capacity
+	cache.entries = list.New()
+	cache.index = make(map[string]*list.Element)
+	cache.dir = dir
+	cache.maxSize = maxSize
+	cache.ttl = ttl
+
+	return &cache, nil
+}
+
+//evictResultCache periodically trims the disk tier of the result cache
+func evictResultCache(cache *ResultCache, interval time.Duration) {
+	for {
+		cache.Evict()
+		time.Sleep(interval)
+	}
+}
+
+//resultCache cache used by ExecuteTask, nil disables caching
+var resultCache *ResultCache
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func testOutput(outcome string, output string) *ProgramOutput {
+	result := ProgramOutput{}
+	result.Output = output
+	result.outcome = outcome
+
+	return &result
+}
+
+func TestCacheableResult(t *testing.T) {
+	exitErr := exec.Command("false").Run()
+	if _, ok := exitErr.(*exec.ExitError); !ok {
+		t.Fatalf("false exited with %v, want an *exec.ExitError", exitErr)
+	}
+
+	killed := testOutput(OutcomeSuccess, "")
+	killed.killed = true
+
+	cases := []struct {
+		name   string
+		output *ProgramOutput
+		err    error
+		want   bool
+	}{
+		{"success", testOutput(OutcomeSuccess, "1\n"), nil, true},
+		{"compile error", testOutput(OutcomeCompileError, "./main.go:3:14: undefined: x"), exitErr, true},
+		{"runtime error", testOutput(OutcomeRuntimeError, "panic: 1"), exitErr, true},
+		{"timeout", testOutput(OutcomeTimeout, ""), nil, false},
+		{"oom", testOutput(OutcomeOOM, ""), exitErr, false},
+		{"killed", killed, nil, false},
+		{"internal error", testOutput("", "Failed to execute the container, internal error"), errors.New("exec: docker not found"), false},
+		{"failed command", testOutput(OutcomeRuntimeError, "Failed to run command"), errors.New("broken pipe"), false},
+		{"module proxy", testOutput(OutcomeCompileError, "dial tcp: lookup proxy.golang.org: no such host"), exitErr, false},
+		{"full disk", testOutput(OutcomeCompileError, "write /tmp/go-build: no space left on device"), exitErr, false},
+		{"no output", nil, nil, false},
+	}
+
+	for _, c := range cases {
+		if got := isCacheableResult(c.output, c.err); got != c.want {
+			t.Errorf("isCacheableResult(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestResultCacheMemoryTier(t *testing.T) {
+	cache, _ := NewResultCache(2, "", 0, time.Hour)
+
+	cache.Put("a", testOutput(OutcomeSuccess, "a"))
+	cache.Put("b", testOutput(OutcomeSuccess, "b"))
+	cache.Get("a")
+	cache.Put("c", testOutput(OutcomeSuccess, "c"))
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Get(b) hit, want the least recently used result evicted")
+	}
+	if output, ok := cache.Get("a"); !ok || output.Output != "a" {
+		t.Errorf("Get(a) = %v, %v, want the result of a", output, ok)
+	}
+}
+
+func TestResultCacheSkipsUncacheableOutcomes(t *testing.T) {
+	cache, _ := NewResultCache(8, t.TempDir(), 1<<20, time.Hour)
+
+	cache.Put("internal", testOutput("", "Failed to run command"))
+	if _, ok := cache.Get("internal"); ok {
+		t.Error("Get() served a result without an outcome")
+	}
+
+	//the disk tier rejects it too once it left memory
+	cache.Put("success", testOutput(OutcomeSuccess, "1\n"))
+	cache.lock.Lock()
+	cache.entries.Init()
+	cache.index = make(map[string]*list.Element)
+	cache.lock.Unlock()
+
+	if output, ok := cache.Get("success"); !ok || output.outcome != OutcomeSuccess {
+		t.Errorf("Get() from disk = %v, %v, want the success", output, ok)
+	}
+	if _, ok := cache.Get("internal"); ok {
+		t.Error("Get() from disk served a result without an outcome")
+	}
+}
+
+func TestResultCacheTTL(t *testing.T) {
+	cache, _ := NewResultCache(8, t.TempDir(), 1<<20, time.Hour)
+
+	cache.Put("old", testOutput(OutcomeSuccess, "1\n"))
+	cache.lock.Lock()
+	cache.index["old"].Value.(*cacheEntry).stored = time.Now().Add(-2 * time.Hour)
+	cache.lock.Unlock()
+
+	if _, ok := cache.Get("old"); ok {
+		t.Error("Get() served a result stored longer than the ttl ago")
+	}
+}
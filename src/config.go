@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//Config Represents the server configuration. Settings are read from the
+//defaults, a JSON config file, environment variables and command-line flags,
+//in increasing order of precedence. Every setting has the same name in the
+//config file and as a flag, and is read from GOPG_<NAME> in the environment
+type Config struct {
+	Listen               string
+	MinWorkers           int
+	MaxWorkers           int
+	WorkerIdleTimeout    time.Duration
+	QueueSize            int
+	QueuePerClient       int
+	Timeout              time.Duration
+	MemoryLimitMB        int
+	TempDir              string
+	Sandbox              bool
+	SandboxImage         string
+	SnippetDir           string
+	SnippetMaxSizeKB     int
+	SnippetExpiry        time.Duration
+	ResultCacheDir       string
+	ResultCacheMaxSizeMB int
+	ResultCacheTTL       time.Duration
+	BuildCacheDir        string
+	BuildCacheMaxSizeMB  int
+	ModulesConfig        string
+	APIKeys              string
+	RateLimit            float64
+	RateBurst            int
+	DailyExecutions      int
+	DailyCPUSeconds      float64
+	TrustedProxies       string
+	QuotaFile            string
+	MaxBodyKB            int
+	MaxProgramKB         int
+	MaxStdinKB           int
+	MaxFiles             int
+	MultipartMemoryKB    int
+	LogLevel             string
+	LogFormat            string
+	AuditDir             string
+	AuditMaxSizeMB       int
+	AuditRetentionDays   int
+	AuditSource          string
+	AuditRedactAddresses bool
+	TLSCert              string
+	TLSKey               string
+	TLSClientCA          string
+	TLSClientAuth        string
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	IdleTimeout          time.Duration
+	CORSOrigins          string
+	CORSMethods          string
+	CORSHeaders          string
+	CORSCredentials      bool
+	CORSMaxAge           time.Duration
+	Playground           bool
+
+	//trustedProxies parsed TrustedProxies, set by Validate
+	trustedProxies []*net.IPNet
+
+	//logLevel parsed LogLevel, set by Validate
+	logLevel slog.Level
+
+	//corsOrigins, corsMethods and corsHeaders parsed CORS settings, set by Validate
+	corsOrigins []string
+	corsMethods []string
+	corsHeaders []string
+}
+
+//reloadableSettings settings applied on SIGHUP, the others need a restart
+var reloadableSettings = map[string]bool{
+	"min-workers":            true,
+	"max-workers":            true,
+	"worker-idle-timeout":    true,
+	"timeout":                true,
+	"memory-limit-mb":        true,
+	"sandbox-image":          true,
+	"rate-limit":             true,
+	"rate-burst":             true,
+	"daily-executions":       true,
+	"daily-cpu-seconds":      true,
+	"trusted-proxies":        true,
+	"max-body-kb":            true,
+	"max-program-kb":         true,
+	"max-stdin-kb":           true,
+	"max-files":              true,
+	"multipart-memory-kb":    true,
+	"read-timeout":           true,
+	"log-level":              true,
+	"audit-retention-days":   true,
+	"audit-source":           true,
+	"audit-redact-addresses": true,
+	"cors-origins":           true,
+	"cors-methods":           true,
+	"cors-headers":           true,
+	"cors-credentials":       true,
+	"cors-max-age":           true,
+}
+
+//legacyEnv environment variables read before the GOPG_ prefix was introduced
+var legacyEnv = map[string]string{
+	"SANDBOX":          "sandbox",
+	"SNIPPET_DIR":      "snippet-dir",
+	"RESULT_CACHE_DIR": "result-cache-dir",
+	"BUILD_CACHE_DIR":  "build-cache-dir",
+	"MODULES_CONFIG":   "modules-config",
+}
+
+//DefaultConfig scales between one worker per CPU and 256 workers
+func DefaultConfig() *Config {
+	config := Config{}
+	config.Listen = ":9000"
+	config.MinWorkers = runtime.NumCPU()
+	config.MaxWorkers = 256
+	config.WorkerIdleTimeout = time.Minute
+	config.QueueSize = 100
+	config.QueuePerClient = 25
+	config.Timeout = SandboxTimeout * time.Second
+	config.MemoryLimitMB = SandboxMemory >> 20
+	config.TempDir = "/tmp"
+	config.Sandbox = false
+	config.SandboxImage = SandboxImage
+	config.SnippetDir = SnippetDir
+	config.SnippetMaxSizeKB = SnippetMaxSize >> 10
+	config.SnippetExpiry = SnippetExpiry
+	config.ResultCacheDir = ""
+	config.ResultCacheMaxSizeMB = 256
+	config.ResultCacheTTL = time.Hour
+	config.BuildCacheDir = BuildCacheDir
+	config.BuildCacheMaxSizeMB = int(BuildCacheMaxSize >> 20)
+	config.ModulesConfig = ""
+	config.APIKeys = ""
+	config.RateLimit = 5
+	config.RateBurst = 20
+	config.DailyExecutions = 0
+	config.DailyCPUSeconds = 0
+	config.TrustedProxies = ""
+	config.QuotaFile = QuotaFile
+	config.MaxBodyKB = 1024
+	config.MaxProgramKB = 64
+	config.MaxStdinKB = 64
+	config.MaxFiles = 8
+	config.MultipartMemoryKB = 256
+	config.LogLevel = "warn"
+	config.LogFormat = "json"
+	config.AuditDir = ""
+	config.AuditMaxSizeMB = 100
+	config.AuditRetentionDays = 90
+	config.AuditSource = "hash"
+	config.AuditRedactAddresses = false
+	config.TLSCert = ""
+	config.TLSKey = ""
+	config.TLSClientCA = ""
+	config.TLSClientAuth = "require"
+	config.ReadHeaderTimeout = 10 * time.Second
+	config.ReadTimeout = time.Minute
+	config.IdleTimeout = 2 * time.Minute
+	config.CORSOrigins = ""
+	config.CORSMethods = "GET,POST,DELETE"
+	config.CORSHeaders = "Authorization,Content-Type,X-Request-ID,X-Priority"
+	config.CORSCredentials = false
+	config.CORSMaxAge = 10 * time.Minute
+	config.Playground = true
+
+	return &config
+}
+
+//registerFlags defines a flag for every setting, bound to the fields of config
+func registerFlags(flags *flag.FlagSet, config *Config) {
+	flags.StringVar(&config.Listen, "listen", config.Listen, "address the server listens on")
+	flags.IntVar(&config.MinWorkers, "min-workers", config.MinWorkers, "workers kept running when idle")
+	flags.IntVar(&config.MaxWorkers, "max-workers", config.MaxWorkers, "maximum number of workers")
+	flags.DurationVar(&config.WorkerIdleTimeout, "worker-idle-timeout", config.WorkerIdleTimeout, "time after which an idle worker above min-workers stops")
+	flags.IntVar(&config.QueueSize, "queue-size", config.QueueSize, "maximum number of queued jobs")
+	flags.IntVar(&config.QueuePerClient, "queue-per-client", config.QueuePerClient, "maximum number of queued jobs of a single client, 0 for no limit")
+	flags.DurationVar(&config.Timeout, "timeout", config.Timeout, "maximum run time of a program")
+	flags.IntVar(&config.MemoryLimitMB, "memory-limit-mb", config.MemoryLimitMB, "memory limit of a sandboxed program, in MB")
+	flags.StringVar(&config.TempDir, "temp-dir", config.TempDir, "directory holding the program workspaces")
+	flags.BoolVar(&config.Sandbox, "sandbox", config.Sandbox, "run programs in gVisor containers")
+	flags.StringVar(&config.SandboxImage, "sandbox-image", config.SandboxImage, "docker image the sandboxed programs run in")
+	flags.StringVar(&config.SnippetDir, "snippet-dir", config.SnippetDir, "directory holding the shared programs")
+	flags.IntVar(&config.SnippetMaxSizeKB, "snippet-max-size-kb", config.SnippetMaxSizeKB, "maximum size of a shared program, in KB")
+	flags.DurationVar(&config.SnippetExpiry, "snippet-expiry", config.SnippetExpiry, "time after which a shared program is removed, 0 to keep them forever")
+	flags.StringVar(&config.ResultCacheDir, "result-cache-dir", config.ResultCacheDir, "directory of the on-disk result cache, empty to keep results in memory only")
+	flags.IntVar(&config.ResultCacheMaxSizeMB, "result-cache-max-size-mb", config.ResultCacheMaxSizeMB, "size above which the least recently used on-disk results are removed, in MB")
+	flags.DurationVar(&config.ResultCacheTTL, "result-cache-ttl", config.ResultCacheTTL, "time a result is served for after its run, 0 to keep results until evicted by size")
+	flags.StringVar(&config.BuildCacheDir, "build-cache-dir", config.BuildCacheDir, "directory of the shared build and module caches")
+	flags.IntVar(&config.BuildCacheMaxSizeMB, "build-cache-max-size-mb", config.BuildCacheMaxSizeMB, "size above which the least recently used build outputs are removed, in MB")
+	flags.StringVar(&config.ModulesConfig, "modules-config", config.ModulesConfig, "JSON file listing the third-party modules programs may require")
+	flags.StringVar(&config.APIKeys, "api-keys", config.APIKeys, "JSON file holding the hashed API keys, empty to disable authentication")
+	flags.Float64Var(&config.RateLimit, "rate-limit", config.RateLimit, "requests per second of a single client, 0 for no limit")
+	flags.IntVar(&config.RateBurst, "rate-burst", config.RateBurst, "requests a single client may send at once")
+	flags.IntVar(&config.DailyExecutions, "daily-executions", config.DailyExecutions, "programs a single client may run per day, 0 for no limit")
+	flags.Float64Var(&config.DailyCPUSeconds, "daily-cpu-seconds", config.DailyCPUSeconds, "CPU-seconds a single client may use per day, 0 for no limit")
+	flags.StringVar(&config.TrustedProxies, "trusted-proxies", config.TrustedProxies, "comma separated addresses and CIDR ranges whose X-Forwarded-For header is honoured")
+	flags.StringVar(&config.QuotaFile, "quota-file", config.QuotaFile, "file the daily usage is persisted to, empty to keep it in memory")
+	flags.IntVar(&config.MaxBodyKB, "max-body-kb", config.MaxBodyKB, "maximum size of a request body, in KB")
+	flags.IntVar(&config.MaxProgramKB, "max-program-kb", config.MaxProgramKB, "maximum size of the sources of a program, in KB")
+	flags.IntVar(&config.MaxStdinKB, "max-stdin-kb", config.MaxStdinKB, "maximum size of the standard input of a program, in KB")
+	flags.IntVar(&config.MaxFiles, "max-files", config.MaxFiles, "maximum number of source files of a program")
+	flags.IntVar(&config.MultipartMemoryKB, "multipart-memory-kb", config.MultipartMemoryKB, "memory used to parse an uploaded form before spilling to temp-dir, in KB")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "lowest level logged: debug, info, warn or error")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "format of the logs: json or text")
+	flags.StringVar(&config.AuditDir, "audit-dir", config.AuditDir, "directory of the execution audit log, empty to disable it")
+	flags.IntVar(&config.AuditMaxSizeMB, "audit-max-size-mb", config.AuditMaxSizeMB, "size after which an audit file is continued in a new one, in MB")
+	flags.IntVar(&config.AuditRetentionDays, "audit-retention-days", config.AuditRetentionDays, "days the audit files are kept")
+	flags.StringVar(&config.AuditSource, "audit-source", config.AuditSource, "sources kept in the audit log: hash or full")
+	flags.BoolVar(&config.AuditRedactAddresses, "audit-redact-addresses", config.AuditRedactAddresses, "record a hash of the client addresses in the audit log")
+	flags.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "PEM certificate served over HTTPS, empty to serve plain HTTP")
+	flags.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "PEM private key of tls-cert")
+	flags.StringVar(&config.TLSClientCA, "tls-client-ca", config.TLSClientCA, "PEM certificates of the CAs verifying client certificates, empty to disable mutual TLS")
+	flags.StringVar(&config.TLSClientAuth, "tls-client-auth", config.TLSClientAuth, "client certificates with tls-client-ca: require or optional")
+	flags.DurationVar(&config.ReadHeaderTimeout, "read-header-timeout", config.ReadHeaderTimeout, "time a client may take to send the headers of a request")
+	flags.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "time a client may take to send the body of a request")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "time an idle connection is kept open")
+	flags.StringVar(&config.CORSOrigins, "cors-origins", config.CORSOrigins, "comma separated origins of the browser editors allowed to call the API, * for any, empty to disable CORS")
+	flags.StringVar(&config.CORSMethods, "cors-methods", config.CORSMethods, "comma separated methods allowed from other origins")
+	flags.StringVar(&config.CORSHeaders, "cors-headers", config.CORSHeaders, "comma separated request headers allowed from other origins")
+	flags.BoolVar(&config.CORSCredentials, "cors-credentials", config.CORSCredentials, "let the browsers send credentials from other origins")
+	flags.DurationVar(&config.CORSMaxAge, "cors-max-age", config.CORSMaxAge, "time browsers cache a preflight answer")
+	flags.BoolVar(&config.Playground, "playground", config.Playground, "serve the web playground at /")
+}
+
+//settingNames names of every setting, sorted
+func settingNames() []string {
+	names := make([]string, 0)
+	flags := flag.NewFlagSet("settings", flag.ContinueOnError)
+	registerFlags(flags, DefaultConfig())
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+
+	return names
+}
+
+//values returns every setting of the config formatted as a flag value
+func (config *Config) values() map[string]string {
+	values := make(map[string]string)
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	registerFlags(flags, config)
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+
+	return values
+}
+
+//String formats the config as a JSON config file
+func (config *Config) String() string {
+	data, _ := json.MarshalIndent(config.values(), "", "  ")
+	return string(data)
+}
+
+//PoolConfig worker pool settings, a sandboxed job needs its memory limit
+func (config *Config) PoolConfig() PoolConfig {
+	pool := PoolConfig{}
+	pool.MinWorkers = config.MinWorkers
+	pool.MaxWorkers = config.MaxWorkers
+	pool.IdleTimeout = config.WorkerIdleTimeout
+	pool.ScaleInterval = time.Second
+	pool.MaxLoadPerCPU = 2.0
+	pool.JobMemory = 256 << 20
+
+	if config.Sandbox {
+		pool.JobMemory = uint64(config.MemoryLimitMB) << 20
+	}
+
+	return pool
+}
+
+//SnippetLimits limits of the shared programs
+func (config *Config) SnippetLimits() SnippetLimits {
+	limits := SnippetLimits{}
+	limits.MaxSize = config.SnippetMaxSizeKB << 10
+	limits.Expiry = config.SnippetExpiry
+
+	return limits
+}
+
+//Validate checks every setting, reporting all the invalid ones at once
+func (config *Config) Validate() error {
+	problems := make([]string, 0)
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		invalid("listen: %v", err)
+	}
+	if config.MinWorkers < 1 {
+		invalid("min-workers: must be at least 1, found %d", config.MinWorkers)
+	}
+	if config.MaxWorkers < config.MinWorkers {
+		invalid("max-workers: must be at least min-workers (%d), found %d", config.MinWorkers, config.MaxWorkers)
+	}
+	if config.WorkerIdleTimeout <= 0 {
+		invalid("worker-idle-timeout: must be positive, found %s", config.WorkerIdleTimeout)
+	}
+	if config.QueueSize < 1 {
+		invalid("queue-size: must be at least 1, found %d", config.QueueSize)
+	}
+	if config.QueuePerClient < 0 || config.QueuePerClient > config.QueueSize {
+		invalid("queue-per-client: must be between 0 and queue-size (%d), found %d", config.QueueSize, config.QueuePerClient)
+	}
+	if config.Timeout <= 0 {
+		invalid("timeout: must be positive, found %s", config.Timeout)
+	}
+
+	//docker refuses containers with less than 6MB of memory
+	if config.MemoryLimitMB < 6 {
+		invalid("memory-limit-mb: must be at least 6, found %d", config.MemoryLimitMB)
+	}
+
+	if config.Sandbox && config.SandboxImage == "" {
+		invalid("sandbox-image: must be set when the sandbox is enabled")
+	}
+
+	if !filepath.IsAbs(config.TempDir) {
+		invalid("temp-dir: must be an absolute path, found %q", config.TempDir)
+	} else if info, err := os.Stat(config.TempDir); err != nil || !info.IsDir() {
+		invalid("temp-dir: %s is not a directory", config.TempDir)
+	}
+
+	directories := map[string]string{
+		"snippet-dir":      config.SnippetDir,
+		"result-cache-dir": config.ResultCacheDir,
+		"build-cache-dir":  config.BuildCacheDir,
+	}
+	for _, name := range []string{"snippet-dir", "result-cache-dir", "build-cache-dir"} {
+		dir := directories[name]
+		if (dir != "" || name != "result-cache-dir") && !filepath.IsAbs(dir) {
+			invalid("%s: must be an absolute path, found %q", name, dir)
+		}
+	}
+
+	if config.SnippetMaxSizeKB < 1 {
+		invalid("snippet-max-size-kb: must be at least 1, found %d", config.SnippetMaxSizeKB)
+	}
+	if config.SnippetExpiry < 0 {
+		invalid("snippet-expiry: must not be negative, found %s", config.SnippetExpiry)
+	}
+
+	if config.BuildCacheMaxSizeMB < 1 {
+		invalid("build-cache-max-size-mb: must be at least 1, found %d", config.BuildCacheMaxSizeMB)
+	}
+
+	if config.ResultCacheMaxSizeMB < 1 {
+		invalid("result-cache-max-size-mb: must be at least 1, found %d", config.ResultCacheMaxSizeMB)
+	}
+	if config.ResultCacheTTL < 0 {
+		invalid("result-cache-ttl: must not be negative, found %s", config.ResultCacheTTL)
+	}
+
+	if config.ModulesConfig != "" {
+		if _, err := os.Stat(config.ModulesConfig); err != nil {
+			invalid("modules-config: %v", err)
+		}
+	}
+
+	//the key file may not exist yet, the first key creates it
+	if config.APIKeys != "" && !filepath.IsAbs(config.APIKeys) {
+		invalid("api-keys: must be an absolute path, found %q", config.APIKeys)
+	}
+
+	if config.RateLimit < 0 {
+		invalid("rate-limit: must not be negative, found %g", config.RateLimit)
+	}
+	if config.RateLimit > 0 && config.RateBurst < 1 {
+		invalid("rate-burst: must be at least 1, found %d", config.RateBurst)
+	}
+	if config.DailyExecutions < 0 {
+		invalid("daily-executions: must not be negative, found %d", config.DailyExecutions)
+	}
+	if config.DailyCPUSeconds < 0 {
+		invalid("daily-cpu-seconds: must not be negative, found %g", config.DailyCPUSeconds)
+	}
+
+	proxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		invalid("trusted-proxies: %v", err)
+	}
+	config.trustedProxies = proxies
+
+	if config.QuotaFile != "" && !filepath.IsAbs(config.QuotaFile) {
+		invalid("quota-file: must be an absolute path, found %q", config.QuotaFile)
+	}
+
+	limits := map[string]int{
+		"max-body-kb":         config.MaxBodyKB,
+		"max-program-kb":      config.MaxProgramKB,
+		"max-stdin-kb":        config.MaxStdinKB,
+		"max-files":           config.MaxFiles,
+		"multipart-memory-kb": config.MultipartMemoryKB,
+	}
+	for _, name := range []string{"max-body-kb", "max-program-kb", "max-stdin-kb", "max-files", "multipart-memory-kb"} {
+		if limits[name] < 1 {
+			invalid("%s: must be at least 1, found %d", name, limits[name])
+		}
+	}
+
+	err = config.logLevel.UnmarshalText([]byte(config.LogLevel))
+	if err != nil {
+		invalid("log-level: must be debug, info, warn or error, found %q", config.LogLevel)
+	}
+	if config.LogFormat != "json" && config.LogFormat != "text" {
+		invalid("log-format: must be json or text, found %q", config.LogFormat)
+	}
+
+	if config.AuditDir != "" && !filepath.IsAbs(config.AuditDir) {
+		invalid("audit-dir: must be an absolute path, found %q", config.AuditDir)
+	}
+	if config.AuditMaxSizeMB < 1 {
+		invalid("audit-max-size-mb: must be at least 1, found %d", config.AuditMaxSizeMB)
+	}
+	if config.AuditRetentionDays < 1 {
+		invalid("audit-retention-days: must be at least 1, found %d", config.AuditRetentionDays)
+	}
+	if config.AuditSource != "hash" && config.AuditSource != "full" {
+		invalid("audit-source: must be hash or full, found %q", config.AuditSource)
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		invalid("tls-cert and tls-key: must be set together")
+	}
+	tlsFiles := map[string]string{
+		"tls-cert":      config.TLSCert,
+		"tls-key":       config.TLSKey,
+		"tls-client-ca": config.TLSClientCA,
+	}
+	for _, name := range []string{"tls-cert", "tls-key", "tls-client-ca"} {
+		if tlsFiles[name] != "" && !filepath.IsAbs(tlsFiles[name]) {
+			invalid("%s: must be an absolute path, found %q", name, tlsFiles[name])
+		}
+	}
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		invalid("tls-client-ca: needs tls-cert and tls-key")
+	}
+	if config.TLSClientAuth != "require" && config.TLSClientAuth != "optional" {
+		invalid("tls-client-auth: must be require or optional, found %q", config.TLSClientAuth)
+	}
+
+	timeouts := map[string]time.Duration{
+		"read-header-timeout": config.ReadHeaderTimeout,
+		"read-timeout":        config.ReadTimeout,
+		"idle-timeout":        config.IdleTimeout,
+	}
+	for _, name := range []string{"read-header-timeout", "read-timeout", "idle-timeout"} {
+		if timeouts[name] <= 0 {
+			invalid("%s: must be positive, found %s", name, timeouts[name])
+		}
+	}
+
+	config.corsOrigins = splitList(config.CORSOrigins)
+	config.corsMethods = splitList(config.CORSMethods)
+	config.corsHeaders = splitList(config.CORSHeaders)
+	for _, origin := range config.corsOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			invalid("cors-origins: origins look like https://editor.example.edu, found %q", origin)
+		}
+		//any page could then act with the credentials of the user
+		if origin == "*" && config.CORSCredentials {
+			invalid("cors-credentials: cannot be enabled for any origin")
+		}
+	}
+	if len(config.corsOrigins) > 0 && len(config.corsMethods) == 0 {
+		invalid("cors-methods: must not be empty when cors-origins is set")
+	}
+	if config.CORSMaxAge < 0 {
+		invalid("cors-max-age: must not be negative, found %s", config.CORSMaxAge)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+//Reloaded returns next with the settings that need a restart kept from
+//config, along with the names of the changed settings that were kept
+func (config *Config) Reloaded(next *Config) (*Config, []string) {
+	reloaded := *next
+	current := config.values()
+
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	registerFlags(flags, &reloaded)
+
+	kept := make([]string, 0)
+	for name, value := range reloaded.values() {
+		if value != current[name] && !reloadableSettings[name] {
+			flags.Set(name, current[name])
+			kept = append(kept, name)
+		}
+	}
+	sort.Strings(kept)
+
+	return &reloaded, kept
+}
+
+//ConfigLoader reads the configuration from its sources, it is kept to reload the config
+type ConfigLoader struct {
+	//path config file, if any
+	path string
+
+	//flags command-line, only the flags given explicitly override other sources
+	flags *flag.FlagSet
+
+	//PrintConfig set by -print-config, the config is printed and the server does not start
+	PrintConfig bool
+
+	//CreateAdminKey set by -create-admin-key, an admin key with this name is
+	//added to the key file and the server does not start
+	CreateAdminKey string
+}
+
+//Load reads and validates the configuration
+func (loader *ConfigLoader) Load() (*Config, error) {
+	config := DefaultConfig()
+
+	settings := flag.NewFlagSet("config", flag.ContinueOnError)
+	settings.SetOutput(ioutil.Discard)
+	registerFlags(settings, config)
+
+	if loader.path != "" {
+		err := loadConfigFile(settings, loader.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := loadConfigEnv(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	loader.flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" && f.Name != "create-admin-key" {
+			settings.Set(f.Name, f.Value.String())
+		}
+	})
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+//loadConfigFile applies the settings of a JSON object, values may be strings, numbers or booleans
+func loadConfigFile(settings *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err != nil {
+		return fmt.Errorf("Invalid config file %s: %v", path, err)
+	}
+
+	for name, value := range values {
+		if settings.Lookup(name) == nil {
+			return fmt.Errorf("Invalid config file %s: unknown setting %q", path, name)
+		}
+
+		switch value.(type) {
+		case string, json.Number, bool:
+		default:
+			return fmt.Errorf("Invalid config file %s: %s must be a string, a number or a boolean", path, name)
+		}
+
+		err = settings.Set(name, fmt.Sprint(value))
+		if err != nil {
+			return fmt.Errorf("Invalid config file %s: %s: %v", path, name, err)
+		}
+	}
+
+	return nil
+}
+
+//loadConfigEnv applies the legacy environment variables, then the GOPG_ ones
+func loadConfigEnv(settings *flag.FlagSet) error {
+	for env, name := range legacyEnv {
+		if value, exists := os.LookupEnv(env); exists {
+			err := settings.Set(name, value)
+			if err != nil {
+				return fmt.Errorf("Invalid environment variable %s: %v", env, err)
+			}
+		}
+	}
+
+	for _, name := range settingNames() {
+		env := "GOPG_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, exists := os.LookupEnv(env); exists {
+			err := settings.Set(name, value)
+			if err != nil {
+				return fmt.Errorf("Invalid environment variable %s: %v", env, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//NewConfigLoader parses the command-line arguments, exiting on -h or invalid flags
+func NewConfigLoader(name string, args []string, output io.Writer) (*ConfigLoader, error) {
+	loader := ConfigLoader{}
+	loader.flags = flag.NewFlagSet(name, flag.ExitOnError)
+	loader.flags.SetOutput(output)
+
+	loader.flags.StringVar(&loader.path, "config", os.Getenv("GOPG_CONFIG"), "JSON config file")
+	loader.flags.BoolVar(&loader.PrintConfig, "print-config", false, "print the effective configuration and exit")
+	loader.flags.StringVar(&loader.CreateAdminKey, "create-admin-key", "", "add an admin key with this name to the api-keys file, print it and exit")
+	registerFlags(loader.flags, DefaultConfig())
+
+	err := loader.flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if loader.flags.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %s", strings.Join(loader.flags.Args(), " "))
+	}
+
+	return &loader, nil
+}
+
+//serverConfig configuration in effect, replaced on SIGHUP
+var serverConfig atomic.Pointer[Config]
+
+//currentConfig returns the configuration in effect, the defaults until one is loaded
+func currentConfig() *Config {
+	config := serverConfig.Load()
+	if config == nil {
+		return DefaultConfig()
+	}
+
+	return config
+}
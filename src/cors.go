@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//CORSExposedHeaders response headers browsers let the editors read
+const CORSExposedHeaders string = "X-Request-ID, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After"
+
+//splitList splits a comma separated setting, ignoring the empty items
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+//containsFold reports whether items holds value, ignoring case
+func containsFold(items []string, value string) bool {
+	for _, item := range items {
+		if item == "*" || strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//allowCORS lets the browsers of cors-origins call the API. Preflight requests
+//are answered here, they never reach the routes nor the queue
+func allowCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(config.corsOrigins) == 0 {
+			next(w, r)
+			return
+		}
+
+		//the answer depends on the origin, caches must keep one per origin
+		w.Header().Add("Vary", "Origin")
+		allowed := containsFold(config.corsOrigins, origin)
+
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", CORSExposedHeaders)
+				if config.CORSCredentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+			next(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		if !allowed {
+			sendError(&w, CodeForbidden, fmt.Sprintf("Origin %s is not allowed", origin))
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !containsFold(config.corsMethods, method) {
+			sendError(&w, CodeForbidden, fmt.Sprintf("Method %s is not allowed from other origins", method))
+			return
+		}
+		for _, header := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+			if !containsFold(config.corsHeaders, header) {
+				sendError(&w, CodeForbidden, fmt.Sprintf("Header %s is not allowed from other origins", header))
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(config.corsMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(config.corsHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORSMaxAge.Seconds())))
+		if config.CORSCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+//ErrorCode machine-readable code of an error answer, clients should match on it rather than on the message
+type ErrorCode string
+
+const (
+	CodeInvalidRequest       ErrorCode = "INVALID_REQUEST"
+	CodeEmptyProgram         ErrorCode = "EMPTY_PROGRAM"
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodePayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeMethodNotAllowed     ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeRateLimited          ErrorCode = "RATE_LIMITED"
+	CodeQueueFull            ErrorCode = "QUEUE_FULL"
+	CodeCancelled            ErrorCode = "CANCELLED"
+	CodeShuttingDown         ErrorCode = "SHUTTING_DOWN"
+	CodeInternal             ErrorCode = "INTERNAL"
+)
+
+//StatusClientClosedRequest status of requests whose client went away, as logged by nginx
+const StatusClientClosedRequest int = 499
+
+//errorStatus HTTP status answered with every code
+var errorStatus = map[ErrorCode]int{
+	CodeInvalidRequest:       http.StatusBadRequest,
+	CodeEmptyProgram:         http.StatusBadRequest,
+	CodeUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	CodePayloadTooLarge:      http.StatusRequestEntityTooLarge,
+	CodeUnauthorized:         http.StatusUnauthorized,
+	CodeForbidden:            http.StatusForbidden,
+	CodeNotFound:             http.StatusNotFound,
+	CodeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	CodeRateLimited:          http.StatusTooManyRequests,
+	CodeQueueFull:            http.StatusTooManyRequests,
+	CodeCancelled:            StatusClientClosedRequest,
+	CodeShuttingDown:         http.StatusServiceUnavailable,
+	CodeInternal:             http.StatusInternalServerError,
+}
+
+//Status returns the HTTP status of the code, 500 for unknown codes
+func (code ErrorCode) Status() int {
+	status, ok := errorStatus[code]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+
+	return status
+}
+
+//answerPanic logs the panic of a handler and answers with an INTERNAL error,
+//unless the handler already started its answer
+func answerPanic(recovered interface{}, w *statusRecorder, r *http.Request) {
+	requestLogger(r.Context()).Error("Panic serving a request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"panic", fmt.Sprint(recovered),
+		"stack", string(debug.Stack()),
+	)
+
+	if w.status == 0 {
+		var writer http.ResponseWriter = w
+		sendError(&writer, CodeInternal, fmt.Sprintf("Internal error while serving %s", r.URL.Path))
+	}
+}
+
+//recoverPanics answers the requests whose handler panics with an INTERNAL error
+func recoverPanics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			//net/http aborts the answer silently
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			answerPanic(recovered, recorder, r)
+		}()
+
+		next(recorder, r)
+	}
+}
+
+//APIError Represents an error answered to the client
+type APIError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *APIError) Error() string {
+	return err.Message
+}
+
+//NewAPIError creates an error answered with code, the message is formatted like fmt.Sprintf
+func NewAPIError(code ErrorCode, format string, args ...interface{}) *APIError {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+
+	//ReadinessCheckTimeout time given to every dependency check
+	ReadinessCheckTimeout = 5 * time.Second
+
+	//ReadinessCacheTTL dependency checks are run at most once in this interval
+	ReadinessCacheTTL = 10 * time.Second
+
+	//DockerSocket unix socket of the docker daemon used in sandbox mode
+	DockerSocket string = "/var/run/docker.sock"
+)
+
+//CheckResult Represents the result of a dependency check
+type CheckResult struct {
+	Name     string  `json:"name"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+//Saturation Represents how busy the workers and the work-queue are
+type Saturation struct {
+	Workers       int  `json:"workers"`
+	BusyWorkers   int  `json:"busyWorkers"`
+	MaxWorkers    int  `json:"maxWorkers"`
+	QueueLength   int  `json:"queueLength"`
+	QueueCapacity int  `json:"queueCapacity"`
+	Saturated     bool `json:"saturated"`
+}
+
+//Readiness Represents the answer of the readiness endpoint
+type Readiness struct {
+	Ready      bool          `json:"ready"`
+	Checks     []CheckResult `json:"checks"`
+	Saturation Saturation    `json:"saturation"`
+}
+
+//ReadinessCheck checks a dependency, failing with a description of the problem
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+//HealthChecker runs the readiness checks, caching their results
+type HealthChecker struct {
+	checks []ReadinessCheck
+	pool   *WorkerPool
+
+	lock      *sync.Mutex
+	results   []CheckResult
+	checkedAt time.Time
+}
+
+//runChecks runs every check concurrently, or returns the cached results
+func (checker *HealthChecker) runChecks() []CheckResult {
+	checker.lock.Lock()
+	defer checker.lock.Unlock()
+
+	if checker.results != nil && time.Since(checker.checkedAt) < ReadinessCacheTTL {
+		return checker.results
+	}
+
+	results := make([]CheckResult, len(checker.checks))
+
+	var wg sync.WaitGroup
+	for idx, check := range checker.checks {
+		wg.Add(1)
+		go func(idx int, check ReadinessCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), ReadinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(ctx)
+
+			results[idx] = CheckResult{
+				Name:     check.Name,
+				OK:       err == nil,
+				Duration: time.Since(start).Seconds(),
+			}
+			if err != nil {
+				results[idx].Error = err.Error()
+			}
+		}(idx, check)
+	}
+	wg.Wait()
+
+	checker.results = results
+	checker.checkedAt = time.Now()
+
+	return results
+}
+
+//saturation reports the pool usage, the pool is saturated once the queue is full or closed
+func (checker *HealthChecker) saturation() Saturation {
+	status := checker.pool.Status()
+
+	saturation := Saturation{}
+	saturation.Workers = status.Workers
+	saturation.BusyWorkers = status.BusyWorkers
+	saturation.MaxWorkers = status.MaxWorkers
+	saturation.QueueLength = status.QueueLength
+	saturation.QueueCapacity = status.QueueCapacity
+	saturation.Saturated = status.QueueLength >= status.QueueCapacity || checker.pool.queue.Closed()
+
+	return saturation
+}
+
+//Readiness runs the dependency checks and reports the pool saturation
+func (checker *HealthChecker) Readiness() *Readiness {
+	readiness := Readiness{}
+	readiness.Checks = checker.runChecks()
+	readiness.Saturation = checker.saturation()
+
+	readiness.Ready = !readiness.Saturation.Saturated
+	for _, result := range readiness.Checks {
+		readiness.Ready = readiness.Ready && result.OK
+	}
+
+	return &readiness
+}
+
+//ServeLiveness answers /healthz, the process is alive as long as it answers
+func (checker *HealthChecker) ServeLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+//ServeReadiness answers /readyz, with 503 when a check fails or the pool is saturated
+func (checker *HealthChecker) ServeReadiness(w http.ResponseWriter, r *http.Request) {
+	readiness := checker.Readiness()
+	bytes, err := json.Marshal(readiness)
+	if err != nil {
+		sendError(&w, CodeInternal, "Failed to serialize readiness")
+		return
+	}
+
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(bytes))
+}
+
+//checkCommand runs a command, failing with its output
+func checkCommand(ctx context.Context, name string, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+		return "", fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), message)
+	}
+
+	return string(output), nil
+}
+
+func checkToolchain(ctx context.Context) error {
+	_, err := checkCommand(ctx, "go", "version")
+	return err
+}
+
+//checkTempDir programs are compiled in workspaces under the temp dir
+func checkTempDir(ctx context.Context) error {
+	file, err := ioutil.TempFile(currentConfig().TempDir, "gopg-readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("ok")
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+func checkDockerSocket(ctx context.Context) error {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "unix", DockerSocket)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func checkSandboxImage(ctx context.Context) error {
+	_, err := checkCommand(ctx, "docker", "image", "inspect", "--format", "{{.Id}}", currentConfig().SandboxImage)
+	return err
+}
+
+func checkSandboxRuntime(ctx context.Context) error {
+	output, err := checkCommand(ctx, "docker", "info", "--format", "{{json .Runtimes}}")
+	if err != nil {
+		return err
+	}
+
+	runtimes := make(map[string]interface{})
+	err = json.Unmarshal([]byte(output), &runtimes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse docker runtimes: %v", err)
+	}
+
+	if _, ok := runtimes["runsc"]; !ok {
+		return fmt.Errorf("runsc runtime is not registered with docker")
+	}
+
+	return nil
+}
+
+//NewHealthChecker creates the checker of the pool, the docker checks are added in sandbox mode
+func NewHealthChecker(pool *WorkerPool) *HealthChecker {
+	checker := HealthChecker{}
+	checker.pool = pool
+	checker.lock = &sync.Mutex{}
+	checker.checks = []ReadinessCheck{
+		{Name: "toolchain", Check: checkToolchain},
+		{Name: "tmp", Check: checkTempDir},
+	}
+
+	if isSandboxEnabled() {
+		checker.checks = append(checker.checks,
+			ReadinessCheck{Name: "docker", Check: checkDockerSocket},
+			ReadinessCheck{Name: "sandboxImage", Check: checkSandboxImage},
+			ReadinessCheck{Name: "sandboxRuntime", Check: checkSandboxRuntime},
+		)
+	}
+
+	return &checker
+}
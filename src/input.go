@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//MainFile name of the file holding InputPack.Program in the workspace
+const MainFile string = "main.go"
+
+//MaxArgs maximum number of arguments of a program
+const MaxArgs int = 64
+
+//MaxArgLength longest argument of a program, in bytes
+const MaxArgLength int = 1024
+
+//SourceFile Represents an additional source file of a program, in package main
+type SourceFile struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+//inputContext request context value holding the *InputPack parsed by parseProgram
+const inputContext contextKey = "input"
+
+//requestInput returns the program parsed before the request was queued
+func requestInput(ctx context.Context) *InputPack {
+	input, _ := ctx.Value(inputContext).(*InputPack)
+	return input
+}
+
+//sources returns the main file followed by the additional files
+func (input *InputPack) sources() []SourceFile {
+	sources := []SourceFile{{Name: MainFile, Content: input.Program}}
+	return append(sources, input.Files...)
+}
+
+//Validate checks a program to run against the limits of config, its sources
+//must be UTF-8 and in package main
+func (input *InputPack) Validate(config *Config) *APIError {
+	if strings.TrimSpace(input.Program) == "" {
+		return NewAPIError(CodeEmptyProgram, "Empty program found")
+	}
+
+	if 1+len(input.Files) > config.MaxFiles {
+		return NewAPIError(CodePayloadTooLarge, "A program may have at most %d files, found %d", config.MaxFiles, 1+len(input.Files))
+	}
+
+	size := 0
+	for _, source := range input.sources() {
+		size += len(source.Content)
+	}
+	if size > config.MaxProgramKB<<10 {
+		return NewAPIError(CodePayloadTooLarge, "The program is %d KB, the limit is %d KB", (size+1023)>>10, config.MaxProgramKB)
+	}
+
+	if len(input.Stdin) > config.MaxStdinKB<<10 {
+		return NewAPIError(CodePayloadTooLarge, "The standard input is %d KB, the limit is %d KB", (len(input.Stdin)+1023)>>10, config.MaxStdinKB)
+	}
+
+	if len(input.Args) > MaxArgs {
+		return NewAPIError(CodePayloadTooLarge, "A program may have at most %d arguments, found %d", MaxArgs, len(input.Args))
+	}
+	for _, arg := range input.Args {
+		if len(arg) > MaxArgLength || strings.ContainsRune(arg, 0) {
+			return NewAPIError(CodeInvalidRequest, "Arguments must be at most %d bytes long, without NUL bytes", MaxArgLength)
+		}
+	}
+
+	//test files are only built when running the tests
+	tests := 0
+	names := map[string]bool{MainFile: true}
+	for _, file := range input.Files {
+		if file.Name != filepath.Base(file.Name) || !strings.HasSuffix(file.Name, ".go") || strings.HasPrefix(file.Name, ".") {
+			return NewAPIError(CodeInvalidRequest, "Invalid file name %q, files are named like util.go", file.Name)
+		}
+		if strings.HasSuffix(file.Name, "_test.go") {
+			if !input.Test {
+				return NewAPIError(CodeInvalidRequest, "%s is a test file, test files are only built with test set", file.Name)
+			}
+			tests++
+		}
+		if names[file.Name] {
+			return NewAPIError(CodeInvalidRequest, "%s is given twice, %s holds the program", file.Name, MainFile)
+		}
+		names[file.Name] = true
+	}
+	if input.Test && tests == 0 {
+		return NewAPIError(CodeInvalidRequest, "Running the tests needs a file named like main_test.go")
+	}
+
+	//tests may live in an external package like main_test, only programs run must be in package main
+	for _, source := range input.sources() {
+		err := validateSource(source, !input.Test)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//validateSource rejects sources that are not UTF-8 or, when mainOnly is set,
+//declare another package than main. Other syntax errors are left to the
+//compiler, they are reported as compile errors
+func validateSource(source SourceFile, mainOnly bool) *APIError {
+	if !utf8.ValidString(source.Content) {
+		offset := 0
+		for offset < len(source.Content) {
+			r, size := utf8.DecodeRuneInString(source.Content[offset:])
+			if r == utf8.RuneError && size == 1 {
+				break
+			}
+			offset += size
+		}
+		return NewAPIError(CodeInvalidRequest, "%s is not valid UTF-8, invalid byte at offset %d", source.Name, offset)
+	}
+
+	if !mainOnly {
+		return nil
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), source.Name, source.Content, parser.PackageClauseOnly)
+	if err != nil {
+		return nil
+	}
+
+	if file.Name.Name != "main" {
+		return NewAPIError(CodeInvalidRequest, "%s is in package %s, programs must be in package main", source.Name, file.Name.Name)
+	}
+
+	return nil
+}
+
+//limitBody caps the size of the request bodies to max-body-kb
+func limitBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			config := currentConfig()
+			body := http.MaxBytesReader(w, r.Body, int64(config.MaxBodyKB)<<10)
+			r.Body = newDeadlineBody(w, body, config.ReadTimeout)
+		}
+
+		next(w, r)
+	}
+}
+
+//deadlineBody request body that must be read within the read timeout. The
+//deadline is armed by the first Read and lifted once the body is read: the
+//handlers queued before reading their body do not spend the timeout waiting
+//for a worker, and a server wide ReadTimeout would cancel the running jobs
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	timeout    time.Duration
+	armed      bool
+	lifted     bool
+}
+
+func (body *deadlineBody) arm() {
+	if !body.armed {
+		body.armed = true
+		body.controller.SetReadDeadline(time.Now().Add(body.timeout))
+	}
+}
+
+func (body *deadlineBody) lift() {
+	if body.armed && !body.lifted {
+		body.lifted = true
+		body.controller.SetReadDeadline(time.Time{})
+	}
+}
+
+//Read reads the body, arming the deadline on the first call and lifting it at
+//the end of the body or on error
+func (body *deadlineBody) Read(data []byte) (int, error) {
+	body.arm()
+	n, err := body.ReadCloser.Read(data)
+	if err != nil {
+		body.lift()
+	}
+
+	return n, err
+}
+
+//Close closes the body and lifts the deadline
+func (body *deadlineBody) Close() error {
+	body.lift()
+	return body.ReadCloser.Close()
+}
+
+//newDeadlineBody bounds the time taken to read body to timeout, from the first read on
+func newDeadlineBody(w http.ResponseWriter, body io.ReadCloser, timeout time.Duration) io.ReadCloser {
+	deadlined := deadlineBody{}
+	deadlined.ReadCloser = body
+	deadlined.controller = http.NewResponseController(w)
+	deadlined.timeout = timeout
+
+	return &deadlined
+}
+
+//bodyError describes a failure to read the request body
+func bodyError(err error) *APIError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return NewAPIError(CodePayloadTooLarge, "The request body exceeds the limit of %d KB", tooLarge.Limit>>10)
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return NewAPIError(CodeInvalidRequest, "The request body was not sent within %s", currentConfig().ReadTimeout)
+	}
+
+	return NewAPIError(CodeInvalidRequest, "Failed to parse body: %v", err)
+}
+
+//mediaType returns the Content-Type of the request without its parameters
+func mediaType(r *http.Request) string {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType
+}
+
+//readJSON decodes the application/json body of a request into value, the
+//body is capped by limitBody
+func readJSON(r *http.Request, value interface{}) *APIError {
+	if mediaType(r) != "application/json" {
+		return NewAPIError(CodeUnsupportedMediaType, "Content-Type must be application/json")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return bodyError(err)
+	}
+
+	err = json.Unmarshal(body, value)
+	if err != nil {
+		return NewAPIError(CodeInvalidRequest, "Invalid json structure provided: %v", err)
+	}
+
+	return nil
+}
+
+//readJSONInput reads the InputPack of an application/json request
+func readJSONInput(r *http.Request, config *Config) (*InputPack, *APIError) {
+	input := InputPack{}
+	apiErr := readJSON(r, &input)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return &input, nil
+}
+
+//readFileInput reads the program of a multipart/form-data request, the first
+//file field is the main file and the others are additional files. The
+//standard input is read from the stdin field, the arguments from the arg
+//fields and the tests are run when the test field is true
+func readFileInput(r *http.Request, config *Config) (*InputPack, *APIError) {
+	if mediaType(r) != "multipart/form-data" {
+		return nil, NewAPIError(CodeUnsupportedMediaType, "Content-Type must be multipart/form-data")
+	}
+
+	//parts larger than the memory limit are spilled to temporary files
+	err := r.ParseMultipartForm(int64(config.MultipartMemoryKB) << 10)
+	if err != nil {
+		return nil, bodyError(err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 {
+		return nil, NewAPIError(CodeInvalidRequest, "File not found, form data requires file attribute to be set")
+	}
+	if len(headers) > config.MaxFiles {
+		return nil, NewAPIError(CodePayloadTooLarge, "A program may have at most %d files, found %d", config.MaxFiles, len(headers))
+	}
+
+	input := InputPack{}
+	for i, header := range headers {
+		if header.Size > int64(config.MaxProgramKB)<<10 {
+			return nil, NewAPIError(CodePayloadTooLarge, "%s exceeds the limit of %d KB", header.Filename, config.MaxProgramKB)
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return nil, NewAPIError(CodeInternal, "Failed to read %s", header.Filename)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, NewAPIError(CodeInternal, "Failed to read %s", header.Filename)
+		}
+
+		if i == 0 {
+			input.Program = string(data)
+		} else {
+			input.Files = append(input.Files, SourceFile{Name: header.Filename, Content: string(data)})
+		}
+	}
+	input.Stdin = r.FormValue("stdin")
+	input.Args = r.MultipartForm.Value["arg"]
+	input.Test = r.FormValue("test") == "true"
+
+	return &input, nil
+}
+
+//parseProgram reads the program of the request with read and validates it
+//before the request is queued, the program is stored in the request context
+func parseProgram(read func(*http.Request, *Config) (*InputPack, *APIError)) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			config := currentConfig()
+
+			input, apiErr := read(r, config)
+			if apiErr == nil {
+				apiErr = input.Validate(config)
+			}
+			if apiErr != nil {
+				sendError(&w, apiErr.Code, apiErr.Message)
+				return
+			}
+
+			next(w, r.WithContext(context.WithValue(r.Context(), inputContext, input)))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testTests string = "package main\n\nimport \"testing\"\n\nfunc TestMain(t *testing.T) {}\n"
+
+func TestInputValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFiles = 3
+	config.MaxProgramKB = 1
+	config.MaxStdinKB = 1
+
+	util := SourceFile{Name: "util.go", Content: "package main\n"}
+	tests := SourceFile{Name: "main_test.go", Content: testTests}
+	large := strings.Repeat("x", 1<<10)
+
+	cases := []struct {
+		name  string
+		input InputPack
+		want  ErrorCode
+	}{
+		{"program", InputPack{Program: testProgram}, ""},
+		{"files", InputPack{Program: testProgram, Files: []SourceFile{util}}, ""},
+		{"tests", InputPack{Program: testProgram, Files: []SourceFile{tests}, Test: true}, ""},
+		{"external test package", InputPack{Program: testProgram, Test: true,
+			Files: []SourceFile{{Name: "main_test.go", Content: "package main_test\n"}}}, ""},
+		{"syntax error left to the compiler", InputPack{Program: "package main\n\nfunc main() {"}, ""},
+
+		{"empty", InputPack{Program: " \n"}, CodeEmptyProgram},
+		{"too many files", InputPack{Program: testProgram, Files: []SourceFile{util, {"a.go", "package main\n"}, {"b.go", "package main\n"}}}, CodePayloadTooLarge},
+		{"too large", InputPack{Program: testProgram, Files: []SourceFile{{"util.go", "package main\n//" + large}}}, CodePayloadTooLarge},
+		{"stdin too large", InputPack{Program: testProgram, Stdin: large + "x"}, CodePayloadTooLarge},
+		{"too many arguments", InputPack{Program: testProgram, Args: make([]string, MaxArgs+1)}, CodePayloadTooLarge},
+		{"argument too long", InputPack{Program: testProgram, Args: []string{strings.Repeat("a", MaxArgLength+1)}}, CodeInvalidRequest},
+		{"NUL in argument", InputPack{Program: testProgram, Args: []string{"a\x00b"}}, CodeInvalidRequest},
+		{"path in file name", InputPack{Program: testProgram, Files: []SourceFile{{"../util.go", "package main\n"}}}, CodeInvalidRequest},
+		{"not a go file", InputPack{Program: testProgram, Files: []SourceFile{{"util.txt", "package main\n"}}}, CodeInvalidRequest},
+		{"hidden file", InputPack{Program: testProgram, Files: []SourceFile{{".util.go", "package main\n"}}}, CodeInvalidRequest},
+		{"main file given twice", InputPack{Program: testProgram, Files: []SourceFile{{MainFile, testProgram}}}, CodeInvalidRequest},
+		{"file given twice", InputPack{Program: testProgram, Files: []SourceFile{util, util}}, CodeInvalidRequest},
+		{"test file without test", InputPack{Program: testProgram, Files: []SourceFile{tests}}, CodeInvalidRequest},
+		{"test without test file", InputPack{Program: testProgram, Test: true}, CodeInvalidRequest},
+		{"other package", InputPack{Program: "package lib\n"}, CodeInvalidRequest},
+		{"other package in a file", InputPack{Program: testProgram, Files: []SourceFile{{"util.go", "package lib\n"}}}, CodeInvalidRequest},
+		{"invalid UTF-8", InputPack{Program: "package main\n//\xff\n"}, CodeInvalidRequest},
+	}
+
+	for _, c := range cases {
+		err := c.input.Validate(config)
+		got := ErrorCode("")
+		if err != nil {
+			got = err.Code
+		}
+		if got != c.want {
+			t.Errorf("Validate() of %s = %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestValidateSourceOffset(t *testing.T) {
+	err := validateSource(SourceFile{Name: MainFile, Content: "package main\n//\xff"}, true)
+	if err == nil || !strings.Contains(err.Message, "offset 15") {
+		t.Errorf("validateSource() = %v, want the invalid byte at offset 15", err)
+	}
+}
+
+//sendProgram sends body to a handler reading the program with read, the
+//body capped by limitBody, and returns the status and the program handled
+func sendProgram(read func(*http.Request, *Config) (*InputPack, *APIError), contentType string, body []byte) (int, *InputPack) {
+	var handled *InputPack
+	handler := limitBody(parseProgram(read)(func(w http.ResponseWriter, r *http.Request) {
+		handled = requestInput(r.Context())
+	}))
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("POST", "/executeJson", bytes.NewReader(body))
+	request.Header.Set("Content-Type", contentType)
+	handler(recorder, request)
+
+	return recorder.Code, handled
+}
+
+func TestReadJSONInput(t *testing.T) {
+	useConfig(t, func(config *Config) {
+		config.MaxBodyKB = 1
+	})
+
+	code, input := sendProgram(readJSONInput, "application/json; charset=utf-8", []byte(`{"program":"package main\n\nfunc main() {}\n","args":["a"]}`))
+	if code != http.StatusOK || input == nil || input.Program != testProgram || len(input.Args) != 1 {
+		t.Errorf("Valid program answered %d with %+v", code, input)
+	}
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"text body", "text/plain", `{"program":"package main"}`, http.StatusUnsupportedMediaType},
+		{"invalid json", "application/json", `{"program":`, http.StatusBadRequest},
+		{"empty program", "application/json", `{"program":""}`, http.StatusBadRequest},
+		{"body too large", "application/json", `{"program":"` + strings.Repeat("x", 1<<10) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		code, input := sendProgram(readJSONInput, c.contentType, []byte(c.body))
+		if code != c.want || input != nil {
+			t.Errorf("%s answered %d, want %d without running the program", c.name, code, c.want)
+		}
+	}
+}
+
+func TestReadFileInput(t *testing.T) {
+	useConfig(t, func(config *Config) {})
+
+	form := func(files map[string]string, fields map[string]string) (string, []byte) {
+		body := bytes.Buffer{}
+		writer := multipart.NewWriter(&body)
+		for _, name := range []string{MainFile, "main_test.go"} {
+			if content, ok := files[name]; ok {
+				part, _ := writer.CreateFormFile("file", name)
+				part.Write([]byte(content))
+			}
+		}
+		for name, value := range fields {
+			writer.WriteField(name, value)
+		}
+		writer.Close()
+		return writer.FormDataContentType(), body.Bytes()
+	}
+
+	contentType, body := form(map[string]string{MainFile: testProgram, "main_test.go": testTests},
+		map[string]string{"stdin": "input", "arg": "-v", "test": "true"})
+	code, input := sendProgram(readFileInput, contentType, body)
+	if code != http.StatusOK || input == nil {
+		t.Fatalf("Valid upload answered %d", code)
+	}
+	if input.Program != testProgram || len(input.Files) != 1 || input.Files[0].Name != "main_test.go" ||
+		input.Stdin != "input" || len(input.Args) != 1 || !input.Test {
+		t.Errorf("Upload read as %+v", input)
+	}
+
+	//the test file is refused without the test field
+	contentType, body = form(map[string]string{MainFile: testProgram, "main_test.go": testTests}, nil)
+	if code, _ := sendProgram(readFileInput, contentType, body); code != http.StatusBadRequest {
+		t.Errorf("Test file without test answered %d, want 400", code)
+	}
+
+	contentType, body = form(nil, map[string]string{"stdin": "input"})
+	if code, _ := sendProgram(readFileInput, contentType, body); code != http.StatusBadRequest {
+		t.Errorf("Upload without a file answered %d, want 400", code)
+	}
+
+	if code, _ := sendProgram(readFileInput, "application/json", []byte(`{}`)); code != http.StatusUnsupportedMediaType {
+		t.Errorf("JSON body answered %d, want 415", code)
+	}
+}
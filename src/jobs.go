@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+//ErrShuttingDown returned when a process is started after KillAll
+var ErrShuttingDown = errors.New("Server is shutting down")
+
+//JobRegistry keeps track of the running processes, containers and workspaces
+//so that they can be cleaned up when the server stops
+type JobRegistry struct {
+	lock *sync.Mutex
+
+	//processes maps every running command to its container name, if any
+	processes  map[*exec.Cmd]string
+	workspaces map[string]bool
+
+	//killed set once KillAll was called, new processes are refused
+	killed bool
+}
+
+//track registers a command, it must have been started with Setpgid
+func (registry *JobRegistry) track(cmd *exec.Cmd, container string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if registry.killed {
+		killProcess(cmd, container)
+		return ErrShuttingDown
+	}
+
+	registry.processes[cmd] = container
+	return nil
+}
+
+func (registry *JobRegistry) untrack(cmd *exec.Cmd) {
+	registry.lock.Lock()
+	delete(registry.processes, cmd)
+	registry.lock.Unlock()
+}
+
+func (registry *JobRegistry) addWorkspace(dir string) {
+	registry.lock.Lock()
+	registry.workspaces[dir] = true
+	registry.lock.Unlock()
+}
+
+func (registry *JobRegistry) removeWorkspace(dir string) {
+	registry.lock.Lock()
+	delete(registry.workspaces, dir)
+	registry.lock.Unlock()
+
+	os.RemoveAll(dir)
+}
+
+func (registry *JobRegistry) isKilled() bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	return registry.killed
+}
+
+//WorkspaceUsage number of workspaces and the disk space they use, in bytes
+func (registry *JobRegistry) WorkspaceUsage() (int, int64) {
+	registry.lock.Lock()
+	dirs := make([]string, 0, len(registry.workspaces))
+	for dir := range registry.workspaces {
+		dirs = append(dirs, dir)
+	}
+	registry.lock.Unlock()
+
+	var size int64
+	for _, dir := range dirs {
+		//workspaces may be removed while walking them
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+	}
+
+	return len(dirs), size
+}
+
+//KillAll terminates every running process and container, processes
+//started afterwards are killed right away
+func (registry *JobRegistry) KillAll() {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.killed = true
+	for cmd, container := range registry.processes {
+		killProcess(cmd, container)
+	}
+}
+
+//CleanUp removes the workspaces left behind by killed jobs
+func (registry *JobRegistry) CleanUp() {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for dir := range registry.workspaces {
+		os.RemoveAll(dir)
+		delete(registry.workspaces, dir)
+	}
+}
+
+//killProcess kills the process group of cmd and removes its container
+func killProcess(cmd *exec.Cmd, container string) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	if container != "" {
+		err := exec.Command("docker", "rm", "-f", container).Run()
+		if err != nil {
+			slog.Warn("Failed to remove a container", "container", container, "error", err)
+		}
+	}
+}
+
+//NewJobRegistry creates an empty job registry
+func NewJobRegistry() *JobRegistry {
+	registry := JobRegistry{}
+	registry.lock = &sync.Mutex{}
+	registry.processes = make(map[*exec.Cmd]string)
+	registry.workspaces = make(map[string]bool)
+
+	return &registry
+}
+
+//runningJobs registry of the processes started by GoRunner
+var runningJobs = NewJobRegistry()
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+//RequestIDHeader header carrying the ID of a request, accepted from the client and always answered
+const RequestIDHeader string = "X-Request-ID"
+
+//MaxRequestIDLength longest request ID accepted from a client
+const MaxRequestIDLength int = 64
+
+//serverLogLevel level of the default logger, follows the log-level setting
+var serverLogLevel = &slog.LevelVar{}
+
+//setupLogging makes a logger writing to output in the log-format of config the default one
+func setupLogging(config *Config, output io.Writer) {
+	serverLogLevel.Set(config.logLevel)
+
+	options := &slog.HandlerOptions{Level: serverLogLevel}
+	if config.LogFormat == "text" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(output, options)))
+		return
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(output, options)))
+}
+
+//fatal logs the error and exits
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+//requestIDContext request context value holding the request ID
+const requestIDContext contextKey = "requestID"
+
+//requestID returns the ID of the request, empty outside of a request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContext).(string)
+	return id
+}
+
+//requestLogger returns the default logger, annotated with the ID of the request
+func requestLogger(ctx context.Context) *slog.Logger {
+	id := requestID(ctx)
+	if id == "" {
+		return slog.Default()
+	}
+
+	return slog.Default().With("requestId", id)
+}
+
+//validRequestID accepts IDs made of letters, digits, '-', '_' and '.', they end up in container names
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.'
+		if !valid {
+			return false
+		}
+	}
+
+	return true
+}
+
+//logRequests assigns every request an ID, taken from the X-Request-ID header
+//when valid, and logs the answered requests at debug level
+func logRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id, _ = randomHex(8)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContext, id))
+		next(recorder, r)
+
+		requestLogger(r.Context()).Debug("Request answered",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", r.Pattern,
+			"status", recorder.Status(),
+			"duration", time.Since(start).Seconds(),
+			"remote", r.RemoteAddr,
+		)
+	}
+}
+
+//JobSummary Represents what a job did, the worker logs it once the job is done
+type JobSummary struct {
+	Worker int
+	Queued time.Duration
+
+	//set by ExecuteTask for the jobs running a program
+	Executor       string
+	Outcome        string
+	Cached         bool
+	CompileSeconds float64
+	RunSeconds     float64
+	CPUSeconds     float64
+}
+
+//jobSummaryContext job context value holding the *JobSummary
+const jobSummaryContext contextKey = "jobSummary"
+
+//jobSummary returns the summary of the job, nil outside of a worker
+func jobSummary(ctx context.Context) *JobSummary {
+	summary, _ := ctx.Value(jobSummaryContext).(*JobSummary)
+	return summary
+}
+
+//logJob logs the summary line of a job answered with status after duration
+func logJob(work WorkType, summary *JobSummary, status int, duration time.Duration) {
+	attrs := []any{
+		"route", work.reader.Pattern,
+		"status", status,
+		"worker", summary.Worker,
+		"queued", summary.Queued.Seconds(),
+		"duration", duration.Seconds(),
+	}
+	if summary.Executor != "" {
+		attrs = append(attrs,
+			"executor", summary.Executor,
+			"outcome", summary.Outcome,
+			"cached", summary.Cached,
+			"compile", summary.CompileSeconds,
+			"run", summary.RunSeconds,
+		)
+	}
+
+	slog.Default().With("requestId", work.requestID).Info("Job done", attrs...)
+}
@@ -1,163 +1,613 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"go/format"
+	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func sendError(w *http.ResponseWriter, message string) {
-	data, _ := json.Marshal(MakeError(message))
-	(*w).WriteHeader(http.StatusInternalServerError)
+//sendError answers with an error, the status is the one of the code
+func sendError(w *http.ResponseWriter, code ErrorCode, message string) {
+	data, _ := json.Marshal(MakeError(code, message))
 	(*w).Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(*w, string(data))
+	(*w).WriteHeader(code.Status())
+	fmt.Fprint(*w, string(data))
 }
 
-func sendInvalidMethod(w *http.ResponseWriter, message string) {
-	data, _ := json.Marshal(MakeError(message))
-	(*w).WriteHeader(http.StatusMethodNotAllowed)
-	(*w).Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(*w, string(data))
+//sendOutputError answers with the error of a failed execution
+func sendOutputError(w *http.ResponseWriter, output *OutputPack) {
+	sendError(w, output.ErrorCode, output.ErrorString)
 }
 
-func executeJSON(w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
-	contentType := r.Header.Get("Content-Type")
+//executeProgram runs the program parsed by parseProgram
+func executeProgram(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	//execute the program
+	programOutput := ExecuteTask(ctx, requestInput(ctx))
+	if programOutput.Error {
+		sendOutputError(w, programOutput)
+		channel <- true
+		return
+	}
 
-	spl := strings.Split(contentType, ";")
-	if len(spl) > 0 {
-		contentType = spl[0]
+	//success message
+	bytes, err := json.Marshal(&programOutput)
+	if err != nil {
+		sendError(w, CodeInternal, "Failed to serialize program output")
+		channel <- true
+		return
 	}
 
-	if r.Method != "POST" {
-		sendInvalidMethod(w, fmt.Sprintf("Method %s not allowed", r.Method))
+	//send output
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusOK)
+	fmt.Fprint(*w, string(bytes))
+
+	channel <- true
+}
+
+//analyzeJSON parses an AnalysisInput and fills the output using the given analysis step
+func analyzeJSON(w *http.ResponseWriter, r *http.Request, channel chan<- bool, step func(*Analysis, *AnalysisInput, *AnalysisOutput)) {
+	input := AnalysisInput{}
+	apiErr := readJSON(r, &input)
+	if apiErr != nil {
+		sendError(w, apiErr.Code, apiErr.Message)
 		channel <- true
 		return
 	}
 
-	if contentType != "application/json" {
-		sendError(w, "Content-Type must be application/json")
+	if input.Offset < 0 || input.Offset > len(input.Program) {
+		sendError(w, CodeInvalidRequest, "Offset must be within the program")
 		channel <- true
 		return
 	}
 
-	//execute the code
-	input := InputPack{}
-	body, err := ioutil.ReadAll(r.Body)
+	//analyse the program
+	analysis := NewAnalysis(input.Program)
+	output := AnalysisOutput{}
+	output.Diagnostics = analysis.Diagnostics()
+	step(analysis, &input, &output)
+
+	bytes, err := json.Marshal(&output)
 	if err != nil {
-		sendError(w, "Failed to parse body")
+		sendError(w, CodeInternal, "Failed to serialize analysis output")
 		channel <- true
 		return
 	}
 
-	err = json.Unmarshal(body, &input)
+	//send output
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusOK)
+	fmt.Fprint(*w, string(bytes))
+
+	channel <- true
+}
+
+func typeCheck(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	analyzeJSON(w, r, channel, func(analysis *Analysis, input *AnalysisInput, output *AnalysisOutput) {})
+}
+
+func hover(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	analyzeJSON(w, r, channel, func(analysis *Analysis, input *AnalysisInput, output *AnalysisOutput) {
+		output.Hover = analysis.Hover(input.Offset)
+	})
+}
+
+func complete(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	analyzeJSON(w, r, channel, func(analysis *Analysis, input *AnalysisInput, output *AnalysisOutput) {
+		output.Completions = analysis.Complete(input.Offset)
+	})
+}
+
+//formatProgram formats the program like gofmt, programs with syntax errors are answered with an error
+func formatProgram(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	analyzeJSON(w, r, channel, func(analysis *Analysis, input *AnalysisInput, output *AnalysisOutput) {
+		formatted, err := format.Source([]byte(input.Program))
+		if err != nil {
+			output.Error = true
+			output.ErrorString = err.Error()
+			return
+		}
+		output.Formatted = string(formatted)
+	})
+}
+
+func sendSnippet(w *http.ResponseWriter, snippet *Snippet) {
+	output := SnippetOutput{}
+	output.URL = "/p/" + snippet.ID
+	output.Snippet = snippet
+
+	bytes, err := json.Marshal(&output)
 	if err != nil {
-		sendError(w, "Invalid json structure provided")
-		channel <- true
+		sendError(w, CodeInternal, "Failed to serialize snippet")
 		return
 	}
 
-	//execute the program
-	programOutput := ExecuteTask(&input)
-	if programOutput.Error {
-		sendError(w, programOutput.ErrorString)
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusOK)
+	fmt.Fprint(*w, string(bytes))
+}
+
+func shareSnippet(store SnippetStore) HandlerFunction {
+	return func(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+		input := InputPack{}
+		apiErr := readJSON(r, &input)
+		if apiErr != nil {
+			sendError(w, apiErr.Code, apiErr.Message)
+			channel <- true
+			return
+		}
+
+		snippet, err := store.Put(input.Program)
+		if err == ErrSnippetEmpty {
+			sendError(w, CodeEmptyProgram, err.Error())
+			channel <- true
+			return
+		}
+		if err == ErrSnippetTooLarge {
+			sendError(w, CodePayloadTooLarge, err.Error())
+			channel <- true
+			return
+		}
+		if err == ErrSnippetCollision {
+			sendError(w, CodeInternal, err.Error())
+			channel <- true
+			return
+		}
+		if err != nil {
+			sendError(w, CodeInternal, "Failed to store snippet")
+			channel <- true
+			return
+		}
+
+		sendSnippet(w, snippet)
 		channel <- true
-		return
 	}
+}
 
-	//success message
-	bytes, err := json.Marshal(&programOutput)
+func getSnippet(store SnippetStore) HandlerFunction {
+	return func(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+		id := r.PathValue("id")
+
+		snippet, err := store.Get(id)
+		if err == ErrSnippetNotFound {
+			sendError(w, CodeNotFound, err.Error())
+			channel <- true
+			return
+		}
+		if err != nil {
+			sendError(w, CodeInternal, "Failed to read snippet")
+			channel <- true
+			return
+		}
+
+		sendSnippet(w, snippet)
+		channel <- true
+	}
+}
+
+func cacheStats(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	bytes, err := json.Marshal(buildCache.Stats())
 	if err != nil {
-		sendError(w, "Failed to serialize program output")
+		sendError(w, CodeInternal, "Failed to serialize cache statistics")
 		channel <- true
 		return
 	}
 
-	//send output
 	(*w).Header().Set("Content-Type", "application/json")
 	(*w).WriteHeader(http.StatusOK)
-	fmt.Fprintf(*w, string(bytes))
+	fmt.Fprint(*w, string(bytes))
 
 	channel <- true
-	return
 }
 
-func executeFile(w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
-	contentType := r.Header.Get("Content-Type")
+func poolStatus(pool *RoutesHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.Marshal(pool.Status())
+		if err != nil {
+			sendError(&w, CodeInternal, "Failed to serialize pool status")
+			return
+		}
 
-	spl := strings.Split(contentType, ";")
-	if len(spl) > 0 {
-		contentType = spl[0]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, string(bytes))
 	}
+}
 
-	if r.Method != "POST" {
-		sendInvalidMethod(w, fmt.Sprintf("Method %s not allowed", r.Method))
-		channel <- true
+//CreateKeyInput Represents a request to create an API key
+type CreateKeyInput struct {
+	Name   string    `json:"name"`
+	Policy KeyPolicy `json:"policy"`
+
+	//Certificate common name of the client certificates authenticated as the key
+	Certificate string `json:"certificate,omitempty"`
+}
+
+func sendJSON(w http.ResponseWriter, status int, value interface{}) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		sendError(&w, CodeInternal, "Failed to serialize response")
 		return
 	}
 
-	if contentType != "multipart/form-data" {
-		sendError(w, "Content-Type must be multipart/form-data")
-		channel <- true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(bytes))
+}
+
+//listKeys lists the API keys
+func listKeys(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, keyStore.List())
+}
+
+//createKey creates an API key, its secret is part of the answer
+func createKey(w http.ResponseWriter, r *http.Request) {
+	input := CreateKeyInput{}
+	apiErr := readJSON(r, &input)
+	if apiErr != nil {
+		sendError(&w, apiErr.Code, apiErr.Message)
 		return
 	}
 
-	//execute the code
-	file, _, err := r.FormFile("file")
+	if strings.TrimSpace(input.Name) == "" {
+		sendError(&w, CodeInvalidRequest, "A key needs a name")
+		return
+	}
+
+	key, err := keyStore.Create(input.Name, input.Policy, input.Certificate)
 	if err != nil {
-		sendError(w, "File not found, form data requires file attribute to be set")
-		channel <- true
+		sendError(&w, CodeInvalidRequest, err.Error())
 		return
 	}
 
-	defer file.Close()
+	sendJSON(w, http.StatusCreated, key)
+}
 
-	var buffer bytes.Buffer
-	io.Copy(&buffer, file)
+//revokeKey revokes the key of DELETE /admin/keys/{id}
+func revokeKey(w http.ResponseWriter, r *http.Request) {
+	err := keyStore.Revoke(r.PathValue("id"))
+	if err == ErrKeyNotFound {
+		sendError(&w, CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		sendError(&w, CodeInternal, err.Error())
+		return
+	}
 
-	program := buffer.String()
-	input := InputPack{}
-	input.Program = program
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	//execute the program
-	programOutput := ExecuteTask(&input)
-	if programOutput.Error {
-		sendError(w, programOutput.ErrorString)
-		channel <- true
+//queryAudit answers the audit records matching the user, since, until,
+//outcome and limit query parameters, newest first
+func queryAudit(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		sendError(&w, CodeNotFound, "The audit log is disabled")
 		return
 	}
 
-	//success message
-	bytes, err := json.Marshal(&programOutput)
+	params := r.URL.Query()
+	query := AuditQuery{}
+	query.User = params.Get("user")
+	query.Outcome = params.Get("outcome")
+	query.Limit = AuditQueryLimit
+
+	for name, bound := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if params.Get(name) == "" {
+			continue
+		}
+
+		value, err := time.Parse(time.RFC3339, params.Get(name))
+		if err != nil {
+			sendError(&w, CodeInvalidRequest, fmt.Sprintf("%s must be an RFC 3339 time like 2006-01-02T15:04:05Z", name))
+			return
+		}
+		*bound = value
+	}
+
+	if params.Get("limit") != "" {
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit < 1 || limit > AuditQueryMaxLimit {
+			sendError(&w, CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", AuditQueryMaxLimit))
+			return
+		}
+		query.Limit = limit
+	}
+
+	records, err := auditLog.Query(query)
 	if err != nil {
-		sendError(w, "Failed to serialize program output")
-		channel <- true
+		sendError(&w, CodeInternal, "Failed to read the audit log")
 		return
 	}
 
-	//send output
-	(*w).Header().Set("Content-Type", "application/json")
-	(*w).WriteHeader(http.StatusOK)
-	fmt.Fprintf(*w, string(bytes))
+	sendJSON(w, http.StatusOK, records)
+}
 
-	buffer.Reset()
+//reloadConfig applies the settings that can change without a restart, the
+//configuration is left untouched when the new one is invalid
+func reloadConfig(loader *ConfigLoader, router *RoutesHandler) {
+	next, err := loader.Load()
+	if err != nil {
+		slog.Error("Keeping the current configuration", "error", err)
+		return
+	}
 
-	channel <- true
-	return
+	config, kept := currentConfig().Reloaded(next)
+	if len(kept) > 0 {
+		slog.Warn("Changes need a restart, ignored", "settings", strings.Join(kept, ", "))
+	}
+
+	serverConfig.Store(config)
+	serverLogLevel.Set(config.logLevel)
+	router.Reconfigure(config.PoolConfig())
+	slog.Info("Configuration reloaded", "config", config.values())
+
+	if keyStore != nil {
+		err = keyStore.Reload()
+		if err != nil {
+			slog.Error("Keeping the current API keys", "error", err)
+		}
+	}
+}
+
+//registerRoutes registers the routes of the server along with the operations
+//documenting them, the returned document is generated from the routes
+func registerRoutes(router *RoutesHandler, config *Config, snippetStore SnippetStore) *OpenAPIDocument {
+	//every route but the probes and the metrics needs an API key when authentication is enabled
+	protected := []Middleware{authenticate, limitRequests}
+
+	//the admin routes answer 403 unless authenticated with an admin key, even while authentication is disabled
+	admin := []Middleware{authenticate, requireAdmin, limitRequests}
+
+	//programs are validated before they are queued
+	router.Queue("POST", "/executeJson", Operation{ID: "executeJson", Tag: "Run",
+		Summary: "Run a program", Request: InputPack{}, Response: OutputPack{}},
+		executeProgram, authenticate, limitRequests, parseProgram(readJSONInput))
+	router.Queue("POST", "/executeFile", Operation{ID: "executeFile", Tag: "Run",
+		Summary: "Run uploaded source files", Request: multipartProgram, RequestType: "multipart/form-data", Response: OutputPack{}},
+		executeProgram, authenticate, limitRequests, parseProgram(readFileInput))
+	router.Queue("POST", "/executeStream", Operation{ID: "executeStream", Tag: "Run",
+		Summary: "Run a program, streaming its output as server-sent events: output events hold a StreamOutput, the final result event an OutputPack",
+		Request: InputPack{}, Response: jsonSchema{"type": "string"}, ResponseType: "text/event-stream"},
+		streamProgram, authenticate, limitRequests, parseProgram(readJSONInput))
+	router.Queue("POST", "/format", Operation{ID: "format", Tag: "Analysis",
+		Summary: "Format a program like gofmt", Request: AnalysisInput{}, Response: AnalysisOutput{}},
+		formatProgram, protected...)
+	router.Queue("POST", "/typecheck", Operation{ID: "typecheck", Tag: "Analysis",
+		Summary: "Report the syntax and type errors of a program", Request: AnalysisInput{}, Response: AnalysisOutput{}},
+		typeCheck, protected...)
+	router.Queue("POST", "/hover", Operation{ID: "hover", Tag: "Analysis",
+		Summary: "Describe the identifier at offset", Request: AnalysisInput{}, Response: AnalysisOutput{}},
+		hover, protected...)
+	router.Queue("POST", "/complete", Operation{ID: "complete", Tag: "Analysis",
+		Summary: "List the completions at offset", Request: AnalysisInput{}, Response: AnalysisOutput{}},
+		complete, protected...)
+	router.Queue("POST", "/share", Operation{ID: "share", Tag: "Share",
+		Summary: "Share a program", Request: InputPack{}, Response: SnippetOutput{}},
+		shareSnippet(snippetStore), protected...)
+	router.Queue("GET", "/p/{id}", Operation{ID: "getSnippet", Tag: "Share",
+		Summary: "Fetch a shared program", Response: SnippetOutput{}},
+		getSnippet(snippetStore), protected...)
+	router.Queue("GET", "/admin/cache", Operation{ID: "cacheStats", Tag: "Admin",
+		Summary: "Build cache statistics", Response: BuildCacheStats{}},
+		cacheStats, admin...)
+
+	//answered directly, the status must be readable while the queue is saturated
+	router.Handle("GET", "/admin/pool", Operation{ID: "poolStatus", Tag: "Admin",
+		Summary: "Worker pool state", Response: PoolStatus{}},
+		poolStatus(router), admin...)
+	router.Handle("GET", "/admin/keys", Operation{ID: "listKeys", Tag: "Admin",
+		Summary: "List the API keys", Response: []APIKeyInfo{}},
+		listKeys, admin...)
+	router.Handle("POST", "/admin/keys", Operation{ID: "createKey", Tag: "Admin",
+		Summary: "Create an API key, its secret is only answered once", Request: CreateKeyInput{}, Response: NewAPIKey{}, Status: http.StatusCreated},
+		createKey, admin...)
+	router.Handle("DELETE", "/admin/keys/{id}", Operation{ID: "revokeKey", Tag: "Admin",
+		Summary: "Revoke an API key", Status: http.StatusNoContent},
+		revokeKey, admin...)
+	router.Handle("GET", "/admin/audit", Operation{ID: "queryAudit", Tag: "Admin",
+		Summary: "Query the audit log, newest records first", Response: []AuditRecord{},
+		Parameters: []QueryParameter{
+			{Name: "user", Description: "Key ID, key name or client as recorded", Schema: jsonSchema{"type": "string"}},
+			{Name: "since", Description: "Oldest time, included", Schema: jsonSchema{"type": "string", "format": "date-time"}},
+			{Name: "until", Description: "Newest time, excluded", Schema: jsonSchema{"type": "string", "format": "date-time"}},
+			{Name: "outcome", Description: "Outcome or error code", Schema: jsonSchema{"type": "string"}},
+			{Name: "limit", Description: "Records answered", Schema: jsonSchema{"type": "integer", "minimum": 1, "maximum": AuditQueryMaxLimit, "default": AuditQueryLimit}},
+		}},
+		queryAudit, admin...)
+	router.Handle("GET", "/metrics", Operation{ID: "metrics", Tag: "Monitoring",
+		Summary: "Metrics in the Prometheus text format", Response: jsonSchema{"type": "string"}, ResponseType: "text/plain"},
+		serverMetrics.ServeHTTP)
+
+	healthChecker := NewHealthChecker(router.workPool)
+	router.Handle("GET", "/healthz", Operation{ID: "liveness", Tag: "Monitoring",
+		Summary: "Answers while the process is alive", Response: struct {
+			Status string `json:"status"`
+		}{}},
+		healthChecker.ServeLiveness)
+	router.Handle("GET", "/readyz", Operation{ID: "readiness", Tag: "Monitoring",
+		Summary: "Answers 503 when a dependency fails or the pool is saturated", Response: Readiness{}, ExtraStatuses: []int{http.StatusServiceUnavailable}},
+		healthChecker.ServeReadiness)
+
+	//the playground calls the API with the key entered by the user
+	if config.Playground {
+		router.Handle("GET", "/", Operation{ID: "playground", Tag: "Playground",
+			Summary: "Page of the web playground", Response: jsonSchema{"type": "string"}, ResponseType: "text/html"},
+			playgroundPage)
+		router.Handle("GET", "/playground/{file...}", Operation{ID: "playgroundAsset", Tag: "Playground",
+			Summary: "Scripts and styles of the web playground", Response: jsonSchema{"type": "string"}, ResponseType: "*/*"},
+			playgroundAsset)
+	}
+
+	apiDocument := &OpenAPIDocument{}
+	router.Handle("GET", "/openapi.json", Operation{ID: "openapi", Tag: "Documentation",
+		Summary: "This document", Response: jsonSchema{"type": "object"}},
+		apiDocument.ServeHTTP)
+
+	return apiDocument
 }
 
 func main() {
+	loader, err := NewConfigLoader(os.Args[0], os.Args[1:], os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	pool := NewRouteHandler(100, 100)
-	pool.RegisterRoute("/executeJson", executeJSON)
-	pool.RegisterRoute("/executeFile", executeFile)
+	config, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		pool.Dispatch(w, r)
-	})
+	if loader.PrintConfig {
+		fmt.Println(config)
+		return
+	}
+
+	setupLogging(config, os.Stderr)
+
+	if config.APIKeys != "" {
+		keyStore, err = NewKeyStore(config.APIKeys)
+		if err != nil {
+			fatal("Failed to load the API keys", err)
+		}
+	}
+
+	if loader.CreateAdminKey != "" {
+		if keyStore == nil {
+			fatal("Failed to create an admin key", errors.New("api-keys is not set"))
+		}
+
+		key, err := keyStore.Create(loader.CreateAdminKey, KeyPolicy{Admin: true, AllowUnsandboxed: true}, "")
+		if err != nil {
+			fatal("Failed to create an admin key", err)
+		}
+		fmt.Println(key.Key)
+		return
+	}
 
-	http.ListenAndServe(":9000", nil)
+	if keyStore == nil {
+		slog.Warn("API key authentication is disabled, anyone reaching the server can run programs")
+	}
+
+	//quota-file keeps the daily usage across restarts
+	quotaStore, err = NewQuotaStore(config.QuotaFile)
+	if err != nil {
+		fatal("Failed to load the quotas", err)
+	}
+	go saveQuotas(quotaStore, 30*time.Second)
+	go purgeRateLimits(rateLimiter, time.Minute)
+
+	//audit-dir enables the audit log of the executions
+	if config.AuditDir != "" {
+		auditLog, err = NewAuditLog(config.AuditDir, int64(config.AuditMaxSizeMB)<<20)
+		if err != nil {
+			fatal("Failed to open the audit log", err)
+		}
+		go purgeAudit(auditLog, time.Hour)
+	}
+
+	serverConfig.Store(config)
+	slog.Info("Effective configuration", "config", config.values())
+
+	snippetStore, err := NewFileSnippetStore(config.SnippetDir, config.SnippetLimits())
+	if err != nil {
+		fatal("Failed to open the snippet store", err)
+	}
+	go purgeSnippets(snippetStore, time.Hour)
+
+	//result-cache-dir enables the on-disk tier of the result cache
+	resultCache, err = NewResultCache(ResultCacheEntries, config.ResultCacheDir, int64(config.ResultCacheMaxSizeMB)<<20, config.ResultCacheTTL)
+	if err != nil {
+		fatal("Failed to open the result cache", err)
+	}
+	go evictResultCache(resultCache, 10*time.Minute)
+
+	buildCache, err = NewBuildCache(config.BuildCacheDir, int64(config.BuildCacheMaxSizeMB)<<20)
+	if err != nil {
+		fatal("Failed to open the build cache", err)
+	}
+	go evictBuildCache(buildCache, 10*time.Minute)
+
+	//modules-config lists the third-party modules programs may require
+	if config.ModulesConfig != "" {
+		moduleConfig, err = LoadModuleConfig(config.ModulesConfig)
+		if err != nil {
+			fatal("Failed to load the modules config", err)
+		}
+	}
+
+	//a single client may hold queue-per-client of the queued jobs
+	router := NewRouteHandler(config.PoolConfig(), NewFairShareBackend[WorkType](config.QueueSize, config.QueuePerClient))
+	//panics are answered before being counted, as internal errors, and logged with the request ID.
+	//Errors are answered with the CORS headers, browsers hide them from the editors otherwise
+	router.Use(logRequests, instrument, recoverPanics, allowCORS, limitBody)
+
+	apiDocument := registerRoutes(router, config, snippetStore)
+	serverMetrics.WatchPool(router.workPool)
+
+	//the document describes every route, gopg refuses to start with an undocumented one
+	err = apiDocument.Generate(router.Routes())
+	if err != nil {
+		fatal("Failed to generate the OpenAPI document", err)
+	}
+
+	//tls-cert and tls-key enable HTTPS, the files are reloaded when they change
+	var reloader *CertificateReloader
+	if config.TLSCert != "" {
+		reloader, err = NewCertificateReloader(config)
+		if err != nil {
+			fatal("Failed to load the TLS certificate", err)
+		}
+		go watchCertificate(reloader, 30*time.Second)
+	}
+
+	server := newServer(config, router)
+	go serve(server, reloader)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		reloadConfig(loader, router)
+		sig = <-signals
+	}
+	slog.Info("Shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	//stop accepting requests, in-flight requests wait for their jobs
+	err = server.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Requests still open after the shutdown deadline", "error", err)
+	}
+
+	err = router.Shutdown(ctx)
+	if err != nil {
+		slog.Warn("Jobs still running after the shutdown deadline", "error", err)
+	}
+
+	runningJobs.CleanUp()
+
+	err = quotaStore.Save()
+	if err != nil {
+		slog.Error("Failed to save the quotas", "error", err)
+	}
+
+	if auditLog != nil {
+		auditLog.Close()
+	}
+	slog.Info("Shutdown complete")
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//DurationBuckets histogram buckets, in seconds, suited to compile and run durations
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60}
+
+//Program outcomes counted by gopg_program_outcomes_total
+const (
+	OutcomeSuccess       string = "success"
+	OutcomeCompileError  string = "compile_error"
+	OutcomeRuntimeError  string = "runtime_error"
+	OutcomeTimeout       string = "timeout"
+	OutcomeOOM           string = "oom"
+	OutcomeCancelled     string = "cancelled"
+	OutcomeInternalError string = "internal_error"
+)
+
+//Metric a metric family written in the Prometheus text exposition format
+type Metric interface {
+	Write(w io.Writer)
+}
+
+//metricFamily name, help and type shared by every metric kind
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (family *metricFamily) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", family.name, family.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", family.name, family.kind)
+}
+
+//writeSample writes a single sample, values are given in the order of the family labels
+func (family *metricFamily) writeSample(w io.Writer, suffix string, labelValues []string, extra string, value float64) {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for idx, labelValue := range labelValues {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", family.labels[idx], escapeLabelValue(labelValue)))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	fmt.Fprintf(w, "%s%s%s %s\n", family.name, suffix, labels, formatMetricValue(value))
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+//labelKey joins label values into a map key, \xff never appears in valid UTF-8
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+//CounterVec counter partitioned by label values
+type CounterVec struct {
+	metricFamily
+
+	lock   *sync.Mutex
+	values map[string]float64
+}
+
+//Inc increments the counter of the given label values
+func (counter *CounterVec) Inc(labelValues ...string) {
+	if len(labelValues) != len(counter.labels) {
+		panic(fmt.Sprintf("%s expects %d label values, got %d", counter.name, len(counter.labels), len(labelValues)))
+	}
+
+	counter.lock.Lock()
+	counter.values[labelKey(labelValues)]++
+	counter.lock.Unlock()
+}
+
+//Write writes the counters sorted by label values
+func (counter *CounterVec) Write(w io.Writer) {
+	counter.lock.Lock()
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	values := make(map[string]float64, len(counter.values))
+	for key, value := range counter.values {
+		values[key] = value
+	}
+	counter.lock.Unlock()
+
+	sort.Strings(keys)
+
+	counter.writeHeader(w)
+	for _, key := range keys {
+		counter.writeSample(w, "", strings.Split(key, "\xff"), "", values[key])
+	}
+}
+
+//NewCounterVec creates a counter partitioned by the given labels
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := CounterVec{}
+	counter.metricFamily = metricFamily{name: name, help: help, kind: "counter", labels: labels}
+	counter.lock = &sync.Mutex{}
+	counter.values = make(map[string]float64)
+
+	return &counter
+}
+
+//GaugeSample value of a gauge for the given label values
+type GaugeSample struct {
+	LabelValues []string
+	Value       float64
+}
+
+//GaugeFunc gauge whose samples are collected when the metrics are written
+type GaugeFunc struct {
+	metricFamily
+
+	collect func() []GaugeSample
+}
+
+//Write collects and writes the samples
+func (gauge *GaugeFunc) Write(w io.Writer) {
+	gauge.writeHeader(w)
+	for _, sample := range gauge.collect() {
+		gauge.writeSample(w, "", sample.LabelValues, "", sample.Value)
+	}
+}
+
+//NewGaugeFunc creates a gauge collected by collect, samples carry a value for each label
+func NewGaugeFunc(name string, help string, collect func() []GaugeSample, labels ...string) *GaugeFunc {
+	gauge := GaugeFunc{}
+	gauge.metricFamily = metricFamily{name: name, help: help, kind: "gauge", labels: labels}
+	gauge.collect = collect
+
+	return &gauge
+}
+
+//Histogram counts observations in cumulative buckets
+type Histogram struct {
+	metricFamily
+
+	lock    *sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+//Observe adds an observation to the histogram
+func (histogram *Histogram) Observe(value float64) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	for idx, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[idx]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+//Write writes the buckets, the sum and the count of observations
+func (histogram *Histogram) Write(w io.Writer) {
+	histogram.lock.Lock()
+	counts := append([]uint64{}, histogram.counts...)
+	sum := histogram.sum
+	count := histogram.count
+	histogram.lock.Unlock()
+
+	histogram.writeHeader(w)
+	for idx, bound := range histogram.buckets {
+		histogram.writeSample(w, "_bucket", nil, "le=\""+formatMetricValue(bound)+"\"", float64(counts[idx]))
+	}
+	histogram.writeSample(w, "_bucket", nil, "le=\"+Inf\"", float64(count))
+	histogram.writeSample(w, "_sum", nil, "", sum)
+	histogram.writeSample(w, "_count", nil, "", float64(count))
+}
+
+//NewHistogram creates a histogram with the given upper bounds, sorted in increasing order
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := Histogram{}
+	histogram.metricFamily = metricFamily{name: name, help: help, kind: "histogram"}
+	histogram.lock = &sync.Mutex{}
+	histogram.buckets = buckets
+	histogram.counts = make([]uint64, len(buckets))
+
+	return &histogram
+}
+
+//MetricsRegistry metrics exposed by the /metrics endpoint, in registration order
+type MetricsRegistry struct {
+	lock    *sync.Mutex
+	metrics []Metric
+}
+
+//Register adds a metric to the registry
+func (registry *MetricsRegistry) Register(metric Metric) {
+	registry.lock.Lock()
+	registry.metrics = append(registry.metrics, metric)
+	registry.lock.Unlock()
+}
+
+//Write writes every registered metric
+func (registry *MetricsRegistry) Write(w io.Writer) {
+	registry.lock.Lock()
+	metrics := append([]Metric{}, registry.metrics...)
+	registry.lock.Unlock()
+
+	for _, metric := range metrics {
+		metric.Write(w)
+	}
+}
+
+//NewMetricsRegistry creates an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	registry := MetricsRegistry{}
+	registry.lock = &sync.Mutex{}
+	registry.metrics = make([]Metric, 0)
+
+	return &registry
+}
+
+//ServerMetrics metrics recorded by the server
+type ServerMetrics struct {
+	registry *MetricsRegistry
+
+	requests        *CounterVec
+	outcomes        *CounterVec
+	compileDuration *Histogram
+	runDuration     *Histogram
+	containerStart  *Histogram
+}
+
+//ObserveRequest counts a request answered by route with status
+func (serverMetrics *ServerMetrics) ObserveRequest(route string, status int) {
+	serverMetrics.requests.Inc(route, strconv.Itoa(status))
+}
+
+//WatchPool exposes the queue and the workers of the pool
+func (serverMetrics *ServerMetrics) WatchPool(pool *WorkerPool) {
+	serverMetrics.registry.Register(NewGaugeFunc("gopg_queue_length", "Number of jobs waiting in the work-queue.",
+		func() []GaugeSample {
+			return []GaugeSample{{Value: float64(pool.queue.Len())}}
+		}))
+
+	serverMetrics.registry.Register(NewGaugeFunc("gopg_queue_capacity", "Maximum number of jobs in the work-queue.",
+		func() []GaugeSample {
+			return []GaugeSample{{Value: float64(pool.queue.Cap())}}
+		}))
+
+	serverMetrics.registry.Register(NewGaugeFunc("gopg_workers", "Number of workers by state.",
+		func() []GaugeSample {
+			pool.statsLock.Lock()
+			busy := pool.busyWorkers
+			idle := pool.nWorkers - pool.busyWorkers
+			pool.statsLock.Unlock()
+
+			return []GaugeSample{
+				{LabelValues: []string{"busy"}, Value: float64(busy)},
+				{LabelValues: []string{"idle"}, Value: float64(idle)},
+			}
+		}, "state"))
+}
+
+//ServeHTTP writes the metrics in the Prometheus text exposition format
+func (serverMetrics *ServerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	serverMetrics.registry.Write(w)
+}
+
+//NewServerMetrics creates the server metrics, pool metrics are added by WatchPool
+func NewServerMetrics() *ServerMetrics {
+	serverMetrics := ServerMetrics{}
+	serverMetrics.registry = NewMetricsRegistry()
+
+	serverMetrics.requests = NewCounterVec("gopg_http_requests_total",
+		"Number of HTTP requests by route and status code.", "route", "status")
+	serverMetrics.outcomes = NewCounterVec("gopg_program_outcomes_total",
+		"Number of executed programs by outcome.", "outcome")
+	serverMetrics.compileDuration = NewHistogram("gopg_compile_duration_seconds",
+		"Time taken to compile programs.", DurationBuckets)
+	serverMetrics.runDuration = NewHistogram("gopg_run_duration_seconds",
+		"Time taken to run compiled programs.", DurationBuckets)
+	serverMetrics.containerStart = NewHistogram("gopg_container_start_seconds",
+		"Time taken by a sandbox container to start and accept the program.", DurationBuckets)
+
+	serverMetrics.registry.Register(serverMetrics.requests)
+	serverMetrics.registry.Register(serverMetrics.outcomes)
+	serverMetrics.registry.Register(serverMetrics.compileDuration)
+	serverMetrics.registry.Register(serverMetrics.runDuration)
+	serverMetrics.registry.Register(serverMetrics.containerStart)
+
+	serverMetrics.registry.Register(NewGaugeFunc("gopg_workspaces", "Number of temporary program workspaces.",
+		func() []GaugeSample {
+			count, _ := runningJobs.WorkspaceUsage()
+			return []GaugeSample{{Value: float64(count)}}
+		}))
+
+	serverMetrics.registry.Register(NewGaugeFunc("gopg_workspace_bytes", "Disk space used by the temporary program workspaces.",
+		func() []GaugeSample {
+			_, size := runningJobs.WorkspaceUsage()
+			return []GaugeSample{{Value: float64(size)}}
+		}))
+
+	return &serverMetrics
+}
+
+//statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+//Unwrap lets http.ResponseController reach the underlying writer
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+//Status status code of the response, 200 when nothing was written
+func (recorder *statusRecorder) Status() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
+
+//instrument counts the answered requests by route, requests matching no route are counted as unmatched
+func instrument(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		next(recorder, r)
+
+		//requests are counted by route rather than path, to bound the number of series
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		serverMetrics.ObserveRequest(route, recorder.Status())
+	}
+}
+
+//serverMetrics metrics of the running server
+var serverMetrics = NewServerMetrics()
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//ModuleVersion Represents a module requirement
+type ModuleVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+//AllowedModule Represents a module and the versions programs may require
+type AllowedModule struct {
+	Path     string   `json:"path"`
+	Versions []string `json:"versions"`
+}
+
+//ModuleConfig Represents the curated set of third-party modules
+type ModuleConfig struct {
+	//ProxyDir GOPROXY directory populated by the operator
+	ProxyDir string          `json:"proxyDir"`
+	Modules  []AllowedModule `json:"modules"`
+
+	allowed map[string]map[string]bool
+}
+
+//LoadModuleConfig reads the module configuration from a JSON file
+func LoadModuleConfig(path string) (*ModuleConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := ModuleConfig{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid module configuration %s: %v", path, err)
+	}
+
+	if !filepath.IsAbs(config.ProxyDir) {
+		return nil, fmt.Errorf("Module proxy directory must be an absolute path, found %q", config.ProxyDir)
+	}
+
+	config.allowed = make(map[string]map[string]bool)
+	for _, module := range config.Modules {
+		if config.allowed[module.Path] == nil {
+			config.allowed[module.Path] = make(map[string]bool)
+		}
+		for _, version := range module.Versions {
+			config.allowed[module.Path][version] = true
+		}
+	}
+
+	return &config, nil
+}
+
+//Env returns the environment resolving modules from the local proxy only
+func (config *ModuleConfig) Env() []string {
+	return []string{
+		"GOFLAGS=-mod=mod",
+		"GOPROXY=file://" + filepath.ToSlash(config.ProxyDir),
+		"GOSUMDB=off",
+	}
+}
+
+//Validate checks that the go.mod only requires allowed modules
+func (config *ModuleConfig) Validate(goMod string) error {
+	requirements, err := parseGoMod(goMod)
+	if err != nil {
+		return err
+	}
+
+	for _, requirement := range requirements {
+		if config != nil && config.allowed[requirement.Path][requirement.Version] {
+			continue
+		}
+
+		return fmt.Errorf("go.mod requires %s %s, which is not available. Allowed modules: %s",
+			requirement.Path, requirement.Version, config.describe())
+	}
+
+	return nil
+}
+
+//describe lists the allowed modules as path@version
+func (config *ModuleConfig) describe() string {
+	if config == nil || len(config.Modules) == 0 {
+		return "none"
+	}
+
+	modules := make([]string, 0)
+	for _, module := range config.Modules {
+		for _, version := range module.Versions {
+			modules = append(modules, module.Path+"@"+version)
+		}
+	}
+	sort.Strings(modules)
+
+	return strings.Join(modules, ", ")
+}
+
+//parseGoMod extracts the requirements of a go.mod, directives that could
+//bypass the allowed modules are rejected
+func parseGoMod(goMod string) ([]ModuleVersion, error) {
+	requirements := make([]ModuleVersion, 0)
+	block := ""
+
+	for idx, line := range strings.Split(goMod, "\n") {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if block != "" {
+			if fields[0] == ")" {
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+
+		switch fields[0] {
+		case "module", "go", "toolchain", "exclude", "retract", "godebug":
+			continue
+		case "require":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("go.mod:%d: malformed require directive", idx+1)
+			}
+
+			path, err := unquoteModulePath(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("go.mod:%d: %v", idx+1, err)
+			}
+
+			requirements = append(requirements, ModuleVersion{Path: path, Version: fields[2]})
+		case "replace", "tool":
+			return nil, fmt.Errorf("go.mod:%d: %s directives are not allowed", idx+1, fields[0])
+		default:
+			return nil, fmt.Errorf("go.mod:%d: unknown directive %s", idx+1, fields[0])
+		}
+	}
+
+	if block != "" {
+		return nil, fmt.Errorf("go.mod: unterminated %s block", block)
+	}
+
+	return requirements, nil
+}
+
+func unquoteModulePath(path string) (string, error) {
+	if !strings.HasPrefix(path, "\"") && !strings.HasPrefix(path, "`") {
+		return path, nil
+	}
+
+	return strconv.Unquote(path)
+}
+
+//moduleConfig curated modules, nil rejects every go.mod requirement
+var moduleConfig *ModuleConfig
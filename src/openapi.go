@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+
+	//OpenAPIVersion version of the OpenAPI specification the document follows
+	OpenAPIVersion string = "3.0.3"
+
+	//APIVersion version of the API described by the document
+	APIVersion string = "1.0.0"
+)
+
+//jsonSchema Represents an OpenAPI schema, or any other object of the document
+type jsonSchema map[string]interface{}
+
+//QueryParameter Represents a query parameter of an operation
+type QueryParameter struct {
+	Name        string
+	Description string
+	Schema      jsonSchema
+}
+
+//Operation Describes a route in the OpenAPI document, given when the route is
+//registered. Request and Response are values of the types of the bodies, their
+//schemas are generated from the types. Whether the operation needs an API key
+//follows from the middleware of the route
+type Operation struct {
+	ID      string
+	Tag     string
+	Summary string
+
+	Parameters []QueryParameter
+
+	Request     interface{}
+	RequestType string
+
+	Response     interface{}
+	ResponseType string
+	Status       int
+
+	//ExtraStatuses statuses answered with the same body as Status
+	ExtraStatuses []int
+}
+
+//multipartProgram schema of the form of /executeFile
+var multipartProgram = jsonSchema{
+	"type":     "object",
+	"required": []string{"file"},
+	"properties": jsonSchema{
+		"file": jsonSchema{
+			"type":        "array",
+			"description": "Source files, the first one is the main file",
+			"items":       jsonSchema{"type": "string", "format": "binary"},
+		},
+		"stdin": jsonSchema{"type": "string", "description": "Standard input of the program"},
+		"arg": jsonSchema{
+			"type":        "array",
+			"description": "Arguments of the program",
+			"items":       jsonSchema{"type": "string"},
+		},
+		"test": jsonSchema{"type": "boolean", "description": "Run the tests of the _test.go files"},
+	},
+}
+
+//requiredFields fields the requests must set, the other fields are optional
+var requiredFields = map[string][]string{
+	"InputPack":      {"program"},
+	"SourceFile":     {"name", "content"},
+	"AnalysisInput":  {"program"},
+	"CreateKeyInput": {"name"},
+}
+
+//schemaGenerator generates the schemas of Go types from their JSON encoding,
+//named types are described once in the components of the document
+type schemaGenerator struct {
+	schemas map[string]jsonSchema
+}
+
+//schema returns the schema of the values of typ
+func (generator *schemaGenerator) schema(typ reflect.Type) jsonSchema {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ {
+	case reflect.TypeOf(time.Time{}):
+		return jsonSchema{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return jsonSchema{"type": "integer", "description": "Nanoseconds"}
+	case reflect.TypeOf(ErrorCode("")):
+		return generator.named("ErrorCode", func() jsonSchema {
+			return errorCodeSchema()
+		})
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return jsonSchema{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return jsonSchema{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "format": "byte"}
+		}
+		return jsonSchema{"type": "array", "items": generator.schema(typ.Elem())}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": generator.schema(typ.Elem())}
+	case reflect.Struct:
+		if typ.Name() == "" {
+			return generator.object(typ)
+		}
+		return generator.named(typ.Name(), func() jsonSchema {
+			return generator.object(typ)
+		})
+	}
+
+	//interfaces hold any value
+	return jsonSchema{}
+}
+
+//named describes a type once in the components, returning a reference to it
+func (generator *schemaGenerator) named(name string, describe func() jsonSchema) jsonSchema {
+	if _, ok := generator.schemas[name]; !ok {
+		//recursive types refer to the schema being described
+		generator.schemas[name] = jsonSchema{}
+		generator.schemas[name] = describe()
+	}
+
+	return jsonSchema{"$ref": "#/components/schemas/" + name}
+}
+
+//object returns the schema of a struct, with its fields as encoded by encoding/json
+func (generator *schemaGenerator) object(typ reflect.Type) jsonSchema {
+	properties := jsonSchema{}
+	generator.addFields(typ, properties)
+
+	schema := jsonSchema{"type": "object", "properties": properties}
+	if required, ok := requiredFields[typ.Name()]; ok {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+//addFields adds the exported fields of a struct to properties, embedded structs are flattened
+func (generator *schemaGenerator) addFields(typ reflect.Type, properties jsonSchema) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			generator.addFields(field.Type, properties)
+			continue
+		}
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = generator.schema(field.Type)
+	}
+}
+
+//bodySchema returns the schema of a body given as a value, or as a schema
+func (generator *schemaGenerator) bodySchema(body interface{}) jsonSchema {
+	if schema, ok := body.(jsonSchema); ok {
+		return schema
+	}
+
+	return generator.schema(reflect.TypeOf(body))
+}
+
+//errorCodeSchema lists the error codes along with their HTTP status
+func errorCodeSchema() jsonSchema {
+	codes := make([]string, 0, len(errorStatus))
+	for code := range errorStatus {
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+
+	statuses := make([]string, 0, len(codes))
+	for _, code := range codes {
+		statuses = append(statuses, fmt.Sprintf("%s (%d)", code, ErrorCode(code).Status()))
+	}
+
+	return jsonSchema{
+		"type":        "string",
+		"enum":        codes,
+		"description": "Machine-readable code of an error, answered with the HTTP status: " + strings.Join(statuses, ", "),
+	}
+}
+
+//openAPIPath converts a route pattern to an OpenAPI path, along with its path parameters
+func openAPIPath(pattern string) (string, []string) {
+	segments := strings.Split(pattern, "/")
+	names := make([]string, 0)
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			name := strings.TrimSuffix(segment[1:len(segment)-1], "...")
+			segments[i] = "{" + name + "}"
+			names = append(names, name)
+		}
+	}
+
+	return strings.Join(segments, "/"), names
+}
+
+//usesMiddleware reports whether middleware holds wanted
+func usesMiddleware(middleware []Middleware, wanted Middleware) bool {
+	for _, candidate := range middleware {
+		if reflect.ValueOf(candidate).Pointer() == reflect.ValueOf(wanted).Pointer() {
+			return true
+		}
+	}
+
+	return false
+}
+
+//operation returns the OpenAPI operation object of a route
+func (generator *schemaGenerator) operation(route Route) jsonSchema {
+	op := route.Operation
+	operation := jsonSchema{
+		"operationId": op.ID,
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+	}
+
+	if usesMiddleware(route.Middleware, authenticate) {
+		operation["security"] = []jsonSchema{{"apiKey": []string{}}}
+	}
+
+	parameters := make([]jsonSchema, 0)
+	_, names := openAPIPath(route.Pattern)
+	for _, name := range names {
+		parameters = append(parameters, jsonSchema{"name": name, "in": "path", "required": true, "schema": jsonSchema{"type": "string"}})
+	}
+	for _, parameter := range op.Parameters {
+		parameters = append(parameters, jsonSchema{"name": parameter.Name, "in": "query", "description": parameter.Description, "schema": parameter.Schema})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if op.Request != nil {
+		requestType := op.RequestType
+		if requestType == "" {
+			requestType = "application/json"
+		}
+		operation["requestBody"] = jsonSchema{
+			"required": true,
+			"content":  jsonSchema{requestType: jsonSchema{"schema": generator.bodySchema(op.Request)}},
+		}
+	}
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	answer := jsonSchema{"description": http.StatusText(status)}
+	if op.Response != nil {
+		responseType := op.ResponseType
+		if responseType == "" {
+			responseType = "application/json"
+		}
+		answer["content"] = jsonSchema{responseType: jsonSchema{"schema": generator.bodySchema(op.Response)}}
+	}
+
+	responses := jsonSchema{fmt.Sprint(status): answer, "default": jsonSchema{"$ref": "#/components/responses/Error"}}
+	for _, extra := range op.ExtraStatuses {
+		responses[fmt.Sprint(extra)] = jsonSchema{"description": http.StatusText(extra), "content": answer["content"]}
+	}
+	operation["responses"] = responses
+
+	return operation
+}
+
+//OpenAPIDocument Represents the OpenAPI document of the server, served at /openapi.json
+type OpenAPIDocument struct {
+	data []byte
+}
+
+//Generate generates the document describing routes, every route must be
+//documented by the operation it was registered with
+func (document *OpenAPIDocument) Generate(routes []Route) error {
+	problems := make([]string, 0)
+	ids := make(map[string]string)
+	for _, route := range routes {
+		op := route.Operation
+		if op.ID == "" || op.Summary == "" {
+			problems = append(problems, fmt.Sprintf("%s %s is routed but not documented", route.Method, route.Pattern))
+			continue
+		}
+		if other, ok := ids[op.ID]; ok {
+			problems = append(problems, fmt.Sprintf("%s %s and %s share the operation ID %s", route.Method, route.Pattern, other, op.ID))
+		}
+		ids[op.ID] = route.Method + " " + route.Pattern
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("OpenAPI document out of sync with the routes: %s", strings.Join(problems, ", "))
+	}
+
+	generator := schemaGenerator{}
+	generator.schemas = make(map[string]jsonSchema)
+
+	paths := jsonSchema{}
+	for _, route := range routes {
+		path, _ := openAPIPath(route.Pattern)
+		if _, ok := paths[path]; !ok {
+			paths[path] = jsonSchema{}
+		}
+		paths[path].(jsonSchema)[strings.ToLower(route.Method)] = generator.operation(route)
+	}
+
+	//the events of /executeStream, and the error model of every operation
+	generator.schema(reflect.TypeOf(StreamOutput{}))
+	generator.schema(reflect.TypeOf(OutputPack{}))
+
+	spec := jsonSchema{
+		"openapi": OpenAPIVersion,
+		"info": jsonSchema{
+			"title":       "gopg",
+			"version":     APIVersion,
+			"description": "Runs Go programs, optionally in a gVisor sandbox. Errors are answered with an OutputPack having error set and an errorCode.",
+		},
+		"paths": paths,
+		"components": jsonSchema{
+			"schemas": generator.schemas,
+			"responses": jsonSchema{
+				"Error": jsonSchema{
+					"description": "Error, the HTTP status follows from errorCode",
+					"content":     jsonSchema{"application/json": jsonSchema{"schema": jsonSchema{"$ref": "#/components/schemas/OutputPack"}}},
+				},
+			},
+			"securitySchemes": jsonSchema{
+				"apiKey": jsonSchema{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "API key, required when the server has api-keys set",
+				},
+			},
+		},
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	document.data = data
+
+	return nil
+}
+
+//ServeHTTP answers the document
+func (document *OpenAPIDocument) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(document.data)
+}
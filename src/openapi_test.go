@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+//newTestRouter registers the routes of the server the way main does
+func newTestRouter(t *testing.T) (*RoutesHandler, *OpenAPIDocument) {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.MinWorkers = 0
+	config.MaxWorkers = 1
+
+	router := NewRouteHandler(config.PoolConfig(), NewFairShareBackend[WorkType](config.QueueSize, config.QueuePerClient))
+	document := registerRoutes(router, config, NewMemorySnippetStore(config.SnippetLimits()))
+
+	return router, document
+}
+
+//generateSpec generates the document of the routes and decodes it
+func generateSpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	router, document := newTestRouter(t)
+	err := document.Generate(router.Routes())
+	if err != nil {
+		t.Fatalf("Generate() = %v", err)
+	}
+
+	spec := make(map[string]interface{})
+	err = json.Unmarshal(document.data, &spec)
+	if err != nil {
+		t.Fatalf("Document is not valid JSON: %v", err)
+	}
+
+	return spec
+}
+
+//resolve follows a local reference like #/components/schemas/InputPack
+func resolve(spec map[string]interface{}, ref string) bool {
+	if !strings.HasPrefix(ref, "#/") {
+		return false
+	}
+
+	var node interface{} = spec
+	for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		node, ok = object[name]
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+//collectRefs appends every $ref found in node to refs
+func collectRefs(node interface{}, refs *[]string) {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if ref, ok := child.(string); ok && key == "$ref" {
+				*refs = append(*refs, ref)
+				continue
+			}
+			collectRefs(child, refs)
+		}
+	case []interface{}:
+		for _, child := range value {
+			collectRefs(child, refs)
+		}
+	}
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	router, _ := newTestRouter(t)
+	spec := generateSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	for _, route := range router.Routes() {
+		path, _ := openAPIPath(route.Pattern)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s is missing from the paths", path)
+			continue
+		}
+		if _, ok := item[strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is missing from the paths", route.Method, route.Pattern)
+		}
+	}
+}
+
+func TestOpenAPIRefsResolve(t *testing.T) {
+	spec := generateSpec(t)
+
+	refs := make([]string, 0)
+	collectRefs(spec, &refs)
+	if len(refs) == 0 {
+		t.Fatal("Document holds no $ref")
+	}
+
+	for _, ref := range refs {
+		if !resolve(spec, ref) {
+			t.Errorf("$ref %s does not resolve", ref)
+		}
+	}
+}
+
+func TestOpenAPIComponents(t *testing.T) {
+	spec := generateSpec(t)
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	for _, name := range []string{"InputPack", "OutputPack", "ProgramOutput", "ErrorCode"} {
+		if _, ok := schemas[name]; !ok {
+			t.Errorf("components.schemas lacks %s", name)
+		}
+	}
+
+	codes := schemas["ErrorCode"].(map[string]interface{})["enum"].([]interface{})
+	if len(codes) != len(errorStatus) {
+		t.Errorf("ErrorCode lists %d codes, want %d", len(codes), len(errorStatus))
+	}
+}
+
+func TestOpenAPISecurityFollowsMiddleware(t *testing.T) {
+	spec := generateSpec(t)
+	paths := spec["paths"].(map[string]interface{})
+
+	operation := func(path string, method string) map[string]interface{} {
+		return paths[path].(map[string]interface{})[method].(map[string]interface{})
+	}
+
+	if _, ok := operation("/executeJson", "post")["security"]; !ok {
+		t.Error("POST /executeJson is authenticated but documented without security")
+	}
+	if _, ok := operation("/healthz", "get")["security"]; ok {
+		t.Error("GET /healthz is open but documented with security")
+	}
+}
+
+func TestOpenAPIRejectsUndocumentedRoute(t *testing.T) {
+	router, document := newTestRouter(t)
+	router.Handle("GET", "/undocumented", Operation{}, func(w http.ResponseWriter, r *http.Request) {})
+
+	err := document.Generate(router.Routes())
+	if err == nil || !strings.Contains(err.Error(), "GET /undocumented") {
+		t.Fatalf("Generate() = %v, want an error naming GET /undocumented", err)
+	}
+}
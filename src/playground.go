@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
+
+//playgroundFiles page, script and style of the web playground, built into the binary
+//
+//go:embed playground
+var playgroundFiles embed.FS
+
+//PlaygroundPolicy Content-Security-Policy of the playground, it only loads its own files
+const PlaygroundPolicy string = "default-src 'self'; img-src 'self' data:; frame-ancestors 'none'"
+
+//servePlayground answers the file name of the playground
+func servePlayground(w http.ResponseWriter, r *http.Request, name string) {
+	files, _ := fs.Sub(playgroundFiles, "playground")
+
+	info, err := fs.Stat(files, name)
+	if err != nil || info.IsDir() {
+		sendError(&w, CodeNotFound, fmt.Sprintf("No route for %s", r.URL.Path))
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", PlaygroundPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFileFS(w, r, files, name)
+}
+
+//playgroundPage answers the page of the playground
+func playgroundPage(w http.ResponseWriter, r *http.Request) {
+	servePlayground(w, r, "index.html")
+}
+
+//playgroundAsset answers the scripts and styles of GET /playground/{file...}
+func playgroundAsset(w http.ResponseWriter, r *http.Request) {
+	servePlayground(w, r, r.PathValue("file"))
+}
@@ -0,0 +1,586 @@
+"use strict";
+
+// The playground of gopg, backed by the API of the server it is served from.
+// It keeps working offline: everything it needs is served by gopg.
+
+const DEFAULT_PROGRAM = `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("Hello, gopg!")
+}
+`;
+
+const elements = {
+  run: document.getElementById("run"),
+  format: document.getElementById("format"),
+  test: document.getElementById("test"),
+  share: document.getElementById("share"),
+  shareLink: document.getElementById("share-link"),
+  apiKey: document.getElementById("api-key"),
+  tabs: document.getElementById("tabs"),
+  addFile: document.getElementById("add-file"),
+  gutter: document.getElementById("gutter"),
+  highlights: document.getElementById("highlights"),
+  source: document.getElementById("source"),
+  diagnostics: document.getElementById("diagnostics"),
+  args: document.getElementById("args"),
+  stdin: document.getElementById("stdin"),
+  status: document.getElementById("status"),
+  output: document.getElementById("output"),
+};
+
+const state = {
+  // files of the program, main.go first
+  files: [{ name: "main.go", content: DEFAULT_PROGRAM }],
+  active: 0,
+  // diagnostics by file name, each one {line, column, message}
+  diagnostics: {},
+  running: false,
+};
+
+// ---- storage
+
+function save() {
+  localStorage.setItem("gopg.files", JSON.stringify(state.files));
+  localStorage.setItem("gopg.stdin", elements.stdin.value);
+  localStorage.setItem("gopg.args", elements.args.value);
+}
+
+function restore() {
+  try {
+    const files = JSON.parse(localStorage.getItem("gopg.files"));
+    if (Array.isArray(files) && files.length > 0 && files[0].name === "main.go") {
+      state.files = files;
+    }
+  } catch (err) {
+    // keep the default program
+  }
+  elements.stdin.value = localStorage.getItem("gopg.stdin") || "";
+  elements.args.value = localStorage.getItem("gopg.args") || "";
+  elements.apiKey.value = localStorage.getItem("gopg.key") || "";
+}
+
+// ---- API
+
+function headers() {
+  const result = { "Content-Type": "application/json" };
+  const key = elements.apiKey.value.trim();
+  if (key !== "") {
+    result["Authorization"] = "Bearer " + key;
+  }
+  return result;
+}
+
+async function post(path, body) {
+  const response = await fetch(path, { method: "POST", headers: headers(), body: JSON.stringify(body) });
+  return response.json();
+}
+
+// parseArgs splits the arguments like a shell, honouring quotes and backslashes
+function parseArgs(line) {
+  const args = [];
+  let current = null;
+  let quote = null;
+  for (let i = 0; i < line.length; i++) {
+    const c = line[i];
+    if (quote !== null) {
+      if (c === quote) {
+        quote = null;
+      } else if (c === "\\" && quote === '"' && i + 1 < line.length) {
+        current += line[++i];
+      } else {
+        current += c;
+      }
+    } else if (c === '"' || c === "'") {
+      quote = c;
+      current = current === null ? "" : current;
+    } else if (c === "\\" && i + 1 < line.length) {
+      current = (current === null ? "" : current) + line[++i];
+    } else if (/\s/.test(c)) {
+      if (current !== null) {
+        args.push(current);
+        current = null;
+      }
+    } else {
+      current = (current === null ? "" : current) + c;
+    }
+  }
+  if (current !== null) {
+    args.push(current);
+  }
+  return args;
+}
+
+// programInput builds the input of /executeStream, test files are only sent to run the tests
+function programInput(test) {
+  const files = state.files.slice(1).filter((file) => test || !file.name.endsWith("_test.go"));
+  return {
+    program: state.files[0].content,
+    files: files.map((file) => ({ name: file.name, content: file.content })),
+    stdin: elements.stdin.value,
+    args: parseArgs(elements.args.value),
+    test: test,
+  };
+}
+
+// ---- editor
+
+function activeFile() {
+  return state.files[state.active];
+}
+
+function renderTabs() {
+  for (const tab of elements.tabs.querySelectorAll(".tab")) {
+    tab.remove();
+  }
+
+  state.files.forEach((file, index) => {
+    const tab = document.createElement("button");
+    tab.className = "tab" + (index === state.active ? " active" : "");
+    tab.textContent = file.name;
+    tab.addEventListener("click", () => selectFile(index));
+
+    if (index > 0) {
+      const close = document.createElement("span");
+      close.className = "close";
+      close.textContent = "×";
+      close.title = "Remove " + file.name;
+      close.addEventListener("click", (event) => {
+        event.stopPropagation();
+        removeFile(index);
+      });
+      tab.appendChild(close);
+    }
+
+    elements.tabs.insertBefore(tab, elements.addFile);
+  });
+}
+
+function selectFile(index) {
+  state.active = index;
+  elements.source.value = activeFile().content;
+  elements.source.scrollTop = 0;
+  renderTabs();
+  renderEditor();
+}
+
+function addFile() {
+  const name = prompt("Name of the new file, like util.go or main_test.go");
+  if (name === null) {
+    return;
+  }
+  if (!/^[A-Za-z0-9][A-Za-z0-9_.-]*\.go$/.test(name) || state.files.some((file) => file.name === name)) {
+    alert("Files are named like util.go, and each name is used once");
+    return;
+  }
+
+  const content = name.endsWith("_test.go")
+    ? 'package main\n\nimport "testing"\n\nfunc TestMain(t *testing.T) {\n}\n'
+    : "package main\n";
+  state.files.push({ name: name, content: content });
+  save();
+  selectFile(state.files.length - 1);
+}
+
+function removeFile(index) {
+  if (!confirm("Remove " + state.files[index].name + "?")) {
+    return;
+  }
+  delete state.diagnostics[state.files[index].name];
+  state.files.splice(index, 1);
+  save();
+  selectFile(Math.min(state.active, state.files.length - 1));
+  renderDiagnostics();
+}
+
+// renderEditor draws the line numbers and the highlighted lines of the diagnostics
+function renderEditor() {
+  const lines = elements.source.value.split("\n");
+  const errors = new Map();
+  for (const diagnostic of state.diagnostics[activeFile().name] || []) {
+    if (!errors.has(diagnostic.line)) {
+      errors.set(diagnostic.line, diagnostic.message);
+    }
+  }
+
+  elements.gutter.replaceChildren();
+  elements.highlights.replaceChildren();
+  lines.forEach((line, index) => {
+    const separator = index + 1 < lines.length ? "\n" : "";
+    const message = errors.get(index + 1);
+
+    const number = document.createElement("span");
+    number.textContent = index + 1;
+    if (message !== undefined) {
+      number.className = "error";
+      number.title = message;
+    }
+    elements.gutter.append(number, separator);
+
+    if (message !== undefined) {
+      const mark = document.createElement("mark");
+      mark.textContent = line === "" ? " " : line;
+      elements.highlights.append(mark, separator);
+    } else {
+      elements.highlights.append(line + separator);
+    }
+  });
+  // room for the horizontal scrollbar of the textarea
+  elements.gutter.append("\n ");
+  elements.highlights.append("\n ");
+
+  syncScroll();
+}
+
+function syncScroll() {
+  elements.highlights.scrollTop = elements.source.scrollTop;
+  elements.highlights.scrollLeft = elements.source.scrollLeft;
+  elements.gutter.scrollTop = elements.source.scrollTop;
+}
+
+// byteColumnIndex converts a Go column, the 1-based byte offset in the UTF-8 line,
+// to an index in the UTF-16 string of the line
+function byteColumnIndex(text, column) {
+  let bytes = 0;
+  let index = 0;
+  for (const character of text) {
+    if (bytes >= column - 1) {
+      break;
+    }
+    const code = character.codePointAt(0);
+    bytes += code < 0x80 ? 1 : code < 0x800 ? 2 : code < 0x10000 ? 3 : 4;
+    index += character.length;
+  }
+  return index;
+}
+
+function goToLine(name, line, column) {
+  const index = state.files.findIndex((file) => file.name === name);
+  if (index < 0) {
+    return;
+  }
+  if (index !== state.active) {
+    selectFile(index);
+  }
+
+  const lines = elements.source.value.split("\n");
+  let offset = 0;
+  for (let i = 0; i < line - 1 && i < lines.length; i++) {
+    offset += lines[i].length + 1;
+  }
+  if (line - 1 < lines.length) {
+    offset += byteColumnIndex(lines[line - 1], column || 1);
+  }
+
+  elements.source.focus();
+  elements.source.setSelectionRange(offset, offset);
+  const lineHeight = parseFloat(getComputedStyle(elements.source).lineHeight) || 20;
+  elements.source.scrollTop = Math.max(0, (line - 5) * lineHeight);
+}
+
+function onEdit() {
+  activeFile().content = elements.source.value;
+  save();
+  renderEditor();
+  scheduleCheck();
+}
+
+// onKey indents with tabs and keeps the indentation of the previous line
+function onKey(event) {
+  const source = elements.source;
+  if (event.key === "Enter" && (event.ctrlKey || event.metaKey)) {
+    event.preventDefault();
+    run(false);
+  } else if (event.key === "F" && event.shiftKey && (event.ctrlKey || event.metaKey)) {
+    event.preventDefault();
+    format();
+  } else if (event.key === "Tab" && !event.ctrlKey && !event.metaKey) {
+    event.preventDefault();
+    source.setRangeText("\t", source.selectionStart, source.selectionEnd, "end");
+    onEdit();
+  } else if (event.key === "Enter" && !event.shiftKey) {
+    const before = source.value.slice(0, source.selectionStart);
+    const indent = before.slice(before.lastIndexOf("\n") + 1).match(/^\s*/)[0];
+    const extra = before.trimEnd().endsWith("{") ? "\t" : "";
+    event.preventDefault();
+    source.setRangeText("\n" + indent + extra, source.selectionStart, source.selectionEnd, "end");
+    onEdit();
+  }
+}
+
+// ---- diagnostics
+
+function setDiagnostics(diagnostics) {
+  state.diagnostics = diagnostics;
+  renderDiagnostics();
+  renderEditor();
+}
+
+function renderDiagnostics() {
+  elements.diagnostics.replaceChildren();
+  for (const file of state.files) {
+    for (const diagnostic of state.diagnostics[file.name] || []) {
+      const item = document.createElement("li");
+      item.textContent = `${file.name}:${diagnostic.line}:${diagnostic.column}: ${diagnostic.message}`;
+      item.addEventListener("click", () => goToLine(file.name, diagnostic.line, diagnostic.column));
+      elements.diagnostics.appendChild(item);
+    }
+  }
+}
+
+// compilerDiagnostics reads the errors of the go command, like ./main.go:5:2: undefined: x
+function compilerDiagnostics(output) {
+  const diagnostics = {};
+  const pattern = /(?:^|\s)(?:\S*\/)?([A-Za-z0-9_.-]+\.go):(\d+):(?:(\d+):)? (.+)$/gm;
+  for (const match of output.matchAll(pattern)) {
+    const name = match[1];
+    if (!state.files.some((file) => file.name === name)) {
+      continue;
+    }
+    diagnostics[name] = diagnostics[name] || [];
+    diagnostics[name].push({ line: Number(match[2]), column: Number(match[3] || 1), message: match[4] });
+  }
+  return diagnostics;
+}
+
+// analysisDiagnostics keeps the diagnostics of /typecheck and /format, for the file that was analyzed
+function analysisDiagnostics(name, diagnostics) {
+  const result = {};
+  if (diagnostics && diagnostics.length > 0) {
+    result[name] = diagnostics.map((d) => ({ line: d.line, column: d.column, message: d.message }));
+  }
+  return result;
+}
+
+let checkTimer = null;
+
+// scheduleCheck type-checks single-file programs once the user stops typing,
+// the files of larger programs refer to each other and are checked by the compiler
+function scheduleCheck() {
+  clearTimeout(checkTimer);
+  if (state.files.length > 1) {
+    return;
+  }
+
+  checkTimer = setTimeout(async () => {
+    const program = state.files[0].content;
+    try {
+      const answer = await post("/typecheck", { program: program });
+      if (!answer.error && state.files[0].content === program && !state.running) {
+        setDiagnostics(analysisDiagnostics("main.go", answer.diagnostics));
+      }
+    } catch (err) {
+      // the diagnostics are a convenience, a failed check is not reported
+    }
+  }, 700);
+}
+
+// ---- output
+
+function setStatus(text, failed) {
+  elements.status.textContent = text;
+  elements.status.className = failed ? "failed" : "";
+}
+
+function appendOutput(text, system) {
+  if (system) {
+    const line = document.createElement("span");
+    line.className = "system";
+    line.textContent = text;
+    elements.output.appendChild(line);
+  } else {
+    elements.output.append(text);
+  }
+  elements.output.scrollTop = elements.output.scrollHeight;
+}
+
+function setRunning(running) {
+  state.running = running;
+  for (const button of [elements.run, elements.test, elements.format]) {
+    button.disabled = running;
+  }
+}
+
+// readEvents parses the server-sent events of a response, calling onEvent with every event
+async function readEvents(response, onEvent) {
+  const reader = response.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    buffer += decoder.decode(value, { stream: true });
+
+    let end;
+    while ((end = buffer.indexOf("\n\n")) >= 0) {
+      const block = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+
+      let event = "message";
+      const data = [];
+      for (const line of block.split("\n")) {
+        if (line.startsWith("event: ")) {
+          event = line.slice(7);
+        } else if (line.startsWith("data: ")) {
+          data.push(line.slice(6));
+        }
+      }
+      onEvent(event, JSON.parse(data.join("\n")));
+    }
+  }
+}
+
+// showResult shows the answer of a run, the whole output replaces the streamed one
+function showResult(result, test) {
+  if (result.error) {
+    setStatus(result.errorString, true);
+    return;
+  }
+
+  const execution = result.execution;
+  elements.output.textContent = execution.output;
+  if (execution.output === "") {
+    appendOutput("[no output]\n", true);
+  }
+
+  const what = test ? (execution.success ? "Tests passed" : "Tests failed") : (execution.success ? "Done" : "Failed");
+  const cached = result.cached ? ", cached" : "";
+  setStatus(`${what} in ${execution.executionTime.toFixed(2)}s${cached}`, !execution.success);
+
+  if (!execution.success) {
+    setDiagnostics(compilerDiagnostics(execution.output));
+  }
+}
+
+async function run(test) {
+  if (state.running) {
+    return;
+  }
+  setRunning(true);
+  setDiagnostics({});
+  elements.output.replaceChildren();
+  setStatus(test ? "Testing..." : "Running...", false);
+
+  try {
+    const response = await fetch("/executeStream", {
+      method: "POST",
+      headers: headers(),
+      body: JSON.stringify(programInput(test)),
+    });
+
+    // requests refused before running are answered with a JSON error
+    if (!response.headers.get("Content-Type").startsWith("text/event-stream")) {
+      const answer = await response.json();
+      setStatus(answer.errorString, true);
+      return;
+    }
+
+    await readEvents(response, (event, data) => {
+      if (event === "output") {
+        appendOutput(data.output, false);
+      } else if (event === "result") {
+        showResult(data, test);
+      }
+    });
+  } catch (err) {
+    setStatus("Failed to reach the server: " + err.message, true);
+  } finally {
+    setRunning(false);
+  }
+}
+
+// ---- format and share
+
+async function format() {
+  const file = activeFile();
+  try {
+    const answer = await post("/format", { program: file.content });
+    if (answer.error) {
+      setDiagnostics(analysisDiagnostics(file.name, answer.diagnostics));
+      setStatus(answer.errorString, true);
+      return;
+    }
+
+    if (answer.formatted !== file.content) {
+      const cursor = elements.source.selectionStart;
+      const scroll = elements.source.scrollTop;
+      file.content = answer.formatted;
+      elements.source.value = answer.formatted;
+      elements.source.setSelectionRange(cursor, cursor);
+      elements.source.scrollTop = scroll;
+      save();
+    }
+    setDiagnostics(state.files.length === 1 ? analysisDiagnostics(file.name, answer.diagnostics) : {});
+    setStatus("Formatted", false);
+  } catch (err) {
+    setStatus("Failed to reach the server: " + err.message, true);
+  }
+}
+
+async function share() {
+  if (state.files.length > 1) {
+    setStatus("Only main.go is shared", false);
+  }
+
+  try {
+    const answer = await post("/share", { program: state.files[0].content });
+    if (answer.error) {
+      setStatus(answer.errorString, true);
+      return;
+    }
+
+    const link = document.createElement("input");
+    link.readOnly = true;
+    link.value = `${location.origin}/?p=${encodeURIComponent(answer.snippet.id)}`;
+    elements.shareLink.replaceChildren(link);
+    link.select();
+    history.replaceState(null, "", "/?p=" + encodeURIComponent(answer.snippet.id));
+  } catch (err) {
+    setStatus("Failed to reach the server: " + err.message, true);
+  }
+}
+
+// loadShared opens the program of a shared link, /?p=<id>
+async function loadShared() {
+  const id = new URLSearchParams(location.search).get("p");
+  if (!id) {
+    return;
+  }
+
+  try {
+    const response = await fetch("/p/" + encodeURIComponent(id), { headers: headers() });
+    const answer = await response.json();
+    if (answer.error) {
+      setStatus(answer.errorString, true);
+      return;
+    }
+    state.files = [{ name: "main.go", content: answer.snippet.program }];
+    selectFile(0);
+    save();
+  } catch (err) {
+    setStatus("Failed to load the shared program: " + err.message, true);
+  }
+}
+
+// ---- setup
+
+elements.source.addEventListener("input", onEdit);
+elements.source.addEventListener("keydown", onKey);
+elements.source.addEventListener("scroll", syncScroll);
+elements.stdin.addEventListener("input", save);
+elements.args.addEventListener("input", save);
+elements.apiKey.addEventListener("change", () => localStorage.setItem("gopg.key", elements.apiKey.value.trim()));
+elements.addFile.addEventListener("click", addFile);
+elements.run.addEventListener("click", () => run(false));
+elements.test.addEventListener("click", () => run(true));
+elements.format.addEventListener("click", format);
+elements.share.addEventListener("click", share);
+
+restore();
+selectFile(0);
+loadShared().then(scheduleCheck);
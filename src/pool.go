@@ -1,23 +1,59 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"./queue"
+)
+
+const (
+
+	//ShutdownTimeout time given to the queued and running jobs to finish on shutdown
+	ShutdownTimeout = 30 * time.Second
+
+	//ShutdownKillGrace time given to the workers to return once their jobs are killed
+	ShutdownKillGrace = 5 * time.Second
+
+	//AdmissionTimeout time a request waits for space in a full work-queue
+	AdmissionTimeout = 2 * time.Second
+
+	//JobDurationWeight weight of the latest job in the average job duration
+	JobDurationWeight float64 = 0.1
 )
 
-//WorkerPool The work pool executor
+//WorkerPool The work pool executor, scaling between config.MinWorkers and config.MaxWorkers
 type WorkerPool struct {
-	queue     *ConcurrentQueue
-	nWorkers  int
+	queue     *queue.Queue[WorkType]
+	config    PoolConfig
 	queueSize int
 
 	workingGroup *sync.WaitGroup
+
+	//aborting set once the shutdown deadline passed, queued jobs are rejected
+	aborting int32
+
+	//statsLock guards the fields below
+	statsLock *sync.Mutex
+
+	nWorkers    int
+	busyWorkers int
+	nextWorker  int
+
+	//stopped set on shutdown, no worker is added afterwards
+	stopped bool
+
+	//avgJobDuration moving average of the job durations
+	avgJobDuration time.Duration
+	decisions      []ScalingDecision
 }
 
-//HandlerFunction handles the http request
-type HandlerFunction func(writer *http.ResponseWriter, reader *http.Request, ch chan<- bool)
+//HandlerFunction handles the http request, ctx is done once the client goes away
+type HandlerFunction func(ctx context.Context, writer *http.ResponseWriter, reader *http.Request, ch chan<- bool)
 
 //WorkType represents the work
 type WorkType struct {
@@ -25,61 +61,277 @@ type WorkType struct {
 	reader  *http.Request
 	handler *HandlerFunction
 	channel chan<- bool
+	ctx     context.Context
+
+	//requestID ID of the request, the job is logged and its container named with it
+	requestID string
+
+	//enqueued time the job entered the queue
+	enqueued time.Time
+
+	//clientKey and priority are used by the scheduling backends
+	clientKey string
+	priority  Priority
 }
 
-func poolWorker(wg *sync.WaitGroup, queue *ConcurrentQueue, idx int) {
-	defer wg.Done()
+//SchedulingKey the client that submitted the work
+func (work WorkType) SchedulingKey() string {
+	return work.clientKey
+}
+
+//SchedulingPriority the priority requested for the work
+func (work WorkType) SchedulingPriority() Priority {
+	return work.priority
+}
 
-	log.Printf("Created worker %d\n", idx)
+func poolWorker(workerPool *WorkerPool, idx int) {
+	defer workerPool.workingGroup.Done()
+
+	slog.Debug("Worker started", "worker", idx)
 
 	for {
-		//wait for job
-		val, err := queue.dequeue()
+		//wait for job, the queue is closed and drained on shutdown
+		idleCtx, cancel := context.WithTimeout(context.Background(), workerPool.poolConfig().IdleTimeout)
+		httpWork, err := workerPool.queue.Dequeue(idleCtx)
+		cancel()
+
+		if err == queue.ErrClosed {
+			slog.Debug("Worker stopped", "worker", idx)
+			return
+		}
+		if err == context.DeadlineExceeded {
+			if workerPool.retireWorker() {
+				slog.Debug("Worker retired", "worker", idx)
+				return
+			}
+			continue
+		}
 		if err != nil {
-			log.Fatal(err)
-			os.Exit(0)
+			slog.Error("Failed to dequeue a job", "worker", idx, "error", err)
+			continue
 		}
 
-		httpWork := val.(WorkType)
+		//the client went away while the job was queued
+		if httpWork.ctx.Err() != nil {
+			slog.Debug("Skipping a job cancelled by its client", "worker", idx, "requestId", httpWork.requestID)
+			httpWork.channel <- true
+			continue
+		}
+
+		if atomic.LoadInt32(&workerPool.aborting) == 1 {
+			sendError(httpWork.writer, CodeShuttingDown, ErrShuttingDown.Error())
+			httpWork.channel <- true
+			continue
+		}
 
-		log.Printf("work processing in progress by worker %d\n", idx)
 		//execute the work function
-		(*httpWork.handler)(httpWork.writer, httpWork.reader, httpWork.channel)
+		start := time.Now()
+		workerPool.markBusy(1)
+		runJob(httpWork, idx)
+		workerPool.markBusy(-1)
+		workerPool.recordJobDuration(time.Since(start))
 	}
 }
 
-//SubmitJob submits a new job to the work-queue
+//runJob runs the handler of the work on worker idx and signals the waiting
+//request once it returns. A panic fails the request rather than the whole process
+func runJob(work WorkType, idx int) {
+	recorder := &statusRecorder{ResponseWriter: *work.writer}
+	var writer http.ResponseWriter = recorder
+
+	summary := &JobSummary{Worker: idx, Queued: time.Since(work.enqueued)}
+	ctx := context.WithValue(work.ctx, jobSummaryContext, summary)
+	start := time.Now()
+
+	//handlers signal when done, the request is released only after they returned
+	done := make(chan bool, 1)
+	defer func() {
+		recovered := recover()
+		if recovered != nil && recovered != http.ErrAbortHandler {
+			answerPanic(recovered, recorder, work.reader)
+		}
+		logJob(work, summary, recorder.Status(), time.Since(start))
+		work.channel <- true
+	}()
+
+	(*work.handler)(ctx, &writer, work.reader, done)
+}
+
+//SubmitJob submits a new job to the work-queue, waiting at most AdmissionTimeout
+//for space. Fails with queue.ErrFull when saturated and queue.ErrClosed once shut down
 func (wokerPool *WorkerPool) SubmitJob(
+	ctx context.Context,
 	w *http.ResponseWriter,
 	r *http.Request,
 	handler *HandlerFunction,
-	channel chan<- bool) {
+	channel chan<- bool) error {
 	work := WorkType{}
 	work.writer = w
 	work.reader = r
 	work.handler = handler
 	work.channel = channel
+	work.ctx = ctx
+	work.requestID = requestID(ctx)
+	work.enqueued = time.Now()
+	work.clientKey = requestClientKey(r)
+	work.priority = requestPriority(r)
+
+	if AdmissionTimeout <= 0 {
+		return wokerPool.queue.TryEnqueue(work)
+	}
 
-	wokerPool.queue.enqueue(work)
+	admissionCtx, cancel := context.WithTimeout(ctx, AdmissionTimeout)
+	defer cancel()
+
+	err := wokerPool.queue.Enqueue(admissionCtx, work)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		//still full after waiting
+		return queue.ErrFull
+	}
 
+	return err
 }
 
-//NewWorkerPool Creates a new workerpool and returns the struct
-func NewWorkerPool(nWorkers int, queueSize int) *WorkerPool {
-	var wg sync.WaitGroup
+func (wokerPool *WorkerPool) recordJobDuration(duration time.Duration) {
+	wokerPool.statsLock.Lock()
+	defer wokerPool.statsLock.Unlock()
+
+	if wokerPool.avgJobDuration == 0 {
+		wokerPool.avgJobDuration = duration
+		return
+	}
 
-	queue := NewConcurrentQueue(uint32(queueSize))
+	wokerPool.avgJobDuration = time.Duration(
+		JobDurationWeight*float64(duration) + (1-JobDurationWeight)*float64(wokerPool.avgJobDuration),
+	)
+}
 
-	for idx := 0; idx < nWorkers; idx++ {
-		wg.Add(1)
-		go poolWorker(&wg, queue, idx)
+func (wokerPool *WorkerPool) markBusy(delta int) {
+	wokerPool.statsLock.Lock()
+	wokerPool.busyWorkers += delta
+	wokerPool.statsLock.Unlock()
+}
+
+//spawnWorkers starts up to count workers without exceeding the maximum, returns the number started
+func (wokerPool *WorkerPool) spawnWorkers(count int) int {
+	wokerPool.statsLock.Lock()
+	defer wokerPool.statsLock.Unlock()
+
+	if wokerPool.stopped {
+		return 0
+	}
+
+	added := 0
+	for added < count && wokerPool.nWorkers < wokerPool.config.MaxWorkers {
+		wokerPool.workingGroup.Add(1)
+		go poolWorker(wokerPool, wokerPool.nextWorker)
+
+		wokerPool.nextWorker++
+		wokerPool.nWorkers++
+		added++
+	}
+
+	return added
+}
+
+//retireWorker lets an idle worker stop if the pool is above its minimum size
+func (wokerPool *WorkerPool) retireWorker() bool {
+	wokerPool.statsLock.Lock()
+	if wokerPool.nWorkers <= wokerPool.config.MinWorkers {
+		wokerPool.statsLock.Unlock()
+		return false
+	}
+
+	wokerPool.nWorkers--
+	workers := wokerPool.nWorkers
+	idleTimeout := wokerPool.config.IdleTimeout
+	wokerPool.statsLock.Unlock()
+
+	wokerPool.recordDecision("retire", workers, "worker idle for "+idleTimeout.String())
+	return true
+}
+
+func (wokerPool *WorkerPool) isStopped() bool {
+	wokerPool.statsLock.Lock()
+	defer wokerPool.statsLock.Unlock()
+
+	return wokerPool.stopped
+}
+
+//RetryAfter estimates the time until a new job could be admitted,
+//based on the queue depth and the average job duration
+func (wokerPool *WorkerPool) RetryAfter() time.Duration {
+	wokerPool.statsLock.Lock()
+	avgJobDuration := wokerPool.avgJobDuration
+	nWorkers := wokerPool.nWorkers
+	wokerPool.statsLock.Unlock()
+
+	if avgJobDuration == 0 {
+		avgJobDuration = time.Second
 	}
+	if nWorkers == 0 {
+		nWorkers = 1
+	}
+
+	depth := int64(wokerPool.queue.Len()) + 1
+	wait := time.Duration(depth * int64(avgJobDuration) / int64(nWorkers))
+
+	if wait < time.Second {
+		return time.Second
+	}
+
+	return wait.Round(time.Second)
+}
+
+//Shutdown stops accepting jobs and waits for the queued and running jobs to
+//finish, jobs still running when ctx expires are killed
+func (wokerPool *WorkerPool) Shutdown(ctx context.Context) error {
+	//no worker may be added while waiting for the working group
+	wokerPool.statsLock.Lock()
+	wokerPool.stopped = true
+	wokerPool.statsLock.Unlock()
+
+	wokerPool.queue.Close()
+
+	done := make(chan bool)
+	go func() {
+		wokerPool.workingGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	slog.Warn("Shutdown deadline passed, killing the remaining jobs")
+	atomic.StoreInt32(&wokerPool.aborting, 1)
+	runningJobs.KillAll()
+
+	select {
+	case <-done:
+	case <-time.After(ShutdownKillGrace):
+		slog.Warn("Workers did not stop after killing their jobs")
+	}
+
+	return ctx.Err()
+}
+
+//NewWorkerPool Creates a new autoscaling workerpool whose queue is ordered by backend and returns the struct
+func NewWorkerPool(config PoolConfig, backend queue.Backend[WorkType]) *WorkerPool {
+	var wg sync.WaitGroup
 
 	workerPool := WorkerPool{}
-	workerPool.queue = queue
+	workerPool.queue = queue.NewWithBackend(backend)
+	workerPool.config = config
 	workerPool.workingGroup = &wg
-	workerPool.nWorkers = nWorkers
-	workerPool.queueSize = queueSize
+	workerPool.queueSize = backend.Cap()
+	workerPool.statsLock = &sync.Mutex{}
+	workerPool.decisions = make([]ScalingDecision, 0)
+
+	workerPool.spawnWorkers(config.MinWorkers)
+	go workerPool.autoscale()
 
 	return &workerPool
 }
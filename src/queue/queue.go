@@ -0,0 +1,349 @@
+//Package queue provides a bounded, generic queue safe for concurrent use.
+//Blocking calls give up when their context is done, and closing the queue
+//wakes up every blocked caller while the queued items can still be drained.
+//The order of the items is decided by a pluggable Backend
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+//ErrClosed returned once the queue is closed, Dequeue returns it only after the queue is drained
+var ErrClosed = errors.New("Queue closed")
+
+//ErrFull returned when an item cannot be enqueued without waiting
+var ErrFull = errors.New("Queue full")
+
+//ErrEmpty returned when an item cannot be dequeued without waiting
+var ErrEmpty = errors.New("Queue empty")
+
+//Backend Backend storage of the queue, decides the order in which items
+//are dequeued. Backends are not safe for concurrent use, Queue serializes access
+type Backend[T any] interface {
+	//Put stores the item, failing with ErrFull when there is no space left
+	Put(item T) error
+
+	//Pop removes the next item, failing with ErrEmpty when there is none
+	Pop() (T, error)
+
+	//Len number of stored items
+	Len() int
+
+	//Cap maximum number of stored items
+	Cap() int
+}
+
+//node storage of queue data
+type node[T any] struct {
+	data T
+	prev *node[T]
+	next *node[T]
+}
+
+//FIFOBackend first-in first-out backend storage, a double linked list
+type FIFOBackend[T any] struct {
+	//Pointers to root and end
+	head *node[T]
+	tail *node[T]
+
+	//keep track of current size
+	size    int
+	maxSize int
+}
+
+func (queue *FIFOBackend[T]) createNode(data T) *node[T] {
+	item := node[T]{}
+	item.data = data
+	item.next = nil
+	item.prev = nil
+
+	return &item
+}
+
+//Put appends the item at the head of the list
+func (queue *FIFOBackend[T]) Put(data T) error {
+	if queue.size >= queue.maxSize {
+		return ErrFull
+	}
+
+	if queue.size == 0 {
+		//new root node
+		node := queue.createNode(data)
+		queue.head = node
+		queue.tail = node
+
+		queue.size++
+
+		return nil
+	}
+
+	//queue non-empty append to head
+	currentHead := queue.head
+	newHead := queue.createNode(data)
+	newHead.next = currentHead
+	currentHead.prev = newHead
+
+	queue.head = newHead
+	queue.size++
+	return nil
+}
+
+//Pop removes the item at the tail of the list
+func (queue *FIFOBackend[T]) Pop() (T, error) {
+	if queue.size == 0 {
+		var empty T
+		return empty, ErrEmpty
+	}
+
+	currentEnd := queue.tail
+	newEnd := currentEnd.prev
+
+	if newEnd != nil {
+		newEnd.next = nil
+	}
+	queue.tail = newEnd
+
+	queue.size--
+	if queue.size == 0 {
+		queue.head = nil
+		queue.tail = nil
+	}
+
+	return currentEnd.data, nil
+}
+
+//Len number of items in the list
+func (queue *FIFOBackend[T]) Len() int {
+	return queue.size
+}
+
+//Cap maximum number of items in the list
+func (queue *FIFOBackend[T]) Cap() int {
+	return queue.maxSize
+}
+
+//NewFIFOBackend creates a first-in first-out backend holding at most maxSize items
+func NewFIFOBackend[T any](maxSize int) *FIFOBackend[T] {
+	backend := FIFOBackend[T]{}
+	backend.size = 0
+	backend.head = nil
+	backend.tail = nil
+	backend.maxSize = maxSize
+
+	return &backend
+}
+
+//Queue bounded concurrent queue, safe for use by multiple goroutines
+type Queue[T any] struct {
+	//mutex lock
+	lock *sync.Mutex
+
+	//empty and full locks
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	//queue storage backend
+	backend Backend[T]
+
+	//closed set once no more items are accepted
+	closed bool
+}
+
+func (q *Queue[T]) isEmpty() bool {
+	return q.backend.Len() == 0
+}
+
+func (q *Queue[T]) isFull() bool {
+	return q.backend.Len() >= q.backend.Cap()
+}
+
+//wakeOnDone wakes up every waiter once ctx is done, the returned function
+//must be called once the wait is over
+func (q *Queue[T]) wakeOnDone(ctx context.Context) func() bool {
+	return context.AfterFunc(ctx, func() {
+		q.lock.Lock()
+		q.notEmpty.Broadcast()
+		q.notFull.Broadcast()
+		q.lock.Unlock()
+	})
+}
+
+//Enqueue waits for space in the queue and enqueues the item. Fails with
+//ErrClosed once the queue is closed, or with the error of ctx once done
+func (q *Queue[T]) Enqueue(ctx context.Context, item T) error {
+	stop := q.wakeOnDone(ctx)
+	defer stop()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.isFull() && !q.closed && ctx.Err() == nil {
+		//wait for empty
+		q.notFull.Wait()
+	}
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if q.isFull() {
+		return ctx.Err()
+	}
+
+	//insert
+	err := q.backend.Put(item)
+	if err == nil {
+		//wake every waiter, a signal could go to a waiter whose context is
+		//done and that leaves, while another one keeps sleeping
+		q.notEmpty.Broadcast()
+	}
+
+	return err
+}
+
+//TryEnqueue enqueues the item without waiting, fails with ErrFull when the queue is full
+func (q *Queue[T]) TryEnqueue(item T) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	if q.isFull() {
+		return ErrFull
+	}
+
+	err := q.backend.Put(item)
+	if err == nil {
+		q.notEmpty.Broadcast()
+	}
+
+	return err
+}
+
+//Dequeue waits for an item and dequeues it. Items queued before closing are
+//still handed out, then it fails with ErrClosed. Fails with the error
+//of ctx once done
+func (q *Queue[T]) Dequeue(ctx context.Context) (T, error) {
+	stop := q.wakeOnDone(ctx)
+	defer stop()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.isEmpty() && !q.closed && ctx.Err() == nil {
+		q.notEmpty.Wait()
+	}
+
+	if q.isEmpty() {
+		var empty T
+		if q.closed {
+			return empty, ErrClosed
+		}
+		return empty, ctx.Err()
+	}
+
+	data, err := q.backend.Pop()
+	if err == nil {
+		//wake every waiter, like Enqueue
+		q.notFull.Broadcast()
+	}
+
+	return data, err
+}
+
+//TryDequeue dequeues an item without waiting, fails with ErrEmpty when
+//the queue is empty, or ErrClosed when it is also closed
+func (q *Queue[T]) TryDequeue() (T, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.isEmpty() {
+		var empty T
+		if q.closed {
+			return empty, ErrClosed
+		}
+		return empty, ErrEmpty
+	}
+
+	data, err := q.backend.Pop()
+	if err == nil {
+		q.notFull.Broadcast()
+	}
+
+	return data, err
+}
+
+//Close stops accepting items and wakes up every blocked caller, closing twice is a no-op
+func (q *Queue[T]) Close() {
+	q.lock.Lock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	q.lock.Unlock()
+}
+
+//Drain removes and returns every queued item, in dequeue order
+func (q *Queue[T]) Drain() []T {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := make([]T, 0, q.backend.Len())
+	for !q.isEmpty() {
+		data, err := q.backend.Pop()
+		if err != nil {
+			break
+		}
+		items = append(items, data)
+	}
+
+	q.notFull.Broadcast()
+	return items
+}
+
+//Len snapshot of the number of queued items
+func (q *Queue[T]) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.backend.Len()
+}
+
+//Cap maximum number of queued items
+func (q *Queue[T]) Cap() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.backend.Cap()
+}
+
+//Closed reports whether Close was called
+func (q *Queue[T]) Closed() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.closed
+}
+
+//New Creates a new first-in first-out queue holding at most capacity items
+func New[T any](capacity int) *Queue[T] {
+	return NewWithBackend[T](NewFIFOBackend[T](capacity))
+}
+
+//NewWithBackend Creates a new queue ordered by the given backend
+func NewWithBackend[T any](backend Backend[T]) *Queue[T] {
+	queue := Queue[T]{}
+
+	//init mutexes
+	queue.lock = &sync.Mutex{}
+	queue.notFull = sync.NewCond(queue.lock)
+	queue.notEmpty = sync.NewCond(queue.lock)
+
+	//init backend
+	queue.backend = backend
+
+	return &queue
+}
@@ -0,0 +1,572 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+//blockedFor time after which a call still waiting is considered blocked
+const blockedFor = 50 * time.Millisecond
+
+//waitResult returns the error sent on done, failing the test if none arrives in time
+func waitResult(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Blocked call was not woken up")
+		return nil
+	}
+}
+
+//assertBlocked fails the test if a result arrives on done before blockedFor
+func assertBlocked(t *testing.T, done <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Call returned %v instead of blocking", err)
+	case <-time.After(blockedFor):
+	}
+}
+
+func TestFIFOOrder(t *testing.T) {
+	q := New[int](3)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := q.Enqueue(ctx, i); err != nil {
+			t.Fatalf("Enqueue(%d) = %v", i, err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		item, err := q.Dequeue(ctx)
+		if err != nil || item != i {
+			t.Fatalf("Dequeue() = %d, %v, want %d", item, err, i)
+		}
+	}
+}
+
+func TestConcurrentEnqueueDequeue(t *testing.T) {
+	const producers = 8
+	const consumers = 8
+	const perProducer = 500
+
+	q := New[int](16)
+	ctx := context.Background()
+
+	var producing sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		producing.Add(1)
+		go func(p int) {
+			defer producing.Done()
+			for i := 0; i < perProducer; i++ {
+				if err := q.Enqueue(ctx, p*perProducer+i); err != nil {
+					t.Errorf("Enqueue() = %v", err)
+					return
+				}
+			}
+		}(p)
+	}
+
+	var lock sync.Mutex
+	received := make([]int, 0, producers*perProducer)
+
+	var consuming sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		consuming.Add(1)
+		go func() {
+			defer consuming.Done()
+			for {
+				item, err := q.Dequeue(ctx)
+				if err == ErrClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("Dequeue() = %v", err)
+					return
+				}
+
+				lock.Lock()
+				received = append(received, item)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	producing.Wait()
+	q.Close()
+	consuming.Wait()
+
+	if len(received) != producers*perProducer {
+		t.Fatalf("Received %d items, want %d", len(received), producers*perProducer)
+	}
+
+	sort.Ints(received)
+	for i, item := range received {
+		if item != i {
+			t.Fatalf("Item %d received as %d, items were lost or duplicated", i, item)
+		}
+	}
+}
+
+func TestCloseWakesBlockedDequeue(t *testing.T) {
+	q := New[int](1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Dequeue(context.Background())
+		done <- err
+	}()
+
+	assertBlocked(t, done)
+	q.Close()
+
+	if err := waitResult(t, done); err != ErrClosed {
+		t.Fatalf("Dequeue() = %v, want ErrClosed", err)
+	}
+}
+
+func TestCloseWakesBlockedEnqueue(t *testing.T) {
+	q := New[int](1)
+	if err := q.TryEnqueue(1); err != nil {
+		t.Fatalf("TryEnqueue() = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Enqueue(context.Background(), 2)
+	}()
+
+	assertBlocked(t, done)
+	q.Close()
+
+	if err := waitResult(t, done); err != ErrClosed {
+		t.Fatalf("Enqueue() = %v, want ErrClosed", err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Len() = %d after a rejected Enqueue, want 1", q.Len())
+	}
+}
+
+func TestDequeueAfterClose(t *testing.T) {
+	q := New[int](4)
+	for i := 0; i < 2; i++ {
+		q.TryEnqueue(i)
+	}
+	q.Close()
+	q.Close()
+
+	if !q.Closed() {
+		t.Fatal("Closed() = false after Close")
+	}
+	if err := q.Enqueue(context.Background(), 3); err != ErrClosed {
+		t.Fatalf("Enqueue() = %v after Close, want ErrClosed", err)
+	}
+	if err := q.TryEnqueue(3); err != ErrClosed {
+		t.Fatalf("TryEnqueue() = %v after Close, want ErrClosed", err)
+	}
+
+	//items queued before closing are still handed out
+	for i := 0; i < 2; i++ {
+		item, err := q.Dequeue(context.Background())
+		if err != nil || item != i {
+			t.Fatalf("Dequeue() = %d, %v, want %d", item, err, i)
+		}
+	}
+
+	if _, err := q.Dequeue(context.Background()); err != ErrClosed {
+		t.Fatalf("Dequeue() = %v on a drained queue, want ErrClosed", err)
+	}
+	if _, err := q.TryDequeue(); err != ErrClosed {
+		t.Fatalf("TryDequeue() = %v on a drained queue, want ErrClosed", err)
+	}
+}
+
+func TestDrainAfterClose(t *testing.T) {
+	q := New[int](4)
+	for i := 0; i < 3; i++ {
+		q.TryEnqueue(i)
+	}
+	q.Close()
+
+	items := q.Drain()
+	if len(items) != 3 {
+		t.Fatalf("Drain() = %v, want 3 items", items)
+	}
+	for i, item := range items {
+		if item != i {
+			t.Fatalf("Drain() = %v, want the dequeue order", items)
+		}
+	}
+
+	if q.Len() != 0 {
+		t.Fatalf("Len() = %d after Drain, want 0", q.Len())
+	}
+	if items := q.Drain(); len(items) != 0 {
+		t.Fatalf("Second Drain() = %v, want no items", items)
+	}
+}
+
+func TestDrainWakesBlockedEnqueue(t *testing.T) {
+	q := New[int](1)
+	q.TryEnqueue(1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Enqueue(context.Background(), 2)
+	}()
+
+	assertBlocked(t, done)
+	if items := q.Drain(); len(items) != 1 || items[0] != 1 {
+		t.Fatalf("Drain() = %v, want [1]", items)
+	}
+
+	if err := waitResult(t, done); err != nil {
+		t.Fatalf("Enqueue() = %v after Drain, want nil", err)
+	}
+	if item, err := q.TryDequeue(); err != nil || item != 2 {
+		t.Fatalf("TryDequeue() = %d, %v, want 2", item, err)
+	}
+}
+
+func TestTryEnqueueFull(t *testing.T) {
+	q := New[int](2)
+
+	for i := 0; i < 2; i++ {
+		if err := q.TryEnqueue(i); err != nil {
+			t.Fatalf("TryEnqueue(%d) = %v", i, err)
+		}
+	}
+
+	if err := q.TryEnqueue(2); err != ErrFull {
+		t.Fatalf("TryEnqueue() = %v on a full queue, want ErrFull", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", q.Len())
+	}
+
+	q.TryDequeue()
+	if err := q.TryEnqueue(2); err != nil {
+		t.Fatalf("TryEnqueue() = %v once space was freed", err)
+	}
+}
+
+func TestTryDequeueEmpty(t *testing.T) {
+	q := New[string](2)
+
+	item, err := q.TryDequeue()
+	if err != ErrEmpty || item != "" {
+		t.Fatalf("TryDequeue() = %q, %v on an empty queue, want ErrEmpty", item, err)
+	}
+
+	q.TryEnqueue("a")
+	if item, err := q.TryDequeue(); err != nil || item != "a" {
+		t.Fatalf("TryDequeue() = %q, %v, want a", item, err)
+	}
+	if _, err := q.TryDequeue(); err != ErrEmpty {
+		t.Fatalf("TryDequeue() = %v once emptied, want ErrEmpty", err)
+	}
+}
+
+func TestDequeueCancelled(t *testing.T) {
+	q := New[int](1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Dequeue(ctx)
+		done <- err
+	}()
+
+	assertBlocked(t, done)
+	cancel()
+
+	if err := waitResult(t, done); err != context.Canceled {
+		t.Fatalf("Dequeue() = %v, want context.Canceled", err)
+	}
+}
+
+func TestEnqueueCancelled(t *testing.T) {
+	q := New[int](1)
+	q.TryEnqueue(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Enqueue(ctx, 2)
+	}()
+
+	assertBlocked(t, done)
+	cancel()
+
+	if err := waitResult(t, done); err != context.Canceled {
+		t.Fatalf("Enqueue() = %v, want context.Canceled", err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Len() = %d after a cancelled Enqueue, want 1", q.Len())
+	}
+}
+
+func TestDequeueTimeout(t *testing.T) {
+	q := New[int](1)
+	ctx, cancel := context.WithTimeout(context.Background(), blockedFor)
+	defer cancel()
+
+	start := time.Now()
+	_, err := q.Dequeue(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue() = %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) < blockedFor {
+		t.Fatalf("Dequeue() returned after %s, before its deadline", time.Since(start))
+	}
+}
+
+func TestEnqueueTimeout(t *testing.T) {
+	q := New[int](1)
+	q.TryEnqueue(1)
+	ctx, cancel := context.WithTimeout(context.Background(), blockedFor)
+	defer cancel()
+
+	if err := q.Enqueue(ctx, 2); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Enqueue() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestDoneContextStillServesReadyItems(t *testing.T) {
+	q := New[int](1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	//a call that does not need to wait succeeds even with a done context
+	if err := q.Enqueue(ctx, 1); err != nil {
+		t.Fatalf("Enqueue() = %v with space left, want nil", err)
+	}
+	if item, err := q.Dequeue(ctx); err != nil || item != 1 {
+		t.Fatalf("Dequeue() = %d, %v with an item queued, want 1", item, err)
+	}
+}
+
+func TestCancelOneOfManyWaiters(t *testing.T) {
+	q := New[int](1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := q.Dequeue(ctx)
+		cancelled <- err
+	}()
+
+	waiting := make(chan error, 1)
+	go func() {
+		item, err := q.Dequeue(context.Background())
+		if err == nil && item != 7 {
+			err = errors.New("unexpected item")
+		}
+		waiting <- err
+	}()
+
+	assertBlocked(t, cancelled)
+	cancel()
+	if err := waitResult(t, cancelled); err != context.Canceled {
+		t.Fatalf("Dequeue() = %v, want context.Canceled", err)
+	}
+
+	//the other waiter keeps waiting and gets the next item
+	assertBlocked(t, waiting)
+	q.TryEnqueue(7)
+	if err := waitResult(t, waiting); err != nil {
+		t.Fatalf("Dequeue() = %v, want 7", err)
+	}
+}
+
+//TestCancelledDequeueRacingLiveWaiter cancels a waiter while an item arrives,
+//the item must reach the cancelled waiter or the live one, never neither
+func TestCancelledDequeueRacingLiveWaiter(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		q := New[int](1)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		cancelled := make(chan error, 1)
+		var cancelledItem int
+		go func() {
+			item, err := q.Dequeue(ctx)
+			cancelledItem = item
+			cancelled <- err
+		}()
+
+		live := make(chan error, 1)
+		var liveItem int
+		go func() {
+			item, err := q.Dequeue(context.Background())
+			liveItem = item
+			live <- err
+		}()
+
+		//let both wait, then race the cancellation with the item
+		time.Sleep(time.Millisecond)
+		go cancel()
+		q.Enqueue(context.Background(), 1)
+
+		if err := waitResult(t, cancelled); err == nil {
+			if cancelledItem != 1 {
+				t.Fatalf("Cancelled Dequeue() = %d, want 1", cancelledItem)
+			}
+			//the cancelled waiter took the item, the live one gets the next
+			q.Enqueue(context.Background(), 2)
+		}
+
+		if err := waitResult(t, live); err != nil || (liveItem != 1 && liveItem != 2) {
+			t.Fatalf("Live Dequeue() = %d, %v after a cancelled waiter left", liveItem, err)
+		}
+		cancel()
+	}
+}
+
+//TestCancelledEnqueueRacingLiveWaiter cancels a waiter while a slot frees up,
+//the slot must go to the cancelled waiter or the live one, never neither
+func TestCancelledEnqueueRacingLiveWaiter(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		q := New[int](1)
+		q.TryEnqueue(0)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		cancelled := make(chan error, 1)
+		go func() {
+			cancelled <- q.Enqueue(ctx, 1)
+		}()
+
+		live := make(chan error, 1)
+		go func() {
+			live <- q.Enqueue(context.Background(), 2)
+		}()
+
+		time.Sleep(time.Millisecond)
+		go cancel()
+		q.Dequeue(context.Background())
+
+		if err := waitResult(t, cancelled); err == nil {
+			//the cancelled waiter took the slot, free another one
+			q.Dequeue(context.Background())
+		}
+
+		if err := waitResult(t, live); err != nil {
+			t.Fatalf("Live Enqueue() = %v after a cancelled waiter left", err)
+		}
+		cancel()
+	}
+}
+
+func TestLenCap(t *testing.T) {
+	q := New[int](3)
+
+	if q.Len() != 0 || q.Cap() != 3 {
+		t.Fatalf("Len(), Cap() = %d, %d, want 0, 3", q.Len(), q.Cap())
+	}
+
+	q.TryEnqueue(1)
+	q.TryEnqueue(2)
+	if q.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", q.Len())
+	}
+
+	q.TryDequeue()
+	if q.Len() != 1 || q.Cap() != 3 {
+		t.Fatalf("Len(), Cap() = %d, %d, want 1, 3", q.Len(), q.Cap())
+	}
+}
+
+func TestLenCapSnapshotsUnderLoad(t *testing.T) {
+	const capacity = 8
+
+	q := New[int](capacity)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var workers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			for ctx.Err() == nil {
+				q.Enqueue(ctx, 1)
+			}
+		}()
+		go func() {
+			defer workers.Done()
+			for ctx.Err() == nil {
+				q.Dequeue(ctx)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		length := q.Len()
+		if length < 0 || length > capacity {
+			t.Errorf("Len() = %d, outside [0, %d]", length, capacity)
+		}
+		if q.Cap() != capacity {
+			t.Errorf("Cap() = %d, want %d", q.Cap(), capacity)
+		}
+	}
+
+	cancel()
+	workers.Wait()
+}
+
+//lifoBackend a last-in first-out backend, checks that Queue follows the order of its backend
+type lifoBackend struct {
+	items   []int
+	maxSize int
+}
+
+func (backend *lifoBackend) Put(item int) error {
+	if len(backend.items) >= backend.maxSize {
+		return ErrFull
+	}
+	backend.items = append(backend.items, item)
+	return nil
+}
+
+func (backend *lifoBackend) Pop() (int, error) {
+	if len(backend.items) == 0 {
+		return 0, ErrEmpty
+	}
+	item := backend.items[len(backend.items)-1]
+	backend.items = backend.items[:len(backend.items)-1]
+	return item, nil
+}
+
+func (backend *lifoBackend) Len() int {
+	return len(backend.items)
+}
+
+func (backend *lifoBackend) Cap() int {
+	return backend.maxSize
+}
+
+func TestCustomBackend(t *testing.T) {
+	q := NewWithBackend[int](&lifoBackend{maxSize: 3})
+
+	for i := 0; i < 3; i++ {
+		q.TryEnqueue(i)
+	}
+	if err := q.TryEnqueue(3); err != ErrFull {
+		t.Fatalf("TryEnqueue() = %v on a full backend, want ErrFull", err)
+	}
+
+	for want := 2; want >= 0; want-- {
+		item, err := q.Dequeue(context.Background())
+		if err != nil || item != want {
+			t.Fatalf("Dequeue() = %d, %v, want %d", item, err, want)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//QuotaFile default file the daily usage is persisted to
+const QuotaFile string = "/tmp/gopg-quotas.json"
+
+//quotaRoutes routes running programs, they count against the daily quotas
+var quotaRoutes = map[string]bool{
+	"/executeJson":   true,
+	"/executeFile":   true,
+	"/executeStream": true,
+}
+
+//tokenBucket holds the tokens of a client, refilled continuously
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//RateLimiter token-bucket rate limiter keyed by client, safe for concurrent use
+type RateLimiter struct {
+	lock    *sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+//RateLimit Represents the state of a client bucket after a request
+type RateLimit struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	//Reset time until the bucket is full again
+	Reset time.Duration
+
+	//RetryAfter time until the next request is allowed, zero when allowed
+	RetryAfter time.Duration
+}
+
+//Allow takes a token from the bucket of client, buckets refill at rate tokens
+//per second and hold at most burst tokens
+func (limiter *RateLimiter) Allow(client string, rate float64, burst int, now time.Time) RateLimit {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	bucket, ok := limiter.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		limiter.buckets[client] = bucket
+	}
+
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed*rate)
+	bucket.last = now
+
+	limit := RateLimit{Limit: burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		limit.Allowed = true
+	} else {
+		limit.RetryAfter = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+
+	limit.Remaining = int(bucket.tokens)
+	limit.Reset = time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+
+	return limit
+}
+
+//Purge forgets the buckets that had time to refill, they are equivalent to new ones
+func (limiter *RateLimiter) Purge(rate float64, burst int, now time.Time) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	for client, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= float64(burst) {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+//NewRateLimiter creates a rate limiter without any bucket
+func NewRateLimiter() *RateLimiter {
+	limiter := RateLimiter{}
+	limiter.lock = &sync.Mutex{}
+	limiter.buckets = make(map[string]*tokenBucket)
+
+	return &limiter
+}
+
+func purgeRateLimits(limiter *RateLimiter, interval time.Duration) {
+	for range time.Tick(interval) {
+		config := currentConfig()
+		limiter.Purge(config.RateLimit, config.RateBurst, time.Now())
+	}
+}
+
+//QuotaUsage Represents the usage of a client on a given day
+type QuotaUsage struct {
+	Executions int     `json:"executions"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+}
+
+//quotaFile Represents the persisted usage
+type quotaFile struct {
+	Day   string                 `json:"day"`
+	Usage map[string]*QuotaUsage `json:"usage"`
+}
+
+//QuotaStore daily usage of every client, persisted to a file. The usage is
+//reset at midnight UTC
+type QuotaStore struct {
+	path string
+
+	lock  *sync.Mutex
+	day   string
+	usage map[string]*QuotaUsage
+	dirty bool
+}
+
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+//untilTomorrow time left until the quotas are reset
+func untilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	return tomorrow.Sub(now)
+}
+
+//rollOver resets the usage on a new day, the caller holds the lock
+func (store *QuotaStore) rollOver(now time.Time) {
+	day := quotaDay(now)
+	if day != store.day {
+		store.day = day
+		store.usage = make(map[string]*QuotaUsage)
+		store.dirty = true
+	}
+}
+
+//QuotaReservation execution and CPU-seconds held for a job between its
+//admission and the end of its run
+type QuotaReservation struct {
+	store  *QuotaStore
+	client string
+	day    string
+
+	//estimate CPU-seconds held until the job is settled
+	estimate float64
+
+	settled  bool
+	released bool
+}
+
+//clientUsage returns the usage of client, the caller holds the lock
+func (store *QuotaStore) clientUsage(client string) *QuotaUsage {
+	usage, ok := store.usage[client]
+	if !ok {
+		usage = &QuotaUsage{}
+		store.usage[client] = usage
+	}
+
+	return usage
+}
+
+//Reserve holds an execution and estimate CPU-seconds of client, failing with
+//a description of the exhausted quota. Concurrent jobs are admitted against
+//the usage reserved by the running ones, zero limits are unlimited
+func (store *QuotaStore) Reserve(client string, maxExecutions int, maxCPUSeconds float64, estimate float64, now time.Time) (*QuotaReservation, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.rollOver(now)
+	usage := store.clientUsage(client)
+
+	if maxExecutions > 0 && usage.Executions >= maxExecutions {
+		return nil, fmt.Errorf("Daily quota of %d executions used", maxExecutions)
+	}
+	if maxCPUSeconds > 0 && usage.CPUSeconds >= maxCPUSeconds {
+		return nil, fmt.Errorf("Daily quota of %g CPU-seconds used", maxCPUSeconds)
+	}
+
+	usage.Executions++
+	usage.CPUSeconds += estimate
+	store.dirty = true
+
+	reservation := QuotaReservation{}
+	reservation.store = store
+	reservation.client = client
+	reservation.day = store.day
+	reservation.estimate = estimate
+
+	return &reservation, nil
+}
+
+//Settle replaces the estimate by the cpuSeconds the job used, once the
+//reservation is released the usage is charged again
+func (reservation *QuotaReservation) Settle(cpuSeconds float64, now time.Time) {
+	store := reservation.store
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if reservation.settled {
+		return
+	}
+
+	store.rollOver(now)
+	usage := store.clientUsage(reservation.client)
+	switch {
+	case reservation.released || reservation.day != store.day:
+		//the reservation was given back or reset at midnight, charge the run
+		usage.Executions++
+		usage.CPUSeconds += cpuSeconds
+	default:
+		usage.CPUSeconds += cpuSeconds - reservation.estimate
+	}
+
+	reservation.settled = true
+	store.dirty = true
+}
+
+//Release gives the reservation back unless it was settled, for the jobs that
+//never ran: rejected, cancelled while queued or served from the result cache
+func (reservation *QuotaReservation) Release(now time.Time) {
+	store := reservation.store
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if reservation.settled || reservation.released {
+		return
+	}
+
+	store.rollOver(now)
+	if reservation.day == store.day {
+		usage := store.clientUsage(reservation.client)
+		usage.Executions--
+		usage.CPUSeconds -= reservation.estimate
+		store.dirty = true
+	}
+
+	reservation.released = true
+}
+
+//Usage returns the usage of client today
+func (store *QuotaStore) Usage(client string, now time.Time) QuotaUsage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.rollOver(now)
+	if usage, ok := store.usage[client]; ok {
+		return *usage
+	}
+
+	return QuotaUsage{}
+}
+
+//Save writes the usage to the quota file if it changed since the last save
+func (store *QuotaStore) Save() error {
+	store.lock.Lock()
+	if !store.dirty || store.path == "" {
+		store.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(&quotaFile{Day: store.day, Usage: store.usage})
+	store.dirty = false
+	store.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	//write then rename, a crash never leaves a partial file
+	temp, err := ioutil.TempFile(filepath.Dir(store.path), ".quotas-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), store.path)
+}
+
+//NewQuotaStore loads today's usage from the quota file, an empty path keeps the usage in memory
+func NewQuotaStore(path string) (*QuotaStore, error) {
+	store := QuotaStore{}
+	store.path = path
+	store.lock = &sync.Mutex{}
+	store.day = quotaDay(time.Now())
+	store.usage = make(map[string]*QuotaUsage)
+
+	if path == "" {
+		return &store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := quotaFile{}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid quota file %s: %v", path, err)
+	}
+
+	//usage of a previous day is dropped
+	if file.Day == store.day && file.Usage != nil {
+		store.usage = file.Usage
+	}
+
+	return &store, nil
+}
+
+func saveQuotas(store *QuotaStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := store.Save()
+		if err != nil {
+			slog.Error("Failed to save the quotas", "error", err)
+		}
+	}
+}
+
+//parseTrustedProxies parses a comma separated list of addresses and CIDR ranges
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func isTrusted(ip net.IP, proxies []*net.IPNet) bool {
+	for _, network := range proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//clientIP returns the address of the client. X-Forwarded-For is only read
+//when the request comes from a trusted proxy, the client is the rightmost
+//address that is not a trusted proxy
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrusted(net.ParseIP(host), proxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for idx := len(forwarded) - 1; idx >= 0; idx-- {
+		address := strings.TrimSpace(forwarded[idx])
+		ip := net.ParseIP(address)
+		if ip == nil {
+			break
+		}
+
+		host = address
+		if !isTrusted(ip, proxies) {
+			break
+		}
+	}
+
+	return host
+}
+
+//clientContext request context value holding the client identity used for limits
+const clientContext contextKey = "client"
+
+//quotaContext request context value holding the *QuotaReservation of a job
+const quotaContext contextKey = "quota"
+
+//requestReservation returns the quota held for a job, nil when the quotas are disabled
+func requestReservation(ctx context.Context) *QuotaReservation {
+	reservation, _ := ctx.Value(quotaContext).(*QuotaReservation)
+	return reservation
+}
+
+//requestClient returns the client a job is accounted to, empty outside of limitRequests
+func requestClient(ctx context.Context) string {
+	client, _ := ctx.Value(clientContext).(string)
+	return client
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit int, remaining int, reset time.Duration) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+}
+
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds()))))
+}
+
+//clientIdentity identifies the client of a request by API key, by client
+//certificate, or else by address. Nothing the client sends picks its identity
+func clientIdentity(r *http.Request, config *Config) string {
+	if key := requestAPIKey(r.Context()); key != nil {
+		return "key:" + key.ID
+	}
+	if name := clientCertificate(r); name != "" {
+		return "cert:" + name
+	}
+
+	return "ip:" + clientIP(r, config.trustedProxies)
+}
+
+//limitRequests rate limits the requests of every client, and refuses programs
+//once the client used its daily quota. Clients are identified by API key, by
+//client certificate, or else by address
+func limitRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		now := time.Now()
+
+		client := clientIdentity(r, config)
+
+		if rateLimiter != nil && config.RateLimit > 0 {
+			limit := rateLimiter.Allow(client, config.RateLimit, config.RateBurst, now)
+			setRateLimitHeaders(w, limit.Limit, limit.Remaining, limit.Reset)
+
+			if !limit.Allowed {
+				w.Header().Set("Retry-After", retryAfterSeconds(limit.RetryAfter))
+				sendError(&w, CodeRateLimited,
+					fmt.Sprintf("Rate limit of %g requests per second exceeded", config.RateLimit))
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), clientContext, client)
+		if quotaStore != nil && quotaRoutes[r.URL.Path] {
+			//the timeout bounds the run, the estimate is settled once it is over
+			reservation, err := quotaStore.Reserve(client, config.DailyExecutions, config.DailyCPUSeconds, config.Timeout.Seconds(), now)
+			if err != nil {
+				reset := untilTomorrow(now)
+				if config.DailyExecutions > 0 {
+					setRateLimitHeaders(w, config.DailyExecutions, 0, reset)
+				}
+				w.Header().Set("Retry-After", retryAfterSeconds(reset))
+				sendError(&w, CodeRateLimited, err.Error()+", the quotas are reset at midnight UTC")
+				return
+			}
+
+			defer func() {
+				reservation.Release(time.Now())
+			}()
+			ctx = context.WithValue(ctx, quotaContext, reservation)
+		}
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+//rateLimiter request rate of every client
+var rateLimiter = NewRateLimiter()
+
+//quotaStore daily usage of every client, nil disables the quotas
+var quotaStore *QuotaStore
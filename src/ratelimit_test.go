@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//useConfig serves the tests with the default configuration changed by change
+func useConfig(t *testing.T, change func(config *Config)) *Config {
+	t.Helper()
+
+	config := DefaultConfig()
+	change(config)
+	err := config.Validate()
+	if err != nil {
+		t.Fatalf("Invalid test configuration: %v", err)
+	}
+
+	previous := serverConfig.Load()
+	serverConfig.Store(config)
+	t.Cleanup(func() {
+		serverConfig.Store(previous)
+	})
+
+	return config
+}
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Now()
+
+	for idx := 0; idx < 3; idx++ {
+		limit := limiter.Allow("ip:a", 2, 3, now)
+		if !limit.Allowed || limit.Remaining != 2-idx {
+			t.Fatalf("Request %d = %+v, want allowed with %d remaining", idx, limit, 2-idx)
+		}
+	}
+
+	limit := limiter.Allow("ip:a", 2, 3, now)
+	if limit.Allowed || limit.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("Request over the burst = %+v, want refused for 500ms", limit)
+	}
+	if limit.Reset != 1500*time.Millisecond {
+		t.Errorf("Reset = %s, want 1.5s to refill 3 tokens", limit.Reset)
+	}
+
+	//other clients have their own bucket
+	if !limiter.Allow("ip:b", 2, 3, now).Allowed {
+		t.Error("Another client was refused")
+	}
+
+	//a token refills every 500ms
+	if !limiter.Allow("ip:a", 2, 3, now.Add(500*time.Millisecond)).Allowed {
+		t.Error("Request after the refill was refused")
+	}
+	if limiter.Allow("ip:a", 2, 3, now.Add(600*time.Millisecond)).Allowed {
+		t.Error("Request before the next refill was allowed")
+	}
+}
+
+func TestTokenBucketCapsAtBurst(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Now()
+
+	limiter.Allow("ip:a", 1, 2, now)
+	later := now.Add(time.Hour)
+
+	allowed := 0
+	for idx := 0; idx < 5; idx++ {
+		if limiter.Allow("ip:a", 1, 2, later).Allowed {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d requests allowed after an idle hour, want the burst of 2", allowed)
+	}
+}
+
+func TestRateLimiterPurge(t *testing.T) {
+	limiter := NewRateLimiter()
+	now := time.Now()
+
+	limiter.Allow("ip:idle", 1, 2, now)
+	limiter.Allow("ip:busy", 1, 2, now.Add(time.Second))
+	limiter.Allow("ip:busy", 1, 2, now.Add(time.Second))
+	limiter.Purge(1, 2, now.Add(2*time.Second))
+
+	if _, ok := limiter.buckets["ip:idle"]; ok {
+		t.Error("Purge() kept a full bucket")
+	}
+	if _, ok := limiter.buckets["ip:busy"]; !ok {
+		t.Error("Purge() forgot a bucket still refilling")
+	}
+}
+
+func TestQuotaReserveSettle(t *testing.T) {
+	store, _ := NewQuotaStore("")
+	now := time.Now()
+
+	reservation, err := store.Reserve("ip:a", 0, 0, 10, now)
+	if err != nil {
+		t.Fatalf("Reserve() = %v", err)
+	}
+	if usage := store.Usage("ip:a", now); usage.Executions != 1 || usage.CPUSeconds != 10 {
+		t.Fatalf("Usage while running = %+v, want 1 execution and the 10s estimate", usage)
+	}
+
+	reservation.Settle(0.5, now)
+	reservation.Settle(3, now)
+	reservation.Release(now)
+	if usage := store.Usage("ip:a", now); usage.Executions != 1 || usage.CPUSeconds != 0.5 {
+		t.Errorf("Usage once settled = %+v, want 1 execution of 0.5s settled once", usage)
+	}
+}
+
+func TestQuotaRelease(t *testing.T) {
+	store, _ := NewQuotaStore("")
+	now := time.Now()
+
+	reservation, _ := store.Reserve("ip:a", 0, 0, 10, now)
+	reservation.Release(now)
+	reservation.Release(now)
+	if usage := store.Usage("ip:a", now); usage.Executions != 0 || usage.CPUSeconds != 0 {
+		t.Fatalf("Usage once released = %+v, want nothing", usage)
+	}
+
+	//a job that ran after its request was released is still charged
+	reservation.Settle(2, now)
+	if usage := store.Usage("ip:a", now); usage.Executions != 1 || usage.CPUSeconds != 2 {
+		t.Errorf("Usage settled after the release = %+v, want 1 execution of 2s", usage)
+	}
+}
+
+func TestQuotaConcurrentReservations(t *testing.T) {
+	store, _ := NewQuotaStore("")
+	now := time.Now()
+
+	//the running jobs hold their executions, a third one is refused
+	store.Reserve("ip:a", 2, 0, 10, now)
+	store.Reserve("ip:a", 2, 0, 10, now)
+	_, err := store.Reserve("ip:a", 2, 0, 10, now)
+	if err == nil || !strings.Contains(err.Error(), "2 executions") {
+		t.Errorf("Third Reserve() = %v, want the executions quota used", err)
+	}
+
+	//and their estimates, the CPU quota is not overshot by more than one job
+	first, _ := store.Reserve("ip:b", 0, 15, 10, now)
+	if _, err := store.Reserve("ip:b", 0, 15, 10, now); err != nil {
+		t.Fatalf("Second Reserve() = %v, want 10 of 15s used", err)
+	}
+	if _, err := store.Reserve("ip:b", 0, 15, 10, now); err == nil {
+		t.Error("Third Reserve() admitted with 20 of 15s reserved")
+	}
+
+	first.Settle(1, now)
+	if _, err := store.Reserve("ip:b", 0, 15, 10, now); err != nil {
+		t.Errorf("Reserve() once a job settled under its estimate = %v", err)
+	}
+}
+
+func TestQuotaReservationAcrossMidnight(t *testing.T) {
+	store, _ := NewQuotaStore("")
+	evening := time.Date(2026, 10, 19, 23, 59, 0, 0, time.UTC)
+	morning := evening.Add(2 * time.Minute)
+
+	reservation, _ := store.Reserve("ip:a", 0, 0, 10, evening)
+	reservation.Settle(4, morning)
+
+	if usage := store.Usage("ip:a", morning); usage.Executions != 1 || usage.CPUSeconds != 4 {
+		t.Errorf("Usage of the new day = %+v, want the run charged once", usage)
+	}
+}
+
+func TestLimitRequestsReleasesRejectedRuns(t *testing.T) {
+	useConfig(t, func(config *Config) {
+		config.DailyExecutions = 1
+	})
+
+	previousStore, previousLimiter := quotaStore, rateLimiter
+	quotaStore, _ = NewQuotaStore("")
+	rateLimiter = NewRateLimiter()
+	t.Cleanup(func() {
+		quotaStore, rateLimiter = previousStore, previousLimiter
+	})
+
+	send := func(handler http.HandlerFunc) int {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", "/executeJson", nil)
+		request.RemoteAddr = "192.0.2.1:1234"
+		limitRequests(handler)(recorder, request)
+		return recorder.Code
+	}
+
+	//a program refused before it ran gives its reservation back
+	rejected := func(w http.ResponseWriter, r *http.Request) {
+		if requestReservation(r.Context()) == nil {
+			t.Error("Program admitted without a reservation")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	for idx := 0; idx < 3; idx++ {
+		if code := send(rejected); code != http.StatusBadRequest {
+			t.Fatalf("Rejected run %d answered %d, want it admitted", idx, code)
+		}
+	}
+
+	ran := func(w http.ResponseWriter, r *http.Request) {
+		requestReservation(r.Context()).Settle(1, time.Now())
+	}
+	if code := send(ran); code != http.StatusOK {
+		t.Fatalf("Run answered %d, want the quota still free", code)
+	}
+	if code := send(ran); code != http.StatusTooManyRequests {
+		t.Errorf("Run over the quota answered %d, want 429", code)
+	}
+}
@@ -1,27 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const (
 
-	//SandboxMemory main memory to be used - 500MB of memory
+	//SandboxMemory default memory limit of the sandbox - 500MB of memory
 	SandboxMemory int = (1 << 20) * 500
 
-	//SandboxTimeout timeout of the sandbox in seconds
+	//SandboxTimeout default timeout of the programs in seconds
 	SandboxTimeout = 10
+
+	//SandboxBuildFlags flags used to build the static binary run inside the sandbox
+	SandboxBuildFlags string = "-ldflags '-w -extldflags \"-static\"'"
+
+	//SandboxImage default image the programs run in
+	SandboxImage string = "sandbox:latest"
 )
 
 //ProgramOutput Represents the output of the program
@@ -29,23 +40,139 @@ type ProgramOutput struct {
 	Success       bool    `json:"success"`
 	Output        string  `json:"output"`
 	ExecutionTime float64 `json:"executionTime"`
+
+	//killed set when the program was killed before finishing, by a timeout
+	//or a shutdown, such outputs are never cached
+	killed bool
+
+	//outcome how the execution ended, see OutcomeSuccess
+	outcome string
 }
 
 //OutputPack Represents the output package
 type OutputPack struct {
 	Error       bool          `json:"error"`
+	ErrorCode   ErrorCode     `json:"errorCode,omitempty"`
 	ErrorString string        `json:"errorString"`
 	Output      ProgramOutput `json:"execution"`
+	Cached      bool          `json:"cached"`
 }
 
 //InputPack Represents input package
 type InputPack struct {
-	Program string `json:"program"`
+	Program string       `json:"program"`
+	Files   []SourceFile `json:"files,omitempty"`
+	Stdin   string       `json:"stdin,omitempty"`
+	Args    []string     `json:"args,omitempty"`
+	Test    bool         `json:"test,omitempty"`
+	GoMod   string       `json:"goMod"`
+	NoCache bool         `json:"noCache"`
 }
 
 //GoRunner compiles and runs a go-program
 type GoRunner struct {
 	programOutput *ProgramOutput
+
+	//ctx cancels the compilation and execution once done
+	ctx context.Context
+
+	//goMod optional go.mod of the program
+	goMod string
+
+	//files additional source files of the program, built along with the main file
+	files []SourceFile
+
+	//stdin standard input of the program
+	stdin string
+
+	//args arguments of the program, test runs the tests of the program instead
+	args []string
+	test bool
+
+	//stream receives the output of the program as it runs, nil when the output is only answered once done
+	stream func([]byte)
+
+	//requestID ID of the request, the sandbox container is named after it
+	requestID string
+
+	//logger logs with the ID of the request
+	logger *slog.Logger
+
+	//compileSeconds and runSeconds time taken by the phases of the job
+	compileSeconds float64
+	runSeconds     float64
+
+	//workspace directory holding the sources of the program
+	workspace string
+
+	//config configuration at the time the job started, reloads do not affect running jobs
+	config *Config
+
+	//cpuSeconds CPU time of the compilation and of an unsandboxed run
+	cpuSeconds float64
+
+	//sandboxWallSeconds wall time of a sandboxed run, the CPU time of the
+	//container is not visible from here
+	sandboxWallSeconds float64
+}
+
+//quotaSeconds seconds counted against the daily CPU-seconds quota
+func (g *GoRunner) quotaSeconds() float64 {
+	return g.cpuSeconds + g.sandboxWallSeconds
+}
+
+//runOutput collects the output of a running program, the writes may come
+//from several goroutines. Writes are forwarded to stream, if set
+type runOutput struct {
+	lock   *sync.Mutex
+	buffer bytes.Buffer
+	stream func([]byte)
+}
+
+func (output *runOutput) Write(data []byte) (int, error) {
+	output.lock.Lock()
+	defer output.lock.Unlock()
+
+	output.buffer.Write(data)
+	if output.stream != nil {
+		output.stream(data)
+	}
+
+	return len(data), nil
+}
+
+func (output *runOutput) String() string {
+	output.lock.Lock()
+	defer output.lock.Unlock()
+
+	return output.buffer.String()
+}
+
+//newRunOutput creates the collector of the output of the program
+func (g *GoRunner) newRunOutput() *runOutput {
+	output := runOutput{}
+	output.lock = &sync.Mutex{}
+	output.stream = g.stream
+
+	return &output
+}
+
+//buildCommand go command building the program, or its test binary
+func (g *GoRunner) buildCommand() []string {
+	if g.test {
+		return []string{"test", "-c"}
+	}
+
+	return []string{"build"}
+}
+
+//programArgs arguments the program is run with, the tests are run verbosely
+func (g *GoRunner) programArgs() []string {
+	if g.test {
+		return append([]string{"-test.v"}, g.args...)
+	}
+
+	return g.args
 }
 
 //B64Mapping mapping of base63 values
@@ -61,7 +188,6 @@ func (g *GoRunner) generateRandonName() (string, error) {
 	_, err := rand.Read(rHolder)
 
 	if err != nil {
-		log.Fatal("Failed to generate randon uuid string")
 		return "", err
 	}
 
@@ -79,59 +205,47 @@ func (g *GoRunner) generateRandonName() (string, error) {
 	return string(mappedString[:]), nil
 }
 
-func (g *GoRunner) isSandboxEnabled() bool {
-	value, exist := os.LookupEnv("SANDBOX")
-
-	fmt.Println(value)
-	if !exist {
-		return false
-	}
-	if value == "1" {
-		return true
-	}
-	return false
+func isSandboxEnabled() bool {
+	return currentConfig().Sandbox
 }
 
 func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 
+	//the binary is named after the source, the directories may contain dots
 	goFileSource := goFile
-	goFile = strings.ReplaceAll(goFile, ".", "_")
-
-	fmt.Println("Binary : " + goFile)
+	goFile = filepath.Join(filepath.Dir(goFile), strings.ReplaceAll(filepath.Base(goFile), ".", "_"))
 
-	command := fmt.Sprintf("go build -ldflags '-w -extldflags \"-static\"' -o %s -i %s\n", goFile, goFileSource)
+	command := fmt.Sprintf("go %s %s -o %s %s\n", strings.Join(g.buildCommand(), " "), SandboxBuildFlags, goFile, strings.Join(g.sourcePaths(goFileSource), " "))
+	g.logger.Debug("Compiling", "command", strings.TrimSpace(command))
 
-	fmt.Printf("Command %s\n", command)
-
-	compiler := exec.Command("/bin/bash", "-c", command)
+	compiler := g.commandContext("", "/bin/bash", "-c", command)
+	g.prepareGoCommand(compiler)
 
 	tstart := time.Now()
-	err := compiler.Run()
+	g.beginBuild()
+	output, err := g.combinedOutput(compiler)
+	g.endBuild()
 	tend := time.Now()
 
 	compileTime := tend.Sub(tstart).Seconds()
 
+	if g.ctx.Err() != nil {
+		g.cleanUp(&goFileSource)
+		return g.onCancel(compileTime)
+	}
+	g.observeCompile(compileTime)
+
 	if err != nil {
-		output, err := compiler.CombinedOutput()
 		outputString := string(output)
 		g.cleanUp(&goFileSource)
-		g.onResult(&outputString, &compileTime, err, false)
+		return g.onCompileError(&outputString, &compileTime, err)
 	}
 
-	containerName := strings.ReplaceAll(goFile, "/", "")
-
-	//compilation is successful, not start the container and pass stdin
-	executor := exec.Command(
-		"docker", "run",
-		"--runtime=runsc",
-		"--memory="+fmt.Sprintf("%d", SandboxMemory),
-		"--name="+containerName,
-		"-i",
-		"sandbox:latest",
-	)
-	executor.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	var outputBuffer strings.Builder
+	//containers are named after the request, the workspace tells apart the jobs of a request
+	containerName := "gopg-" + filepath.Base(g.workspace)
+	if g.requestID != "" {
+		containerName = "gopg-" + g.requestID + "-" + filepath.Base(g.workspace)
+	}
 
 	data, err := ioutil.ReadFile(goFile)
 	if err != nil {
@@ -141,6 +255,24 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 		return g.onResult(&outputString, &compileTime, err, false)
 	}
 
+	//compilation is successful, not start the container and pass stdin
+	executor := g.commandContext(
+		containerName,
+		"docker", append([]string{
+			"run",
+			"--runtime=runsc",
+			"--memory=" + fmt.Sprintf("%d", g.config.MemoryLimitMB<<20),
+			"--name=" + containerName,
+			"-i",
+			g.config.SandboxImage,
+			//the binary is followed by the standard input of the program
+			strconv.Itoa(len(data)),
+		}, g.programArgs()...)...,
+	)
+	executor.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	outputBuffer := g.newRunOutput()
+
 	//attach the stdin and write data to child
 	stdin, err := executor.StdinPipe()
 	if err != nil {
@@ -151,7 +283,7 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 	stdout, err := executor.StdoutPipe()
 
 	if err != nil {
-		fmt.Println(err)
+		g.logger.Error("Failed to attach to the container", "container", containerName, "error", err)
 		outputString := "Failed to run command"
 		g.cleanUp(&goFileSource)
 		g.cleanUp(&goFile)
@@ -161,7 +293,7 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 	stderr, err := executor.StderrPipe()
 
 	if err != nil {
-		fmt.Println(err)
+		g.logger.Error("Failed to attach to the container", "container", containerName, "error", err)
 		outputString := "Failed to run command"
 		g.cleanUp(&goFileSource)
 		g.cleanUp(&goFile)
@@ -179,6 +311,7 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 			syscall.Kill(-pgid, syscall.SIGTERM)
 		}
 
+		runningJobs.untrack(executor)
 		stdout.Close()
 		stderr.Close()
 		g.cleanUp(&goFileSource)
@@ -194,22 +327,53 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 		executionEnd <- err
 	}
 
+	containerStartTime := time.Now()
 	err = executor.Start()
+	if err == nil {
+		//a failure means the server is shutting down, the container is already killed
+		runningJobs.track(executor, containerName)
+	}
 	go processWaiter()
 
-	stdin.Write(data)
+	//the timeout runs while the input is written, a program that never reads
+	//its standard input must not hold the worker once the pipe buffer is full
+	deadline := time.After(g.config.Timeout)
+
+	started := make(chan time.Time, 1)
+	go func() {
+		//the write returns once the container started and read the binary
+		_, err := stdin.Write(data)
+		if err == nil {
+			startedAt := time.Now()
+			serverMetrics.containerStart.Observe(startedAt.Sub(containerStartTime).Seconds())
+			started <- startedAt
+		}
+		if g.stdin != "" {
+			stdin.Write([]byte(g.stdin))
+		}
 
-	//closes the stdin channel properly with EOF
-	stdin.Close()
-	executionStartTime := time.Now()
+		//closes the stdin channel properly with EOF
+		stdin.Close()
+	}()
+
+	//executionStart returns when the container read the binary, the run time
+	//starts then, or when the container started if it never read it
+	executionStart := func() time.Time {
+		select {
+		case startedAt := <-started:
+			started <- startedAt
+			return startedAt
+		default:
+			return containerStartTime
+		}
+	}
 
-	go io.Copy(&outputBuffer, stdout)
-	go io.Copy(&outputBuffer, stderr)
+	go io.Copy(outputBuffer, stdout)
+	go io.Copy(outputBuffer, stderr)
 
 	if err != nil {
-		executionEndTime := time.Now()
-		totalTime := executionEndTime.Sub(executionStartTime).Seconds() + compileTime
-		fmt.Println(err)
+		totalTime := compileTime
+		g.logger.Error("Failed to start the container", "container", containerName, "error", err)
 		outputString := "Failed to execute the container, internal error"
 		childProcessCleaner(false)
 		return g.onResult(&outputString, &totalTime, err, false)
@@ -217,28 +381,223 @@ func (g *GoRunner) sandboxExecute(goFile string) (*ProgramOutput, error) {
 
 	select {
 	case err := <-executionEnd:
-		if err != nil {
+		if g.ctx.Err() != nil {
 			executionEndTime := time.Now()
-			totalTime := executionEndTime.Sub(executionStartTime).Seconds() + compileTime
+			g.sandboxWallSeconds += executionEndTime.Sub(executionStart()).Seconds()
+			totalTime := executionEndTime.Sub(executionStart()).Seconds() + compileTime
+			childProcessCleaner(false)
+			return g.onCancel(totalTime)
+		}
+
+		executionEndTime := time.Now()
+		runTime := executionEndTime.Sub(executionStart()).Seconds()
+		g.observeRun(runTime)
+
+		g.sandboxWallSeconds += runTime
+
+		if err != nil {
+			totalTime := runTime + compileTime
 			outputMessage := "Wait error"
 			childProcessCleaner(false)
-			return g.onResult(&outputMessage, &totalTime, err, true)
+			programOutput, err := g.onResult(&outputMessage, &totalTime, err, true)
+			programOutput.outcome = runOutcome(err, outputBuffer.String())
+			return programOutput, err
 		}
 
 		//executed gracefully
-		executionEndTime := time.Now()
-		totalTime := executionEndTime.Sub(executionStartTime).Seconds() + compileTime
+		totalTime := runTime + compileTime
 		childProcessCleaner(false)
 		result := outputBuffer.String()
-		return g.onResult(&result, &totalTime, nil, true)
-	case <-time.After(SandboxTimeout * time.Second):
+		programOutput, err := g.onResult(&result, &totalTime, nil, true)
+		programOutput.outcome = OutcomeSuccess
+		return programOutput, err
+	case <-deadline:
 		executionEndTime := time.Now()
-		totalTime := executionEndTime.Sub(executionStartTime).Seconds() + compileTime
+		runTime := executionEndTime.Sub(executionStart()).Seconds()
+		g.observeRun(runTime)
+		g.sandboxWallSeconds += runTime
+		totalTime := runTime + compileTime
 		//timeout error
 		outputString := outputBuffer.String() + "\n[Execution Timeout]\n"
 		//terminate and exit
 		childProcessCleaner(true)
-		return g.onResult(&outputString, &totalTime, nil, false)
+		programOutput, err := g.onResult(&outputString, &totalTime, nil, false)
+		programOutput.killed = true
+		programOutput.outcome = OutcomeTimeout
+		return programOutput, err
+	case <-g.ctx.Done():
+		//the container is killed by the command context
+		executionEndTime := time.Now()
+		g.sandboxWallSeconds += executionEndTime.Sub(executionStart()).Seconds()
+		totalTime := executionEndTime.Sub(executionStart()).Seconds() + compileTime
+		childProcessCleaner(false)
+		return g.onCancel(totalTime)
+	}
+}
+
+//executorName how the programs are run, sandbox or local
+func (g *GoRunner) executorName() string {
+	if g.config.Sandbox {
+		return "sandbox"
+	}
+
+	return "local"
+}
+
+//observeCompile records the compile time of the job
+func (g *GoRunner) observeCompile(seconds float64) {
+	g.compileSeconds = seconds
+	serverMetrics.compileDuration.Observe(seconds)
+}
+
+//observeRun records the run time of the job, excluding compilation
+func (g *GoRunner) observeRun(seconds float64) {
+	g.runSeconds = seconds
+	serverMetrics.runDuration.Observe(seconds)
+}
+
+//sourcePaths paths of the main file and of the additional files, in build order
+func (g *GoRunner) sourcePaths(mainFile string) []string {
+	paths := []string{mainFile}
+	for _, file := range g.files {
+		paths = append(paths, filepath.Join(g.workspace, file.Name))
+	}
+
+	return paths
+}
+
+//cacheKey builds the result cache key of the input for the executor in use
+func (g *GoRunner) cacheKey(inputPack *InputPack) *CacheKey {
+	key := CacheKey{}
+	key.Program = inputPack.Program
+	key.Files = inputPack.Files
+	key.Stdin = inputPack.Stdin
+	key.Args = inputPack.Args
+	key.Test = inputPack.Test
+	key.GoMod = inputPack.GoMod
+	key.GoVersion = toolchainVersion()
+	key.Limits = fmt.Sprintf("timeout=%s memory=%dMB", g.config.Timeout, g.config.MemoryLimitMB)
+
+	key.Executor = g.executorName()
+	if g.config.Sandbox {
+		key.BuildOptions = SandboxBuildFlags
+	}
+
+	return &key
+}
+
+//commandContext creates a command killed along with its process group and
+//container, if any, once the runner's context is done
+func (g *GoRunner) commandContext(container string, name string, args ...string) *exec.Cmd {
+	command := exec.CommandContext(g.ctx, name, args...)
+	command.Cancel = func() error {
+		killProcess(command, container)
+		return nil
+	}
+
+	return command
+}
+
+//onCancel reports a job cancelled because the client went away
+func (g *GoRunner) onCancel(timeDiff float64) (*ProgramOutput, error) {
+	outputString := "[Execution Cancelled]"
+	programOutput, _ := g.onResult(&outputString, &timeDiff, nil, false)
+	programOutput.killed = true
+	programOutput.outcome = OutcomeCancelled
+
+	return programOutput, g.ctx.Err()
+}
+
+//onCompileError reports a program that failed to compile
+func (g *GoRunner) onCompileError(output *string, timeDiff *float64, err error) (*ProgramOutput, error) {
+	programOutput, err := g.onResult(output, timeDiff, err, false)
+	programOutput.outcome = OutcomeCompileError
+
+	return programOutput, err
+}
+
+//runOutcome classifies a program that ran until it exited
+func runOutcome(err error, output string) string {
+	if err == nil {
+		return OutcomeSuccess
+	}
+
+	//SIGKILL, sent by the kernel or docker when the memory limit is reached
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 137 {
+		return OutcomeOOM
+	}
+	if strings.Contains(output, "runtime: out of memory") {
+		return OutcomeOOM
+	}
+
+	return OutcomeRuntimeError
+}
+
+//combinedOutput runs the command, returning its output once done
+func (g *GoRunner) combinedOutput(command *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	err := g.run(command, &output)
+
+	return output.Bytes(), err
+}
+
+//run runs the command in its own process group writing its output to output,
+//tracking it so that it can be killed when the server shuts down
+func (g *GoRunner) run(command *exec.Cmd, output io.Writer) error {
+	command.Stdout = output
+	command.Stderr = output
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := command.Start()
+	if err != nil {
+		return err
+	}
+
+	err = runningJobs.track(command, "")
+	if err != nil {
+		command.Wait()
+		return err
+	}
+
+	err = command.Wait()
+	runningJobs.untrack(command)
+
+	//includes the waited-for children, like the compiler run by go build
+	if command.ProcessState != nil {
+		g.cpuSeconds += (command.ProcessState.UserTime() + command.ProcessState.SystemTime()).Seconds()
+	}
+
+	return err
+}
+
+//prepareGoCommand runs the go command inside the workspace, using the shared
+//build and module caches and resolving modules from the local proxy only
+func (g *GoRunner) prepareGoCommand(command *exec.Cmd) {
+	command.Dir = g.workspace
+
+	if buildCache != nil {
+		command.Env = buildCache.Env()
+	} else {
+		command.Env = os.Environ()
+	}
+
+	//never download modules or toolchains
+	command.Env = append(command.Env, "GOPROXY=off", "GOTOOLCHAIN=local")
+	if g.goMod != "" && moduleConfig != nil {
+		command.Env = append(command.Env, moduleConfig.Env()...)
+	}
+}
+
+func (g *GoRunner) beginBuild() {
+	if buildCache != nil {
+		buildCache.BeginBuild()
+	}
+}
+
+func (g *GoRunner) endBuild() {
+	if buildCache != nil {
+		buildCache.EndBuild()
 	}
 }
 
@@ -260,55 +619,121 @@ func (g *GoRunner) onResult(output *string, timeDiff *float64, err error, succes
 func (g *GoRunner) executeTask(goProgram *[]byte) (*ProgramOutput, error) {
 	b63, err := g.generateRandonName()
 	if err != nil {
-		log.Fatal(err)
+		g.logger.Error("Failed to generate a workspace name", "error", err)
+		return nil, err
+	}
+
+	//every program gets its own workspace in /tmp, the go.mod lives next to the source
+	g.workspace = filepath.Join(g.config.TempDir, b63)
+	err = os.Mkdir(g.workspace, 0755)
+	if err != nil {
+		g.logger.Error("Failed to create the workspace", "error", err)
 		return nil, err
 	}
+	runningJobs.addWorkspace(g.workspace)
+	defer runningJobs.removeWorkspace(g.workspace)
 
-	b63GoFile := "/tmp/" + b63 + ".go"
+	b63GoFile := filepath.Join(g.workspace, MainFile)
 
 	//save output to /tmp
 	err = ioutil.WriteFile(b63GoFile, *goProgram, 0666)
 	if err != nil {
-		log.Println(err)
+		g.logger.Error("Failed to write the sources", "workspace", g.workspace, "error", err)
 		return nil, err
 	}
 
-	if g.isSandboxEnabled() {
-		fmt.Println("Sandbox enabled, running in sandbox")
+	for _, file := range g.files {
+		err = ioutil.WriteFile(filepath.Join(g.workspace, file.Name), []byte(file.Content), 0666)
+		if err != nil {
+			g.logger.Error("Failed to write the sources", "workspace", g.workspace, "error", err)
+			return nil, err
+		}
+	}
+
+	if g.goMod != "" {
+		err = ioutil.WriteFile(g.workspace+"/go.mod", []byte(g.goMod), 0666)
+		if err != nil {
+			g.logger.Error("Failed to write the sources", "workspace", g.workspace, "error", err)
+			return nil, err
+		}
+	}
+
+	if g.config.Sandbox {
 		return g.sandboxExecute(b63GoFile)
 	}
 
-	//execute the go-code with stderr and stdout connectors
-	executor := exec.Command("timeout", "10", "go", "run", b63GoFile)
+	//compile and run separately, so that compile errors are told apart from runtime errors
+	binary := g.workspace + "/main"
+	compiler := g.commandContext("", "go", append(append(g.buildCommand(), "-o", binary), g.sourcePaths(b63GoFile)...)...)
+	g.prepareGoCommand(compiler)
 
 	st := time.Now()
-	output, err := executor.CombinedOutput()
-	et := time.Now()
+	g.beginBuild()
+	output, err := g.combinedOutput(compiler)
+	g.endBuild()
+	compileTime := time.Since(st).Seconds()
+
+	if g.ctx.Err() != nil {
+		g.cleanUp(&b63GoFile)
+		return g.onCancel(compileTime)
+	}
+	g.observeCompile(compileTime)
+
+	if err != nil {
+		outputStr := string(output)
+		g.cleanUp(&b63GoFile)
+		return g.onCompileError(&outputStr, &compileTime, err)
+	}
+
+	//execute the binary with stderr and stdout connectors
+	timeout := fmt.Sprintf("%gs", g.config.Timeout.Seconds())
+	executor := g.commandContext("", "timeout", append([]string{timeout, binary}, g.programArgs()...)...)
+	executor.Dir = g.workspace
+	executor.Stdin = strings.NewReader(g.stdin)
+
+	runOutput := g.newRunOutput()
+	rt := time.Now()
+	err = g.run(executor, runOutput)
+	runTime := time.Since(rt).Seconds()
+
+	outputStr := runOutput.String()
 
-	outputStr := string(output)
+	tdiff := compileTime + runTime
 
-	tdiff := et.Sub(st).Seconds()
+	if g.ctx.Err() != nil {
+		g.cleanUp(&b63GoFile)
+		return g.onCancel(tdiff)
+	}
+	g.observeRun(runTime)
 
-	if tdiff >= 10 {
+	if runTime >= g.config.Timeout.Seconds() {
 		errString := "Execution timeout"
 		err = errors.New("Execution timeout error")
 		g.cleanUp(&b63GoFile)
-		return g.onResult(&errString, &tdiff, err, false)
+		programOutput, err := g.onResult(&errString, &tdiff, err, false)
+		programOutput.killed = true
+		programOutput.outcome = OutcomeTimeout
+		return programOutput, err
 	}
 
 	if err != nil {
 		g.cleanUp(&b63GoFile)
-		return g.onResult(&outputStr, &tdiff, err, false)
+		programOutput, err := g.onResult(&outputStr, &tdiff, err, false)
+		programOutput.outcome = runOutcome(err, outputStr)
+		return programOutput, err
 	}
 
 	g.cleanUp(&b63GoFile)
-	return g.onResult(&outputStr, &tdiff, err, true)
+	programOutput, err := g.onResult(&outputStr, &tdiff, err, true)
+	programOutput.outcome = OutcomeSuccess
+	return programOutput, err
 }
 
 //MakeError Returns an  error object
-func MakeError(errString string) *OutputPack {
+func MakeError(code ErrorCode, errString string) *OutputPack {
 	return &OutputPack{
 		Error:       true,
+		ErrorCode:   code,
 		ErrorString: errString,
 		Output: ProgramOutput{
 			Success:       false,
@@ -318,35 +743,104 @@ func MakeError(errString string) *OutputPack {
 	}
 }
 
-//ExecuteTask Executes a program
-func ExecuteTask(inputPack *InputPack) *OutputPack {
+//ExecuteTask Executes a program, the execution is recorded in the audit log
+func ExecuteTask(ctx context.Context, inputPack *InputPack) *OutputPack {
+	//the worker logs what the job did
+	summary := jobSummary(ctx)
+	if summary == nil {
+		summary = &JobSummary{}
+	}
+
+	output := executeInput(ctx, inputPack, summary)
+	auditExecution(ctx, inputPack, output, summary)
+
+	return output
+}
+
+//executeInput runs the program, describing what it did in summary
+func executeInput(ctx context.Context, inputPack *InputPack, summary *JobSummary) *OutputPack {
+	if ctx.Err() != nil {
+		return MakeError(CodeCancelled, "Request cancelled")
+	}
+
 	if inputPack.Program == "" || inputPack.Program == " " {
-		return &OutputPack{
-			Error:       true,
-			ErrorString: "Empty program found",
-			Output: ProgramOutput{
-				Success:       false,
-				Output:        "",
-				ExecutionTime: 0.000,
-			},
+		return MakeError(CodeEmptyProgram, "Empty program found")
+	}
+
+	if inputPack.GoMod != "" {
+		err := moduleConfig.Validate(inputPack.GoMod)
+		if err != nil {
+			return MakeError(CodeInvalidRequest, err.Error())
 		}
 	}
 
 	executor := GoRunner{}
+	executor.ctx = ctx
+	executor.goMod = inputPack.GoMod
+	executor.files = inputPack.Files
+	executor.stdin = inputPack.Stdin
+	executor.args = inputPack.Args
+	executor.test = inputPack.Test
+	executor.stream = outputStream(ctx)
+	executor.requestID = requestID(ctx)
+	executor.logger = requestLogger(ctx)
+	executor.config = currentConfig()
+
+	//the API key may tighten the limits, or refuse to run programs at all
+	if key := requestAPIKey(ctx); key != nil {
+		config, err := key.Policy.Apply(executor.config, toolchainVersion())
+		if err != nil {
+			return MakeError(CodeForbidden, err.Error())
+		}
+		executor.config = config
+	}
+
+	summary.Executor = executor.executorName()
+
+	//look for a previous run of the same program
+	cacheKey := ""
+	cacheable := !inputPack.NoCache
+	for _, source := range inputPack.sources() {
+		cacheable = cacheable && isCacheable(source.Content)
+	}
+	if resultCache != nil && cacheable {
+		cacheKey = executor.cacheKey(inputPack).Hash()
+		if cached, ok := resultCache.Get(cacheKey); ok {
+			//audited and logged with the outcome of the run that was cached
+			summary.Cached = true
+			summary.Outcome = cached.outcome
+			return &OutputPack{
+				Error:       false,
+				ErrorString: "",
+				Output:      *cached,
+				Cached:      true,
+			}
+		}
+	}
 
 	pBytes := []byte(inputPack.Program)
 	programOutput, err := executor.executeTask(&pBytes)
 
+	if reservation := requestReservation(ctx); reservation != nil {
+		reservation.Settle(executor.quotaSeconds(), time.Now())
+	}
+
+	summary.Outcome = OutcomeInternalError
+	if programOutput != nil && programOutput.outcome != "" {
+		summary.Outcome = programOutput.outcome
+	}
+	summary.CompileSeconds = executor.compileSeconds
+	summary.RunSeconds = executor.runSeconds
+	summary.CPUSeconds = executor.cpuSeconds
+	serverMetrics.outcomes.Inc(summary.Outcome)
+
 	if err != nil && programOutput == nil {
-		return &OutputPack{
-			Error:       true,
-			ErrorString: "General execution error",
-			Output: ProgramOutput{
-				Success:       false,
-				Output:        "",
-				ExecutionTime: 0.000,
-			},
-		}
+		return MakeError(CodeInternal, "General execution error")
+	}
+
+	//jobs killed by a shutdown fail in ways that say nothing about the program
+	if cacheKey != "" && isCacheableResult(programOutput, err) && !runningJobs.isKilled() {
+		resultCache.Put(cacheKey, programOutput)
 	}
 
 	return &OutputPack{
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strings"
+
+	"./queue"
+)
+
+//Priority scheduling class of a job, lower values are dequeued first
+type Priority int
+
+const (
+
+	//PriorityInteractive programs run from an editor, someone is waiting for them
+	PriorityInteractive Priority = iota
+
+	//PriorityGrading programs run to grade tests
+	PriorityGrading
+
+	//PriorityBatch bulk submissions from scripts
+	PriorityBatch
+
+	numPriorities
+)
+
+//ErrClientQueueFull returned when a single client holds its share of the queue
+var ErrClientQueueFull = errors.New("Too many programs queued by this client")
+
+//priorityNames names used by the X-Priority header
+var priorityNames = map[string]Priority{
+	"interactive": PriorityInteractive,
+	"grading":     PriorityGrading,
+	"batch":       PriorityBatch,
+}
+
+//ParsePriority parses a priority name, unknown names fall back to the given priority
+func ParsePriority(name string, fallback Priority) Priority {
+	priority, ok := priorityNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return fallback
+	}
+
+	return priority
+}
+
+//Schedulable implemented by the items queued in a FairShareBackend
+type Schedulable interface {
+	//SchedulingKey identifies the client the item belongs to
+	SchedulingKey() string
+
+	//SchedulingPriority class of the item
+	SchedulingPriority() Priority
+}
+
+//fairClass round-robins between the clients of a single priority
+type fairClass[T Schedulable] struct {
+	//clients maps every client with queued items to its FIFO of items
+	clients map[string]*queue.FIFOBackend[T]
+
+	//order clients in round-robin order, the front is served next
+	order *list.List
+}
+
+//FairShareBackend serves priorities strictly in order and, within a
+//priority, round-robins between clients so that none can starve the others
+type FairShareBackend[T Schedulable] struct {
+	classes [numPriorities]*fairClass[T]
+
+	//perClient items held by each client, across priorities
+	perClient map[string]int
+
+	size         int
+	maxSize      int
+	maxPerClient int
+}
+
+//Put queues the item behind the other items of its client and priority
+func (backend *FairShareBackend[T]) Put(item T) error {
+	if backend.size >= backend.maxSize {
+		return queue.ErrFull
+	}
+
+	key := item.SchedulingKey()
+	if backend.maxPerClient > 0 && backend.perClient[key] >= backend.maxPerClient {
+		return ErrClientQueueFull
+	}
+
+	priority := item.SchedulingPriority()
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityBatch
+	}
+
+	class := backend.classes[priority]
+	items, ok := class.clients[key]
+	if !ok {
+		//the per-client limit is enforced above, the client FIFO only needs to fit the queue
+		items = queue.NewFIFOBackend[T](backend.maxSize)
+		class.clients[key] = items
+		class.order.PushBack(key)
+	}
+
+	items.Put(item)
+	backend.perClient[key]++
+	backend.size++
+
+	return nil
+}
+
+//Pop removes the next item of the highest non-empty priority, taking turns between clients
+func (backend *FairShareBackend[T]) Pop() (T, error) {
+	for _, class := range backend.classes {
+		if class.order.Len() == 0 {
+			continue
+		}
+
+		front := class.order.Front()
+		key := front.Value.(string)
+		items := class.clients[key]
+		data, _ := items.Pop()
+
+		//the client goes to the back of the line, or leaves it
+		if items.Len() == 0 {
+			class.order.Remove(front)
+			delete(class.clients, key)
+		} else {
+			class.order.MoveToBack(front)
+		}
+
+		backend.perClient[key]--
+		if backend.perClient[key] == 0 {
+			delete(backend.perClient, key)
+		}
+		backend.size--
+
+		return data, nil
+	}
+
+	var empty T
+	return empty, queue.ErrEmpty
+}
+
+//Len number of queued items, across priorities
+func (backend *FairShareBackend[T]) Len() int {
+	return backend.size
+}
+
+//Cap maximum number of queued items
+func (backend *FairShareBackend[T]) Cap() int {
+	return backend.maxSize
+}
+
+//NewFairShareBackend creates a fair-share backend holding at most maxSize
+//items, of which at most maxPerClient per client, zero disables the per-client limit
+func NewFairShareBackend[T Schedulable](maxSize int, maxPerClient int) *FairShareBackend[T] {
+	backend := FairShareBackend[T]{}
+	backend.maxSize = maxSize
+	backend.maxPerClient = maxPerClient
+	backend.perClient = make(map[string]int)
+
+	for idx := range backend.classes {
+		backend.classes[idx] = &fairClass[T]{
+			clients: make(map[string]*queue.FIFOBackend[T]),
+			order:   list.New(),
+		}
+	}
+
+	return &backend
+}
+
+//requestClientKey identifies the client of a request like limitRequests does
+func requestClientKey(r *http.Request) string {
+	if client := requestClient(r.Context()); client != "" {
+		return client
+	}
+
+	return clientIdentity(r, currentConfig())
+}
+
+//defaultPriority priority of a request as derived by the server: tests are run
+//to grade them, every other program has someone waiting on it. Scripts opt
+//into batch with X-Priority
+func defaultPriority(r *http.Request) Priority {
+	if input := requestInput(r.Context()); input != nil && input.Test {
+		return PriorityGrading
+	}
+
+	return PriorityInteractive
+}
+
+//requestPriority returns the priority the request is queued with. The X-Priority
+//header asks for a priority, granted when it is not higher than the default
+//priority or than the maxPriority of the policy of the API key
+func requestPriority(r *http.Request) Priority {
+	priority := defaultPriority(r)
+
+	highest := priority
+	if key := requestAPIKey(r.Context()); key != nil && key.Policy.MaxPriority != "" {
+		allowed := ParsePriority(key.Policy.MaxPriority, highest)
+		if allowed < highest {
+			highest = allowed
+		}
+	}
+
+	requested := ParsePriority(r.Header.Get("X-Priority"), priority)
+	if requested < highest {
+		return highest
+	}
+
+	return requested
+}
@@ -1,48 +1,304 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"./queue"
 )
 
-//Routes Defines all routes
-var Routes map[string](*HandlerFunction)
+//Middleware wraps a handler, to run code before and after it or to answer in its place
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+//chain wraps handler in middleware, the first middleware runs first
+func chain(handler http.HandlerFunc, middleware ...Middleware) http.HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+//route Represents a registered route, a pattern like /p/{id} or /files/{path...}
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.HandlerFunc
+
+	//operation and middleware describe the route in the OpenAPI document
+	operation  Operation
+	middleware []Middleware
+}
+
+//parseSegments splits a pattern into segments, wildcards are kept as {name} and {name...}
+func parseSegments(pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("Route %q must start with /", pattern)
+	}
+
+	segments := strings.Split(pattern[1:], "/")
+	names := make(map[string]bool)
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") {
+			if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("Route %q: a wildcard must be a whole segment", pattern)
+			}
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(segment, "{"), "}"), "...")
+		if !strings.HasSuffix(segment, "}") || name == "" || strings.ContainsAny(name, "{}") {
+			return nil, fmt.Errorf("Route %q: invalid wildcard %s", pattern, segment)
+		}
+		if strings.HasSuffix(segment, "...}") && i != len(segments)-1 {
+			return nil, fmt.Errorf("Route %q: %s must be the last segment", pattern, segment)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Route %q: wildcard %s is used twice", pattern, name)
+		}
+		names[name] = true
+	}
+
+	return segments, nil
+}
+
+//match returns the path parameters when the route matches the segments of a path
+func (route *route) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+
+	for i, segment := range route.segments {
+		if strings.HasSuffix(segment, "...}") {
+			params[segment[1:len(segment)-4]] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+
+		if i >= len(segments) {
+			return nil, false
+		}
 
-//RoutesHandler handles routes
+		if strings.HasPrefix(segment, "{") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+
+	return params, len(segments) == len(route.segments)
+}
+
+//literals number of literal segments, the route with the most of them wins when several match
+func (route *route) literals() int {
+	count := 0
+	for _, segment := range route.segments {
+		if !strings.HasPrefix(segment, "{") {
+			count++
+		}
+	}
+
+	return count
+}
+
+//RoutesHandler routes requests by method and path, through a middleware chain
 type RoutesHandler struct {
-	routes   *map[string](*HandlerFunction)
-	workPool *WorkerPool
+	routes     []*route
+	middleware []Middleware
+	workPool   *WorkerPool
 }
 
-//RegisterRoute Registers a URL Route
-func (rh *RoutesHandler) RegisterRoute(route string, fun func(w *http.ResponseWriter, r *http.Request, c chan<- bool)) {
-	handle := HandlerFunction(fun)
-	fmt.Println(&handle)
-	(*rh.routes)[route] = &handle
+//Use adds middleware run for every request, including the ones matching no route
+func (rh *RoutesHandler) Use(middleware ...Middleware) {
+	rh.middleware = append(rh.middleware, middleware...)
 }
 
-//Dispatch Dispatches a task from the map to work-queue
-func (rh *RoutesHandler) Dispatch(w http.ResponseWriter, r *http.Request) {
-	uri := r.URL.EscapedPath()
+//Handle registers a handler answering method requests to pattern directly,
+//segments like {id} match a single path segment and {path...} the rest of the path.
+//Path parameters are read with r.PathValue. The route is documented by operation
+func (rh *RoutesHandler) Handle(method string, pattern string, operation Operation, handler http.HandlerFunc, middleware ...Middleware) {
+	segments, err := parseSegments(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, registered := range rh.routes {
+		if registered.method == method && registered.pattern == pattern {
+			panic(fmt.Sprintf("Route %s %s is registered twice", method, pattern))
+		}
+	}
+
+	newRoute := route{}
+	newRoute.method = method
+	newRoute.pattern = pattern
+	newRoute.segments = segments
+	newRoute.handler = chain(handler, middleware...)
+	newRoute.operation = operation
+	newRoute.middleware = middleware
+
+	rh.routes = append(rh.routes, &newRoute)
+}
 
-	handler, ok := (*rh.routes)[uri]
-	if !ok {
-		fmt.Fprintf(w, "<h4>Not found</h4>")
-	} else {
+//Queue registers a handler run by the worker pool, see Handle
+func (rh *RoutesHandler) Queue(method string, pattern string, operation Operation, fun HandlerFunction, middleware ...Middleware) {
+	handler := &fun
+	rh.Handle(method, pattern, operation, func(w http.ResponseWriter, r *http.Request) {
 		dataChannel := make(chan bool)
-		rh.workPool.SubmitJob(&w, r, handler, dataChannel)
+		err := rh.workPool.SubmitJob(r.Context(), &w, r, handler, dataChannel)
+		if err != nil {
+			rh.reject(w, r, err)
+			return
+		}
 
 		<-dataChannel
+	}, middleware...)
+}
+
+//Route Describes a registered route, as listed by Routes
+type Route struct {
+	Method    string
+	Pattern   string
+	Operation Operation
+
+	//Middleware run before the handler of the route, in order
+	Middleware []Middleware
+}
+
+//Routes lists the registered routes, in registration order
+func (rh *RoutesHandler) Routes() []Route {
+	routes := make([]Route, 0, len(rh.routes))
+	for _, registered := range rh.routes {
+		routes = append(routes, Route{
+			Method:     registered.method,
+			Pattern:    registered.pattern,
+			Operation:  registered.operation,
+			Middleware: registered.middleware,
+		})
 	}
+
+	return routes
 }
 
-//NewRouteHandler create a new route handler
-func NewRouteHandler(nWorkers int, queueSize int) *RoutesHandler {
-	routesHandler := RoutesHandler{}
+//ServeHTTP routes the request, r.Pattern holds the matched pattern and stays
+//empty when no route matches
+func (rh *RoutesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	chain(rh.route(r), rh.middleware...)(w, r)
+}
+
+//route finds the handler of the request and sets its pattern and path parameters
+func (rh *RoutesHandler) route(r *http.Request) http.HandlerFunc {
+	path := r.URL.EscapedPath()
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err == nil {
+			segments[i] = unescaped
+		}
+	}
+
+	var matched *route
+	var matchedParams map[string]string
+	allowed := make(map[string]bool)
+
+	for _, candidate := range rh.routes {
+		params, ok := candidate.match(segments)
+		if !ok {
+			continue
+		}
+
+		allowed[candidate.method] = true
+		if candidate.method == "GET" {
+			allowed["HEAD"] = true
+		}
 
-	handlerMap := make(map[string](*HandlerFunction))
-	routesHandler.routes = &handlerMap
-	routesHandler.workPool = NewWorkerPool(nWorkers, queueSize)
+		//HEAD requests are answered by the GET route unless one is registered for HEAD
+		if candidate.method != r.Method && !(r.Method == "HEAD" && candidate.method == "GET") {
+			continue
+		}
+		if matched == nil || candidate.literals() > matched.literals() ||
+			(candidate.literals() == matched.literals() && candidate.method == r.Method && matched.method != r.Method) {
+			matched = candidate
+			matchedParams = params
+		}
+	}
+
+	if matched != nil {
+		r.Pattern = matched.pattern
+		for name, value := range matchedParams {
+			r.SetPathValue(name, value)
+		}
+		return matched.handler
+	}
+
+	if len(allowed) > 0 {
+		methods := make([]string, 0, len(allowed))
+		for method := range allowed {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			sendError(&w, CodeMethodNotAllowed, fmt.Sprintf("Method %s not allowed for %s", r.Method, path))
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		sendError(&w, CodeNotFound, fmt.Sprintf("No route for %s", path))
+	}
+}
+
+//reject answers a request that could not be admitted to the work-queue
+func (rh *RoutesHandler) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		//the client is gone
+		return
+	}
+
+	retryAfter := int(rh.workPool.RetryAfter().Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	if err == queue.ErrClosed {
+		sendError(&w, CodeShuttingDown, ErrShuttingDown.Error())
+		return
+	}
+
+	if err == ErrClientQueueFull {
+		sendError(&w, CodeQueueFull,
+			fmt.Sprintf("%s, retry after %d seconds", err.Error(), retryAfter))
+		return
+	}
+
+	sendError(&w, CodeQueueFull,
+		fmt.Sprintf("Too many programs queued, retry after %d seconds", retryAfter))
+}
+
+//Shutdown drains the work-queue, see WorkerPool.Shutdown
+func (rh *RoutesHandler) Shutdown(ctx context.Context) error {
+	return rh.workPool.Shutdown(ctx)
+}
+
+//Reconfigure applies new worker bounds, see WorkerPool.Reconfigure
+func (rh *RoutesHandler) Reconfigure(config PoolConfig) {
+	rh.workPool.Reconfigure(config)
+}
+
+//Status returns the state of the worker pool, see WorkerPool.Status
+func (rh *RoutesHandler) Status() *PoolStatus {
+	return rh.workPool.Status()
+}
+
+//NewRouteHandler create a new route handler, jobs are queued in backend and
+//run by a worker pool scaled according to config
+func NewRouteHandler(config PoolConfig, backend queue.Backend[WorkType]) *RoutesHandler {
+	routesHandler := RoutesHandler{}
+	routesHandler.workPool = NewWorkerPool(config, backend)
 
 	return &routesHandler
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//newRoutingTestRouter registers routes answering with their pattern and path parameters
+func newRoutingTestRouter() *RoutesHandler {
+	router := NewRouteHandler(DefaultConfig().PoolConfig(), NewFairShareBackend[WorkType](1, 1))
+
+	answer := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Pattern", r.Pattern)
+		w.Header().Set("X-Id", r.PathValue("id"))
+		w.Header().Set("X-Path", r.PathValue("path"))
+	}
+
+	router.Handle("GET", "/p/{id}", Operation{ID: "getSnippet"}, answer)
+	router.Handle("GET", "/p/latest", Operation{ID: "latestSnippet"}, answer)
+	router.Handle("DELETE", "/p/{id}", Operation{ID: "deleteSnippet"}, answer)
+	router.Handle("GET", "/files/{path...}", Operation{ID: "getFile"}, answer)
+	router.Handle("PUT", "/files/{id}/meta", Operation{ID: "putMeta"}, answer)
+
+	return router
+}
+
+//routeRequest sends a request without a body through router
+func routeRequest(router *RoutesHandler, method string, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder
+}
+
+func TestRouterMatches(t *testing.T) {
+	router := newRoutingTestRouter()
+
+	cases := []struct {
+		method  string
+		path    string
+		pattern string
+		id      string
+		rest    string
+	}{
+		{"GET", "/p/abcdefghij", "/p/{id}", "abcdefghij", ""},
+		{"DELETE", "/p/abcdefghij", "/p/{id}", "abcdefghij", ""},
+		{"HEAD", "/p/abcdefghij", "/p/{id}", "abcdefghij", ""},
+		{"GET", "/p/a%20b", "/p/{id}", "a b", ""},
+
+		//the route with the most literal segments wins
+		{"GET", "/p/latest", "/p/latest", "", ""},
+
+		//{path...} matches the rest of the path, including nothing
+		{"GET", "/files/a/b/c.go", "/files/{path...}", "", "a/b/c.go"},
+		{"GET", "/files/", "/files/{path...}", "", ""},
+		{"GET", "/files", "/files/{path...}", "", ""},
+		{"GET", "/files/a%2Fb", "/files/{path...}", "", "a/b"},
+		{"PUT", "/files/util/meta", "/files/{id}/meta", "util", ""},
+	}
+
+	for _, c := range cases {
+		recorder := routeRequest(router, c.method, c.path)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s %s answered %d, want 200", c.method, c.path, recorder.Code)
+			continue
+		}
+
+		header := recorder.Header()
+		if header.Get("X-Pattern") != c.pattern || header.Get("X-Id") != c.id || header.Get("X-Path") != c.rest {
+			t.Errorf("%s %s matched %s with id %q and path %q, want %s with %q and %q", c.method, c.path,
+				header.Get("X-Pattern"), header.Get("X-Id"), header.Get("X-Path"), c.pattern, c.id, c.rest)
+		}
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := newRoutingTestRouter()
+
+	for _, path := range []string{"/", "/p", "/p/", "/p/abcdefghij/more", "/other"} {
+		recorder := routeRequest(router, "GET", path)
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("GET %s answered %d, want 404", path, recorder.Code)
+		}
+		if recorder.Header().Get("Allow") != "" {
+			t.Errorf("GET %s answered Allow: %s, want no Allow header", path, recorder.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	router := newRoutingTestRouter()
+
+	cases := map[string]string{
+		"/p/abcdefghij":    "DELETE, GET, HEAD",
+		"/p/latest":        "DELETE, GET, HEAD",
+		"/files/util/meta": "GET, HEAD, PUT",
+	}
+
+	for path, allow := range cases {
+		recorder := routeRequest(router, "POST", path)
+		if recorder.Code != http.StatusMethodNotAllowed {
+			t.Errorf("POST %s answered %d, want 405", path, recorder.Code)
+		}
+		if recorder.Header().Get("Allow") != allow {
+			t.Errorf("POST %s answered Allow: %s, want %s", path, recorder.Header().Get("Allow"), allow)
+		}
+	}
+}
+
+func TestParseSegmentsRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"p/{id}", "/p/x{id}", "/p/{}", "/p/{id", "/{path...}/more", "/{id}/{id}"} {
+		if _, err := parseSegments(pattern); err == nil {
+			t.Errorf("parseSegments(%q) = nil, want an error", pattern)
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	order := ""
+	middleware := func(name string) Middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				order += name
+				next(w, r)
+			}
+		}
+	}
+
+	router := NewRouteHandler(DefaultConfig().PoolConfig(), NewFairShareBackend[WorkType](1, 1))
+	router.Use(middleware("a"))
+	router.Handle("GET", "/", Operation{ID: "root"}, func(w http.ResponseWriter, r *http.Request) {
+		order += "handler"
+	}, middleware("b"), middleware("c"))
+
+	routeRequest(router, "GET", "/")
+	if order != "abchandler" {
+		t.Errorf("Ran %s, want abchandler", order)
+	}
+
+	//the router middleware also runs for requests matching no route
+	order = ""
+	routeRequest(router, "GET", "/missing")
+	if order != "a" {
+		t.Errorf("Ran %s for a missing route, want a", order)
+	}
+}
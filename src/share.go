@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+
+	//SnippetIDLength number of characters in a snippet ID
+	SnippetIDLength = 11
+
+	//SnippetMaxSize default maximum size of a shared program - 64KB
+	SnippetMaxSize int = 64 << 10
+
+	//SnippetExpiry default time after which a shared program is removed - 90 days
+	SnippetExpiry = 90 * 24 * time.Hour
+
+	//SnippetDir default directory of the filesystem snippet store
+	SnippetDir string = "/tmp/gopg-snippets"
+)
+
+//ErrSnippetNotFound returned when the snippet does not exist or has expired
+var ErrSnippetNotFound = errors.New("Snippet not found")
+
+//ErrSnippetTooLarge returned when the program exceeds the configured size limit
+var ErrSnippetTooLarge = errors.New("Snippet too large")
+
+//ErrSnippetEmpty returned when the program is empty
+var ErrSnippetEmpty = errors.New("Empty program found")
+
+//ErrSnippetCollision returned when another program is shared with the same ID,
+//IDs keep about 51 bits of the digest of the program
+var ErrSnippetCollision = errors.New("Another program is shared with the same ID")
+
+//Snippet Represents a shared program
+type Snippet struct {
+	ID      string    `json:"id"`
+	Program string    `json:"program"`
+	Created time.Time `json:"created"`
+}
+
+//SnippetLimits limits applied by the snippet stores
+type SnippetLimits struct {
+	//MaxSize maximum size of a program in bytes
+	MaxSize int
+
+	//Expiry lifetime of a snippet, zero keeps snippets forever
+	Expiry time.Duration
+}
+
+//SnippetStore storage backend of the shared programs
+type SnippetStore interface {
+	//Put stores the program and returns the stored snippet
+	Put(program string) (*Snippet, error)
+
+	//Get returns the snippet with the given ID
+	Get(id string) (*Snippet, error)
+
+	//Purge removes expired snippets
+	Purge() error
+}
+
+//SnippetID computes the content-addressed ID of a program
+func SnippetID(program string) string {
+	digest := sha256.Sum256([]byte(program))
+
+	mappedString := make([]byte, 0, SnippetIDLength)
+
+	//map to alphabets range, 8 bytes of the digest give enough letters
+	rInt := binary.BigEndian.Uint64(digest[:8])
+	for len(mappedString) < SnippetIDLength {
+		rem := rInt % 26
+		rInt = rInt / 26
+		mappedString = append(mappedString, B64Mapping[rem])
+	}
+
+	return string(mappedString)
+}
+
+//isValidSnippetID checks that id could have been produced by SnippetID
+func isValidSnippetID(id string) bool {
+	if len(id) != SnippetIDLength {
+		return false
+	}
+
+	for idx := 0; idx < len(id); idx++ {
+		if !strings.ContainsRune(B64Mapping, rune(id[idx])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (limits *SnippetLimits) newSnippet(program string) (*Snippet, error) {
+	if strings.TrimSpace(program) == "" {
+		return nil, ErrSnippetEmpty
+	}
+
+	if limits.MaxSize > 0 && len(program) > limits.MaxSize {
+		return nil, ErrSnippetTooLarge
+	}
+
+	snippet := Snippet{}
+	snippet.ID = SnippetID(program)
+	snippet.Program = program
+	snippet.Created = time.Now().UTC()
+
+	return &snippet, nil
+}
+
+func (limits *SnippetLimits) isExpired(snippet *Snippet) bool {
+	if limits.Expiry <= 0 {
+		return false
+	}
+
+	return time.Since(snippet.Created) > limits.Expiry
+}
+
+//MemorySnippetStore keeps snippets in memory, used for tests and ephemeral setups
+type MemorySnippetStore struct {
+	lock     *sync.RWMutex
+	limits   SnippetLimits
+	snippets map[string]*Snippet
+}
+
+//Put stores the program in memory, re-sharing a program refreshes its expiry
+func (store *MemorySnippetStore) Put(program string) (*Snippet, error) {
+	snippet, err := store.limits.newSnippet(program)
+	if err != nil {
+		return nil, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	existing, ok := store.snippets[snippet.ID]
+	if ok && existing.Program != program && !store.limits.isExpired(existing) {
+		return nil, ErrSnippetCollision
+	}
+	store.snippets[snippet.ID] = snippet
+
+	return snippet, nil
+}
+
+//Get returns the snippet from memory
+func (store *MemorySnippetStore) Get(id string) (*Snippet, error) {
+	store.lock.RLock()
+	snippet, ok := store.snippets[id]
+	store.lock.RUnlock()
+
+	if !ok || store.limits.isExpired(snippet) {
+		return nil, ErrSnippetNotFound
+	}
+
+	return snippet, nil
+}
+
+//Purge removes the expired snippets from memory
+func (store *MemorySnippetStore) Purge() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for id, snippet := range store.snippets {
+		if store.limits.isExpired(snippet) {
+			delete(store.snippets, id)
+		}
+	}
+
+	return nil
+}
+
+//NewMemorySnippetStore creates an in-memory snippet store
+func NewMemorySnippetStore(limits SnippetLimits) *MemorySnippetStore {
+	store := MemorySnippetStore{}
+	store.lock = &sync.RWMutex{}
+	store.limits = limits
+	store.snippets = make(map[string]*Snippet)
+
+	return &store
+}
+
+//FileSnippetStore keeps every snippet as a JSON file inside a directory
+type FileSnippetStore struct {
+	dir    string
+	limits SnippetLimits
+
+	//lock serializes the writers, a collision is checked before replacing a snippet
+	lock *sync.Mutex
+}
+
+func (store *FileSnippetStore) path(id string) string {
+	return filepath.Join(store.dir, id+".json")
+}
+
+//Put writes the program to the store directory, re-sharing a program refreshes its expiry
+func (store *FileSnippetStore) Put(program string) (*Snippet, error) {
+	snippet, err := store.limits.newSnippet(program)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(snippet)
+	if err != nil {
+		return nil, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	existing, err := store.Get(snippet.ID)
+	if err == nil && existing.Program != program {
+		return nil, ErrSnippetCollision
+	}
+
+	//write to a temporary file and rename, readers never see partial snippets
+	tmpFile, err := ioutil.TempFile(store.dir, snippet.ID+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tmpFile.Write(data)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+
+	err = os.Rename(tmpFile.Name(), store.path(snippet.ID))
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, err
+	}
+
+	return snippet, nil
+}
+
+//Get reads the snippet from the store directory
+func (store *FileSnippetStore) Get(id string) (*Snippet, error) {
+	if !isValidSnippetID(id) {
+		return nil, ErrSnippetNotFound
+	}
+
+	data, err := ioutil.ReadFile(store.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSnippetNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snippet := Snippet{}
+	err = json.Unmarshal(data, &snippet)
+	if err != nil {
+		return nil, err
+	}
+
+	if store.limits.isExpired(&snippet) {
+		os.Remove(store.path(id))
+		return nil, ErrSnippetNotFound
+	}
+
+	return &snippet, nil
+}
+
+//Purge removes the expired snippets from the store directory
+func (store *FileSnippetStore) Purge() error {
+	if store.limits.Expiry <= 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		//a snippet is never older than its file, skip the recently written ones
+		if time.Since(entry.ModTime()) <= store.limits.Expiry {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		_, err := store.Get(id)
+		if err == ErrSnippetNotFound {
+			os.Remove(store.path(id))
+		}
+	}
+
+	return nil
+}
+
+//NewFileSnippetStore creates a filesystem snippet store, creating dir if required
+func NewFileSnippetStore(dir string, limits SnippetLimits) (*FileSnippetStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	store := FileSnippetStore{}
+	store.dir = dir
+	store.limits = limits
+	store.lock = &sync.Mutex{}
+
+	return &store, nil
+}
+
+//purgeSnippets periodically removes expired snippets from the store
+func purgeSnippets(store SnippetStore, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		store.Purge()
+	}
+}
+
+//SnippetOutput Represents the output of the sharing endpoints
+type SnippetOutput struct {
+	Error       bool     `json:"error"`
+	ErrorString string   `json:"errorString"`
+	URL         string   `json:"url"`
+	Snippet     *Snippet `json:"snippet"`
+}
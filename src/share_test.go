@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testProgram string = "package main\n\nfunc main() {}\n"
+
+func newTestSnippetStore() *MemorySnippetStore {
+	return NewMemorySnippetStore(DefaultConfig().SnippetLimits())
+}
+
+//age moves the creation time of a stored snippet back by duration
+func age(store *MemorySnippetStore, id string, duration time.Duration) {
+	store.lock.Lock()
+	store.snippets[id].Created = store.snippets[id].Created.Add(-duration)
+	store.lock.Unlock()
+}
+
+func TestSnippetPutGet(t *testing.T) {
+	store := newTestSnippetStore()
+
+	snippet, err := store.Put(testProgram)
+	if err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if snippet.ID != SnippetID(testProgram) || !isValidSnippetID(snippet.ID) {
+		t.Errorf("Put() stored the snippet as %q, want %q", snippet.ID, SnippetID(testProgram))
+	}
+
+	found, err := store.Get(snippet.ID)
+	if err != nil {
+		t.Fatalf("Get(%q) = %v", snippet.ID, err)
+	}
+	if found.Program != testProgram {
+		t.Errorf("Get(%q) returned %q, want %q", snippet.ID, found.Program, testProgram)
+	}
+}
+
+func TestSnippetGetUnknown(t *testing.T) {
+	store := newTestSnippetStore()
+
+	_, err := store.Get(SnippetID(testProgram))
+	if err != ErrSnippetNotFound {
+		t.Errorf("Get() of an unknown snippet = %v, want ErrSnippetNotFound", err)
+	}
+}
+
+func TestSnippetIDIsContentAddressed(t *testing.T) {
+	if SnippetID(testProgram) != SnippetID(testProgram) {
+		t.Error("SnippetID() differs for the same program")
+	}
+	if SnippetID(testProgram) == SnippetID(testProgram+"\n") {
+		t.Error("SnippetID() is the same for different programs")
+	}
+	if len(SnippetID(testProgram)) != SnippetIDLength {
+		t.Errorf("SnippetID() has %d characters, want %d", len(SnippetID(testProgram)), SnippetIDLength)
+	}
+
+	for _, id := range []string{"", "abc", "ABCDEFGHIJK", "abcdefghij1", "abcdefghijkl"} {
+		if isValidSnippetID(id) {
+			t.Errorf("isValidSnippetID(%q) = true", id)
+		}
+	}
+}
+
+func TestSnippetRejectsEmpty(t *testing.T) {
+	store := newTestSnippetStore()
+
+	for _, program := range []string{"", " \n\t"} {
+		_, err := store.Put(program)
+		if err != ErrSnippetEmpty {
+			t.Errorf("Put(%q) = %v, want ErrSnippetEmpty", program, err)
+		}
+	}
+}
+
+func TestSnippetRejectsTooLarge(t *testing.T) {
+	store := NewMemorySnippetStore(SnippetLimits{MaxSize: 1 << 10})
+
+	program := "package main\n//" + strings.Repeat("x", 1<<10) + "\n"
+	_, err := store.Put(program)
+	if err != ErrSnippetTooLarge {
+		t.Errorf("Put() of %d bytes = %v, want ErrSnippetTooLarge", len(program), err)
+	}
+
+	_, err = store.Put(testProgram)
+	if err != nil {
+		t.Errorf("Put() of %d bytes = %v", len(testProgram), err)
+	}
+}
+
+func TestSnippetExpiry(t *testing.T) {
+	store := NewMemorySnippetStore(SnippetLimits{Expiry: time.Hour})
+
+	snippet, _ := store.Put(testProgram)
+	age(store, snippet.ID, 2*time.Hour)
+
+	_, err := store.Get(snippet.ID)
+	if err != ErrSnippetNotFound {
+		t.Errorf("Get() of an expired snippet = %v, want ErrSnippetNotFound", err)
+	}
+
+	//sharing the program again refreshes it
+	store.Put(testProgram)
+	_, err = store.Get(snippet.ID)
+	if err != nil {
+		t.Errorf("Get() of a shared again snippet = %v", err)
+	}
+}
+
+func TestSnippetWithoutExpiry(t *testing.T) {
+	store := NewMemorySnippetStore(SnippetLimits{})
+
+	snippet, _ := store.Put(testProgram)
+	age(store, snippet.ID, 365*24*time.Hour)
+
+	_, err := store.Get(snippet.ID)
+	if err != nil {
+		t.Errorf("Get() of a year old snippet = %v, want it kept", err)
+	}
+}
+
+func TestSnippetPurge(t *testing.T) {
+	store := NewMemorySnippetStore(SnippetLimits{Expiry: time.Hour})
+
+	expired, _ := store.Put(testProgram)
+	age(store, expired.ID, 2*time.Hour)
+	fresh, _ := store.Put(testProgram + "//fresh\n")
+
+	err := store.Purge()
+	if err != nil {
+		t.Fatalf("Purge() = %v", err)
+	}
+
+	if _, ok := store.snippets[expired.ID]; ok {
+		t.Error("Purge() kept an expired snippet")
+	}
+	if _, ok := store.snippets[fresh.ID]; !ok {
+		t.Error("Purge() removed a snippet that has not expired")
+	}
+}
+
+func TestSnippetCollision(t *testing.T) {
+	store := newTestSnippetStore()
+
+	//another program already holds the ID of testProgram
+	id := SnippetID(testProgram)
+	store.snippets[id] = &Snippet{ID: id, Program: "package other\n", Created: time.Now().UTC()}
+
+	_, err := store.Put(testProgram)
+	if err != ErrSnippetCollision {
+		t.Fatalf("Put() over another program = %v, want ErrSnippetCollision", err)
+	}
+	if store.snippets[id].Program != "package other\n" {
+		t.Error("Put() replaced the program holding the ID")
+	}
+}
+
+func newTestFileSnippetStore(t *testing.T, limits SnippetLimits) *FileSnippetStore {
+	t.Helper()
+
+	store, err := NewFileSnippetStore(filepath.Join(t.TempDir(), "snippets"), limits)
+	if err != nil {
+		t.Fatalf("NewFileSnippetStore() = %v", err)
+	}
+
+	return store
+}
+
+//writeSnippetFile stores snippet as the file store does, last written age ago
+func writeSnippetFile(t *testing.T, store *FileSnippetStore, snippet *Snippet, age time.Duration) {
+	t.Helper()
+
+	data, _ := json.Marshal(snippet)
+	err := ioutil.WriteFile(store.path(snippet.ID), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := time.Now().Add(-age)
+	os.Chtimes(store.path(snippet.ID), written, written)
+}
+
+func TestFileSnippetPutGet(t *testing.T) {
+	store := newTestFileSnippetStore(t, DefaultConfig().SnippetLimits())
+
+	snippet, err := store.Put(testProgram)
+	if err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+
+	//a store opened on the same directory serves it
+	reopened, _ := NewFileSnippetStore(store.dir, store.limits)
+	found, err := reopened.Get(snippet.ID)
+	if err != nil || found.Program != testProgram {
+		t.Fatalf("Get(%q) = %v, %v, want the program", snippet.ID, found, err)
+	}
+
+	//the snippet is renamed into place, no temporary file is left
+	entries, _ := ioutil.ReadDir(store.dir)
+	if len(entries) != 1 || entries[0].Name() != snippet.ID+".json" {
+		names := make([]string, 0)
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("Store directory holds %v, want only %s.json", names, snippet.ID)
+	}
+}
+
+func TestFileSnippetGetInvalid(t *testing.T) {
+	store := newTestFileSnippetStore(t, DefaultConfig().SnippetLimits())
+
+	for _, id := range []string{SnippetID(testProgram), "../../etc/pa", "short"} {
+		_, err := store.Get(id)
+		if err != ErrSnippetNotFound {
+			t.Errorf("Get(%q) = %v, want ErrSnippetNotFound", id, err)
+		}
+	}
+}
+
+func TestFileSnippetRejects(t *testing.T) {
+	store := newTestFileSnippetStore(t, SnippetLimits{MaxSize: 16})
+
+	if _, err := store.Put(" \n"); err != ErrSnippetEmpty {
+		t.Errorf("Put() of an empty program = %v, want ErrSnippetEmpty", err)
+	}
+	if _, err := store.Put(testProgram); err != ErrSnippetTooLarge {
+		t.Errorf("Put() of %d bytes = %v, want ErrSnippetTooLarge", len(testProgram), err)
+	}
+}
+
+func TestFileSnippetCollision(t *testing.T) {
+	store := newTestFileSnippetStore(t, DefaultConfig().SnippetLimits())
+
+	id := SnippetID(testProgram)
+	writeSnippetFile(t, store, &Snippet{ID: id, Program: "package other\n", Created: time.Now().UTC()}, 0)
+
+	_, err := store.Put(testProgram)
+	if err != ErrSnippetCollision {
+		t.Fatalf("Put() over another program = %v, want ErrSnippetCollision", err)
+	}
+
+	found, _ := store.Get(id)
+	if found == nil || found.Program != "package other\n" {
+		t.Error("Put() replaced the program holding the ID")
+	}
+
+	//sharing the same program again is not a collision
+	_, err = store.Put("package other\n")
+	if err != nil {
+		t.Errorf("Put() of the stored program = %v", err)
+	}
+}
+
+func TestFileSnippetExpiryOnRead(t *testing.T) {
+	store := newTestFileSnippetStore(t, SnippetLimits{Expiry: time.Hour})
+
+	id := SnippetID(testProgram)
+	writeSnippetFile(t, store, &Snippet{ID: id, Program: testProgram, Created: time.Now().Add(-2 * time.Hour)}, 2*time.Hour)
+
+	_, err := store.Get(id)
+	if err != ErrSnippetNotFound {
+		t.Fatalf("Get() of an expired snippet = %v, want ErrSnippetNotFound", err)
+	}
+	if _, err := os.Stat(store.path(id)); !os.IsNotExist(err) {
+		t.Error("Get() kept the file of an expired snippet")
+	}
+
+	//an expired snippet does not collide
+	_, err = store.Put(testProgram)
+	if err != nil {
+		t.Errorf("Put() over an expired snippet = %v", err)
+	}
+}
+
+func TestFileSnippetPurge(t *testing.T) {
+	store := newTestFileSnippetStore(t, SnippetLimits{Expiry: time.Hour})
+
+	old := time.Now().Add(-2 * time.Hour)
+	expired := &Snippet{ID: SnippetID("package expired\n"), Program: "package expired\n", Created: old}
+	writeSnippetFile(t, store, expired, 2*time.Hour)
+
+	//a recent file is skipped without reading it
+	recent := &Snippet{ID: SnippetID("package recent\n"), Program: "package recent\n", Created: old}
+	writeSnippetFile(t, store, recent, 0)
+
+	fresh, _ := store.Put(testProgram)
+
+	err := store.Purge()
+	if err != nil {
+		t.Fatalf("Purge() = %v", err)
+	}
+
+	for _, check := range []struct {
+		id   string
+		kept bool
+	}{{expired.ID, false}, {recent.ID, true}, {fresh.ID, true}} {
+		_, err := os.Stat(store.path(check.id))
+		if kept := err == nil; kept != check.kept {
+			t.Errorf("Purge() kept %s = %v, want %v", check.id, kept, check.kept)
+		}
+	}
+}
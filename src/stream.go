@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+)
+
+//outputStreamContext job context value receiving the output of the program as it runs
+const outputStreamContext contextKey = "outputStream"
+
+//outputStream returns the receiver of the output of the program, nil when the output is not streamed
+func outputStream(ctx context.Context) func([]byte) {
+	stream, _ := ctx.Value(outputStreamContext).(func([]byte))
+	return stream
+}
+
+//StreamOutput Represents a chunk of the output of a running program
+type StreamOutput struct {
+	Output string `json:"output"`
+}
+
+//EventStream writes server-sent events, the output of the program may be sent
+//from several goroutines and is dropped once the stream is closed
+type EventStream struct {
+	lock       *sync.Mutex
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	closed     bool
+
+	//pending end of the output cut in the middle of a UTF-8 character
+	pending []byte
+}
+
+//send writes an event, the caller holds the lock
+func (stream *EventStream) send(event string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(stream.writer, "event: %s\ndata: %s\n\n", event, data)
+	if err != nil {
+		return err
+	}
+
+	return stream.controller.Flush()
+}
+
+//Output sends a chunk of output as an output event
+func (stream *EventStream) Output(data []byte) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if stream.closed {
+		return
+	}
+
+	//events hold whole characters, the cut one is sent with the next chunk
+	data = append(stream.pending, data...)
+	end := len(data)
+	for start := len(data) - 1; start >= 0 && start >= len(data)-utf8.UTFMax; start-- {
+		if utf8.RuneStart(data[start]) {
+			if !utf8.FullRune(data[start:]) {
+				end = start
+			}
+			break
+		}
+	}
+	stream.pending = append([]byte{}, data[end:]...)
+
+	if end > 0 {
+		stream.send("output", StreamOutput{Output: string(data[:end])})
+	}
+}
+
+//Close stops sending the output of the program and sends the result event
+func (stream *EventStream) Close(output *OutputPack) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	stream.closed = true
+	stream.send("result", output)
+}
+
+//NewEventStream answers the request with an event stream
+func NewEventStream(w http.ResponseWriter) *EventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	//proxies must not wait for the end of the answer
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := EventStream{}
+	stream.lock = &sync.Mutex{}
+	stream.writer = w
+	stream.controller = http.NewResponseController(w)
+	stream.controller.Flush()
+
+	return &stream
+}
+
+//streamProgram runs the program parsed by parseProgram, answering its output
+//as output events while it runs, followed by a result event holding the
+//answer of /executeJson
+func streamProgram(ctx context.Context, w *http.ResponseWriter, r *http.Request, channel chan<- bool) {
+	stream := NewEventStream(*w)
+
+	ctx = context.WithValue(ctx, outputStreamContext, stream.Output)
+	output := ExecuteTask(ctx, requestInput(ctx))
+	stream.Close(output)
+
+	channel <- true
+}
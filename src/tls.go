@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//CertificateReloader serves the certificate of tls-cert and tls-key, and the
+//client CAs of tls-client-ca, reloading them when the files change
+type CertificateReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	lock        *sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+
+	//modified modification times of the files when they were loaded
+	modified map[string]time.Time
+}
+
+//modTimes returns the modification times of the files of the reloader
+func (reloader *CertificateReloader) modTimes() (map[string]time.Time, error) {
+	modified := make(map[string]time.Time)
+	for _, path := range []string{reloader.certFile, reloader.keyFile, reloader.clientCAFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modified[path] = info.ModTime()
+	}
+
+	return modified, nil
+}
+
+//Reload loads the files again when one of them changed, the current
+//certificate is kept when the new files are invalid
+func (reloader *CertificateReloader) Reload() (bool, error) {
+	modified, err := reloader.modTimes()
+	if err != nil {
+		return false, err
+	}
+
+	reloader.lock.RLock()
+	changed := false
+	for path, modTime := range modified {
+		changed = changed || !modTime.Equal(reloader.modified[path])
+	}
+	reloader.lock.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var clientCAs *x509.CertPool
+	if reloader.clientCAFile != "" {
+		data, err := ioutil.ReadFile(reloader.clientCAFile)
+		if err != nil {
+			return false, err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("%s holds no PEM certificate", reloader.clientCAFile)
+		}
+	}
+
+	reloader.lock.Lock()
+	reloader.certificate = &certificate
+	reloader.clientCAs = clientCAs
+	reloader.modified = modified
+	reloader.lock.Unlock()
+
+	return true, nil
+}
+
+//clientConfig returns the configuration of a handshake, with the files loaded last
+func (reloader *CertificateReloader) clientConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+
+	config := reloader.TLSConfig()
+	config.GetConfigForClient = nil
+	config.Certificates = []tls.Certificate{*reloader.certificate}
+	if reloader.clientCAs != nil {
+		config.ClientCAs = reloader.clientCAs
+		config.ClientAuth = reloader.clientAuth
+	}
+
+	return config, nil
+}
+
+//TLSConfig returns the configuration of the server, HTTP/2 is offered to the clients supporting it
+func (reloader *CertificateReloader) TLSConfig() *tls.Config {
+	config := tls.Config{}
+	config.MinVersion = tls.VersionTLS12
+	config.NextProtos = []string{"h2", "http/1.1"}
+	config.GetConfigForClient = reloader.clientConfig
+
+	return &config
+}
+
+//NewCertificateReloader loads the certificate and the client CAs of config
+func NewCertificateReloader(config *Config) (*CertificateReloader, error) {
+	reloader := CertificateReloader{}
+	reloader.certFile = config.TLSCert
+	reloader.keyFile = config.TLSKey
+	reloader.clientCAFile = config.TLSClientCA
+	reloader.clientAuth = tls.RequireAndVerifyClientCert
+	if config.TLSClientAuth == "optional" {
+		reloader.clientAuth = tls.VerifyClientCertIfGiven
+	}
+	reloader.lock = &sync.RWMutex{}
+	reloader.modified = make(map[string]time.Time)
+
+	_, err := reloader.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reloader, nil
+}
+
+//watchCertificate periodically reloads the certificate files that changed
+func watchCertificate(reloader *CertificateReloader, interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := reloader.Reload()
+		if err != nil {
+			slog.Error("Failed to reload the TLS certificate, the current one is kept", "error", err)
+			continue
+		}
+		if reloaded {
+			slog.Info("TLS certificate reloaded", "cert", reloader.certFile)
+		}
+	}
+}
+
+//clientCertificate returns the common name of the verified client certificate
+//of the request, empty when the client sent none
+func clientCertificate(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+//newServer creates the server of config, with timeouts bounding how long a
+//client may take to send its headers and keep an idle connection open. The
+//body is bounded by limitBody, ReadTimeout would cancel queued jobs
+func newServer(config *Config, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: config.Listen, Handler: handler}
+	server.ReadHeaderTimeout = config.ReadHeaderTimeout
+	server.IdleTimeout = config.IdleTimeout
+	server.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+
+	return server
+}
+
+//serve serves plain HTTP, or HTTPS and HTTP/2 when reloader is set
+func serve(server *http.Server, reloader *CertificateReloader) {
+	var err error
+	if reloader == nil {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = reloader.TLSConfig()
+		err = server.ListenAndServeTLS("", "")
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal("Failed to serve", err)
+	}
+}